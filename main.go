@@ -1,9 +1,11 @@
 package main
 
 import (
+    "bufio"
     "encoding/json"
     "flag"
     "fmt"
+    "io"
     "os"
     "os/exec"
     "path/filepath"
@@ -11,50 +13,98 @@ import (
     "strings"
     "syscall"
     "text/tabwriter"
+    "text/template"
     "time"
+    "github.com/jagjeet-singh-23/minidocker/pkg/builder"
     "github.com/jagjeet-singh-23/minidocker/pkg/cgroup"
+    "github.com/jagjeet-singh-23/minidocker/pkg/config"
     "github.com/jagjeet-singh-23/minidocker/pkg/container"
     "github.com/jagjeet-singh-23/minidocker/pkg/image"
     "github.com/jagjeet-singh-23/minidocker/pkg/namespace"
     "github.com/jagjeet-singh-23/minidocker/pkg/network"
     "github.com/jagjeet-singh-23/minidocker/pkg/volume"
     "github.com/jagjeet-singh-23/minidocker/pkg/layer"
-    "github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+    "github.com/jagjeet-singh-23/minidocker/pkg/reconcile"
+    "github.com/jagjeet-singh-23/minidocker/pkg/reference"
+    "github.com/jagjeet-singh-23/minidocker/pkg/registry"
+    "github.com/jagjeet-singh-23/minidocker/pkg/snapshot"
+    "github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
+// storageDriver is the snapshotter new containers and builds use (--storage-driver)
+var storageDriver = snapshot.DefaultDriver
+
+// logDriver decides whether new containers keep their output
+var logDriver = config.LogDriverFile
+
 func main() {
+    loadConfig(parseGlobalOptions())
+
     if len(os.Args) < 2 {
-        fmt.Println("Usage: minidocker <command> [args...]")
+        fmt.Println("Usage: minidocker [OPTIONS] <command> [args...]")
+        fmt.Println("Global options:")
+	fmt.Println("  --config=FILE            Config file (default " + config.DefaultPath + ", or $MINIDOCKER_CONFIG)")
+	fmt.Println("  --data-root=DIR          Directory holding all state (default /var/lib/minidocker, or $MINIDOCKER_ROOT)")
+	fmt.Println("  --storage-driver=DRIVER  Root filesystem driver: overlay (default), native or btrfs")
         fmt.Println("Commands:")
 	fmt.Println("  run [options] <image> <command>")
 	fmt.Println("    Options:")
+	fmt.Println("      --name=NAME            Container name (default: random adjective_surname)")
 	fmt.Println("      --memory=MB            Memory limit")
 	fmt.Println("      --cpu=CORES            CPU limit")
-	fmt.Println("      --net=MODE             Network mode (bridge/none)")
+	fmt.Println("      --network=NET          Network: bridge (default), none or a user-defined network (--net)")
+	fmt.Println("      --ip=ADDRESS           Static IPv4 address on the bridge network")
 	fmt.Println("      -d                     Detached mode")
 	fmt.Println("      -v SRC:DEST[:ro]       Volume mount")
 	fmt.Println("      -p HOST:CONTAINER      Port mapping")
 	fmt.Println("      -e KEY=VALUE           Environment variable")
 	fmt.Println("      -w PATH                Working directory")
-        fmt.Println("  ps                                           - List containers")
+        fmt.Println("  ps [-s]                                      - List containers")
         fmt.Println("  stop <container-id>                          - Stop a container")
         fmt.Println("  rm <container-id>                            - Remove a container")
         fmt.Println("  exec <container-id> <command>                - Execute in container")
         fmt.Println("  logs <container-id>                          - Show container logs")
+	fmt.Println("  diff <container-id>                          - Show changes to a container's filesystem")
         fmt.Println("  images                                       - List available images")
+	fmt.Println("  tag <source> <target[:tag]>                  - Create a tag that refers to an image")
+	fmt.Println("  rmi [-f] <image> [image...]                  - Remove one or more images")
+	fmt.Println("  history [--no-trunc] [--format T] <image>    - Show how an image was built")
         fmt.Println("  volume create <name>                         - Create a volume")
         fmt.Println("  volume ls                                    - List volumes")
         fmt.Println("  volume rm <name>                             - Remove a volume")
         fmt.Println("  volume inspect <name>                        - Inspect a volume")
+	fmt.Println("  network create [--subnet CIDR] <name>        - Create a network")
+	fmt.Println("  network ls                                   - List networks")
+	fmt.Println("  network rm <network...>                      - Remove networks")
+	fmt.Println("  network inspect <network>                    - Inspect a network")
+	fmt.Println("  network connect [--ip IP] <network> <container> - Connect a running container to a network")
+	fmt.Println("  network disconnect <network> <container>     - Disconnect a container from a network")
+	fmt.Println("  inspect <container|network|image> [...]      - Show low-level information as JSON")
         fmt.Println("  layer create <dir> [comment]                 - Create a layer")
         fmt.Println("  layer ls                                     - List layers")
         fmt.Println("  layer inspect <id>                           - Inspect a layer")
         fmt.Println("  layer rm <id>                                - Remove a layer")
-        fmt.Println("  build <name> <layer-id1> [layer-id2...]      - Build image from layers")
-	fmt.Println("  commit <container-id> <new-image-name>       - Create image from container")
+        fmt.Println("  build [-t name[:tag]] [-f file] <context>    - Build an image from a Dockerfile")
+        fmt.Println("  image create <name[:tag]> <layer-id...>      - Create image from layers")
+	fmt.Println("  image migrate [name...]                      - Convert monolithic images into single-layer images")
+	fmt.Println("  commit [-m MSG] [-c INST] <container> [name]  - Create image from container")
+	fmt.Println("  pull [--insecure] <name[:tag|@digest]>       - Pull an image from a registry")
+	fmt.Println("  push [--insecure] <name[:tag]>               - Push an image to a registry")
+	fmt.Println("  login [-u USER] [-p PASS] [server]           - Log in to a registry")
+        os.Exit(1)
+    }
+
+    // New layers are stored as compressed blobs when this is gzip or zstd
+    if err := layer.SetCompression(os.Getenv("MINIDOCKER_LAYER_COMPRESSION")); err != nil {
+        fmt.Printf("Error: MINIDOCKER_LAYER_COMPRESSION: %v\n", err)
         os.Exit(1)
     }
 
+    // Fix up state left behind by a crash or reboot before acting on it
+    if err := reconcile.Run(); err != nil {
+        fmt.Printf("Warning: failed to reconcile state: %v\n", err)
+    }
+
     command := os.Args[1]
     
     switch command {
@@ -70,31 +120,104 @@ func main() {
         execContainer()
     case "logs":
         showLogs()
+    case "diff":
+	showDiff()
     case "images":
         listImages()
+    case "tag":
+        tagImage()
+    case "rmi":
+        removeImages()
+    case "history":
+        showHistory()
     case "volume":
         handleVolumeCommand()
+    case "network":
+	handleNetworkCommand()
+    case "inspect":
+	inspectObjects()
     case "port":
 	showPorts()
     case "layer":
         handleLayerCommand()
     case "build":
         buildImage()
+    case "image":
+        handleImageCommand()
     case "commit":
 	commitContainer()
+    case "pull":
+	pullImage()
+    case "push":
+	pushImage()
+    case "login":
+	loginRegistry()
     default:
         fmt.Printf("Unknown command: %s\n", command)
         os.Exit(1)
     }
 }
 
+// parseGlobalOptions handles the options given before the command and
+// removes them from os.Args
+func parseGlobalOptions() map[string]string {
+	options := make(map[string]string)
+	for len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "--") {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(os.Args[1], "--"), "=")
+		rest := os.Args[2:]
+		if !hasValue {
+			if len(rest) == 0 {
+				fmt.Printf("Error: option --%s needs a value\n", name)
+				os.Exit(1)
+			}
+			value, rest = rest[0], rest[1:]
+		}
+
+		switch name {
+		case "config", "data-root", "storage-driver":
+			options[name] = value
+		default:
+			fmt.Printf("Error: unknown option --%s\n", name)
+			os.Exit(1)
+		}
+		os.Args = append(os.Args[:1], rest...)
+	}
+	return options
+}
+
+// loadConfig reads the config file and applies it with the command line
+// options on top
+func loadConfig(options map[string]string) {
+	cfg, err := config.Load(options["config"])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if dataRoot, ok := options["data-root"]; ok {
+		cfg.DataRoot = dataRoot
+	}
+	if driver, ok := options["storage-driver"]; ok {
+		cfg.StorageDriver = driver
+	}
+
+	if err := cfg.Apply(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	storageDriver = cfg.StorageDriver
+	logDriver = cfg.LogDriver
+}
+
 func runContainer() {
     // Parse run command flags
     runCmd := flag.NewFlagSet("run", flag.ExitOnError)
     memoryMB := runCmd.Int("memory", 0, "Memory limit in MB")
     cpuCores := runCmd.Float64("cpu", 0, "CPU limit (e.g., 0.5 for half a core)")
     detach := runCmd.Bool("d", false, "Run container in background")
-    networkMode := runCmd.String("net", "bridge", "Network mode (bridge or none)")
+    networkMode := runCmd.String("net", network.DefaultNetwork, "Network mode (bridge or none)")
+    runCmd.StringVar(networkMode, "network", network.DefaultNetwork, "Network to connect the container to: bridge, none or a user-defined network")
+    containerName := runCmd.String("name", "", "Assign a name to the container")
+    staticIP := runCmd.String("ip", "", "IPv4 address for the container (default: the next free one)")
 
     var volumeSpecs arrayFlags
     var portSpecs arrayFlags
@@ -108,8 +231,8 @@ func runContainer() {
     runCmd.Parse(os.Args[2:])
     
     args := runCmd.Args()
-    if len(args) < 2 {
-        fmt.Println("Usage: minidocker run [--memory=MB] [--cpu=CORES] <image> <command>")
+    if len(args) < 1 {
+        fmt.Println("Usage: minidocker run [--memory=MB] [--cpu=CORES] <image> [command]")
         os.Exit(1)
     }
     
@@ -117,72 +240,126 @@ func runContainer() {
     command := args[1:]
 
     // Validate network mode
-    if *networkMode != "bridge" && *networkMode != "none" {
-	    fmt.Printf("Invalid network mode: %s (use 'bridge' or 'none')", *networkMode)
+    var netw *network.Network
+    if *networkMode != network.NoNetwork {
+	    n, err := network.GetNetwork(*networkMode)
+	    if err != nil {
+		    fmt.Printf("Invalid network mode: %v (use 'bridge', 'none' or a network from 'network ls')\n", err)
+		    os.Exit(1)
+	    }
+	    netw = n
+	    *networkMode = netw.Name
+    }
+
+    if len(portSpecs) > 0 && netw == nil {
+	    fmt.Println("Error: Port mapping requires a network (--network)")
 	    os.Exit(1)
     }
 
-    if len(portSpecs) > 0 && *networkMode != "bridge" {
-	    fmt.Println("Error: Port mapping requires bridge networking (--net=bridge)")
+    if *staticIP != "" && netw == nil {
+	    fmt.Println("Error: --ip requires a network (--network)")
 	    os.Exit(1)
     }
 
+    // Catch an unusable name before preparing the root filesystem
+    if *containerName != "" {
+	    if err := container.ValidateName(*containerName); err != nil {
+		    fmt.Printf("Error: %v\n", err)
+		    os.Exit(1)
+	    }
+	    if c, err := container.FindContainerByPrefix(*containerName); err == nil && c.Name == *containerName {
+		    fmt.Printf("Error: the container name %q is already in use by container %s\n", c.Name, container.ShortID(c.ID))
+		    os.Exit(1)
+	    }
+    }
+
     // Get image rootfs path
     var rootfsPath string
-    var overlayMount *overlay.OverlayMount
-    var isLayered bool
-    var containerID string
+    var snapshotter snapshot.Snapshotter
+    driver := storageDriver
+    var imageID string
+
+    // The container ID names its root filesystem
+    containerID, err := container.GenerateContainerID()
+    if err != nil {
+	    fmt.Printf("Error: %v\n", err)
+	    os.Exit(1)
+    }
+
+    // Store the image as the user would write it, e.g. "ubuntu:latest"
+    if ref, err := reference.Parse(imageName); err == nil {
+	    imageName = ref.FamiliarString()
+    }
 
     if image.IsLayeredImage(imageName) {
 	    // Layered image - use OverlayFS
-	    isLayered = true
-
 	    // Get image manifest
 	    manifest, err := image.GetImageManifest(imageName)
 	    if err != nil {
 		    fmt.Printf("Error loading image manifest: %v\n", err)
 		    os.Exit(1)
 	    }
+	    imageID = manifest.ID
 
-	    fmt.Printf("Using layered image with %d layers\n", len(manifest.Layers))
-
-	    // Get layer paths
-	    var layerPaths []string
-	    for _, layerID := range manifest.Layers {
-		    l, err := layer.GetLayer(layerID)
-		    if err != nil {
-			    fmt.Printf("Error: layer %s not found: %v\n", layerID, err)
-			    os.Exit(1)
-		    }
-		    layerPaths = append(layerPaths, l.Path)
+	    // Image config supplies defaults for what wasn't given on the command line
+	    command = append(append([]string(nil), manifest.Config.Entrypoint...), command...)
+	    if len(args) == 1 {
+		    command = append(command, manifest.Config.Cmd...)
+	    }
+	    envVars = append(append(arrayFlags(nil), manifest.Config.Env...), envVars...)
+	    if *workingDir == "" {
+		    *workingDir = manifest.Config.WorkingDir
 	    }
 
-	    // Create container ID first (we need it for overlay)
-	    containerID = container.GenerateContainerID()
+	    fmt.Printf("Using layered image with %d layers\n", len(manifest.Layers))
 
-	    // Create overlay mount
-	    overlayMount, err = overlay.CreateOverlay(containerID, layerPaths)
+	    // Prepare the container's root filesystem with the storage driver
+	    snapshotter, err = snapshot.Get(storageDriver)
+	    if err != nil {
+		    fmt.Printf("Error: %v\n", err)
+		    os.Exit(1)
+	    }
+	    rootfsPath, err = snapshotter.Prepare(containerID, manifest.Layers)
 	    if err != nil {
-		    fmt.Printf("Error creating overlay: %v\n", err)
+		    fmt.Printf("Error preparing root filesystem: %v\n", err)
 		    os.Exit(1)
 	    }
 
-	    // Use merged directory as rootfs
-	    rootfsPath = overlayMount.MergedDir
-
-	    fmt.Printf("Overlay filesystem mounted at %s\n", rootfsPath)
+	    fmt.Printf("Root filesystem (%s) ready at %s\n", storageDriver, rootfsPath)
 
     } else {
-	    // Non-layered image - use direct rootfs
-	    var err error
-	    rootfsPath, err = image.GetImageRootfs(imageName)
+	    // Non-layered image - its rootfs is the read-only lower directory
+	    // of an overlay, so containers never modify the image itself
+	    imageRootfs, err := image.GetImageRootfs(imageName)
 	    if err != nil {
 		    fmt.Printf("Error: %v\n", err)
 		    os.Exit(1)
 	    }
 
-	    // Generate container ID for non-layered image
-	    containerID = container.GenerateContainerID()
+	    // Only overlay can stack a container on a plain directory
+	    if driver != snapshot.DefaultDriver && driver != "overlay2" {
+		    fmt.Printf("Warning: monolithic image %s runs on the %s storage driver, not %s; 'minidocker image migrate %s' converts it to layers\n", imageName, snapshot.DefaultDriver, driver, imageName)
+	    }
+	    driver = snapshot.DefaultDriver
+	    if snapshotter, err = snapshot.Get(driver); err != nil {
+		    fmt.Printf("Error: %v\n", err)
+		    os.Exit(1)
+	    }
+	    rootfsPath, err = snapshot.PrepareRootfs(containerID, imageRootfs)
+	    if err != nil {
+		    fmt.Printf("Error preparing root filesystem: %v\n", err)
+		    os.Exit(1)
+	    }
+
+	    fmt.Printf("Root filesystem (%s) ready at %s\n", driver, rootfsPath)
+    }
+
+    if len(command) == 0 {
+	    fmt.Println("Error: no command specified and the image has no CMD or ENTRYPOINT")
+	    if snapshotter != nil {
+		    snapshotter.Remove(containerID)
+	    }
+	    os.Exit(1)
     }
     
     // Parse volume spefications
@@ -201,19 +378,23 @@ func runContainer() {
     for _, portSpec := range portSpecs {
 	    portMapping, err := parsePortSpec(portSpec)
 	    if err != nil {
-		    fmt.Println("Error parsing port spec '%s': %v\n", portSpec, err)
+		    fmt.Printf("Error parsing port spec '%s': %v\n", portSpec, err)
 		    os.Exit(1)
 	    }
 	    ports = append(ports, *portMapping)
     }
 
     // Create container metadata
-    logPath := fmt.Sprintf("/var/lib/minidocker/containers/%s.log", containerID)
+    logPath := ""
+    if logDriver == config.LogDriverFile {
+        logPath = store.Path("containers", containerID+".log")
+    }
 
     containerInfo := &container.Container{
         ID: 	     containerID,
-        Name: 	     containerID,
+        Name: 	     *containerName,
         Image: 	     imageName,
+        ImageID:     imageID,
         Command:     command,
         State:       container.StateCreated,
         Created:     time.Now(),
@@ -223,14 +404,36 @@ func runContainer() {
 	Ports:       ports,
 	Env:         envVars,
 	WorkingDir:  *workingDir,
+	StorageDriver: driver,
+	Rootfs:      rootfsPath,
+    }
+
+    // Reserve the address right before the record is written, so nothing
+    // in between can exit and leave the reservation behind
+    var containerIP string
+    if netw != nil {
+	    containerIP, err = network.AllocateIP(netw.Name, netw.Subnet, containerID, *staticIP)
+	    if err != nil {
+		    fmt.Printf("Error: %v\n", err)
+		    if snapshotter != nil {
+			    snapshotter.Remove(containerID)
+		    }
+		    os.Exit(1)
+	    }
     }
 
-    if err := container.SaveContainer(containerInfo); err != nil {
+    if err := container.CreateContainer(containerInfo); err != nil {
         fmt.Printf("Error saving container: %v\n", err)
+        if netw != nil {
+            network.ReleaseIP(netw.Name, containerID)
+        }
+        if snapshotter != nil {
+            snapshotter.Remove(containerID)
+        }
         os.Exit(1)
     }
 
-    fmt.Printf("Container %s created\n", containerID)
+    fmt.Printf("Container %s created (%s)\n", containerID, containerInfo.Name)
     
     if *memoryMB > 0 || *cpuCores > 0 {
         limits := cgroup.ContainerLimits{
@@ -250,9 +453,9 @@ func runContainer() {
     }
 
     // Setup bridge network if needed
-    enableNetwork := *networkMode == "bridge"
+    enableNetwork := netw != nil
     if enableNetwork {
-	    if err := network.SetupBridge(); err != nil {
+	    if err := netw.SetupBridge(); err != nil {
 		    fmt.Printf("Error setting up bridge: %v\n", err)
 		    os.Exit(1)
 	    }
@@ -295,15 +498,25 @@ func runContainer() {
     containerInfo.PID = pid
     container.SaveContainer(containerInfo)
 
-    var containerIP string
     // Setup container network if bridge mode
     if enableNetwork {
-	    ip, err := network.SetupContainerNetwork(containerID, pid)
+	    vethHost, err := network.SetupContainerNetwork(netw, pid, containerIP, "eth0")
 	    if err != nil {
 		    fmt.Printf("Warning: failed to setup network: %v\n", err)
+		    network.ReleaseIP(netw.Name, containerID)
+		    containerIP = ""
 	    } else {
-		    containerIP = ip
 		    containerInfo.IPAddress = containerIP
+		    containerInfo.VethHost = vethHost
+		    containerInfo.Networks = map[string]*network.Endpoint{
+			    netw.Name: {
+				    NetworkID: netw.ID,
+				    Interface: "eth0",
+				    IPAddress: containerIP,
+				    Gateway:   netw.Gateway,
+				    VethHost:  vethHost,
+			    },
+		    }
 		    container.SaveContainer(containerInfo)
 		    fmt.Printf("Container network configured with IP: %s\n", containerIP)
 
@@ -330,7 +543,7 @@ func runContainer() {
     }
     if *detach {
         // Detach mode - run in goroutine
-        fmt.Printf("Container %s started in background with PID %d\n", containerID[:12], pid)
+        fmt.Printf("Container %s started in background with PID %d\n", container.ShortID(containerID), pid)
         
         // Start goroutine to monitor container
         go func() {
@@ -358,24 +571,21 @@ func runContainer() {
                 }
             }
 
-	    // Cleanup network
-            if enableNetwork {
-                network.CleanupContainerNetwork(containerID)
-            }
-
 	    // Clean up mounts
 	    cleanupMounts(rootfsPath, mounts)
-	    // if isLayered && overlayMount != nil {
-	    //         overlay.CleanupOverlay(containerID)
+	    // if snapshotter != nil {
+	    //         snapshotter.Remove(containerID)
 	    // }
            
-            // Update final state
-            containerInfo.State = container.StateExited
-            containerInfo.Finished = time.Now()
-            containerInfo.ExitCode = exitCode
-            containerInfo.PID = 0
-	    containerInfo.IPAddress = ""
-            container.SaveContainer(containerInfo)
+            // Update final state, leaving every network the container is on by now
+            container.UpdateContainer(containerID, func(c *container.Container) error {
+                releaseNetworks(c)
+                c.State = container.StateExited
+                c.Finished = time.Now()
+                c.ExitCode = exitCode
+                c.PID = 0
+                return nil
+            })
             
             // Cleanup cgroup
             if *memoryMB > 0 || *cpuCores > 0 {
@@ -413,34 +623,56 @@ func runContainer() {
 	    }
     }
 
-    // Cleanup network
-    if enableNetwork {
-	    network.CleanupContainerNetwork(containerID)
-    }
-
     cleanupMounts(rootfsPath, mounts)
-    if isLayered && overlayMount != nil {
-            overlay.CleanupOverlay(containerInfo.ID)
+    if snapshotter != nil {
+            snapshotter.Remove(containerInfo.ID)
     }
     
-    // Update final state
-    containerInfo.State = container.StateExited
-    containerInfo.Finished = time.Now()
-    containerInfo.ExitCode = exitCode
-    containerInfo.PID = 0
-    containerInfo.IPAddress = ""
-    container.SaveContainer(containerInfo)
+    // Update final state, leaving every network the container is on by now
+    container.UpdateContainer(containerID, func(c *container.Container) error {
+        releaseNetworks(c)
+        c.State = container.StateExited
+        c.Finished = time.Now()
+        c.ExitCode = exitCode
+        c.PID = 0
+        return nil
+    })
+}
+
+// releaseNetworks removes a container's interfaces and frees their addresses
+func releaseNetworks(c *container.Container) {
+	network.CleanupContainerNetwork(c.VethHost)
+	if c.NetworkMode != "" && c.NetworkMode != network.NoNetwork {
+		network.ReleaseIP(c.NetworkMode, c.ID)
+	}
+	for name, endpoint := range c.Networks {
+		network.CleanupContainerNetwork(endpoint.VethHost)
+		network.ReleaseIP(name, c.ID)
+	}
+	c.Networks = nil
+	c.IPAddress = ""
+	c.VethHost = ""
 }
 
 func listContainers() {
+	psCmd := flag.NewFlagSet("ps", flag.ExitOnError)
+	var showSize bool
+	psCmd.BoolVar(&showSize, "s", false, "Show the size of each container's writable layer")
+	psCmd.BoolVar(&showSize, "size", false, "Show the size of each container's writable layer")
+	psCmd.Parse(os.Args[2:])
+
 	containers, err := container.ListContainers()
 	if err != nil {
-		fmt.Println("Error listing containers: %v\n", err)
+		fmt.Printf("Error listing containers: %v\n", err)
 		os.Exit(1)
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tSTATE\tCREATED")
+	if showSize {
+		fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tSTATE\tCREATED\tSIZE\tNAMES")
+	} else {
+		fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tSTATE\tCREATED\tNAMES")
+	}
 
 	for _, c := range containers {
 		created := c.Created.Format("2006-01-02 15:04:05")
@@ -451,12 +683,30 @@ func listContainers() {
 				commandStr += "..."
 			}
 		}
-	        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", 
-            		c.ID[:12], c.Image, commandStr, c.State, created)
+		if showSize {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				container.ShortID(c.ID), containerImageName(c), commandStr, c.State, created, containerSize(c), c.Name)
+			continue
+		}
+	        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", 
+            		container.ShortID(c.ID), containerImageName(c), commandStr, c.State, created, c.Name)
 	}
 	w.Flush()
 }
 
+// containerSize formats the space a container's root filesystem takes on top of its image
+func containerSize(c *container.Container) string {
+	snapshotter, err := snapshot.Get(c.StorageDriver)
+	if err != nil {
+		return "-"
+	}
+	size, err := snapshotter.Usage(c.ID)
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
+}
+
 func stopContainer() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: minidocker stop <container-id>")
@@ -472,7 +722,7 @@ func stopContainer() {
 	}
 
 	if containerInfo.State != container.StateRunning {
-		fmt.Printf("Container %s is not running (state: %s)\n", containerInfo.ID[:12], containerInfo.State)
+		fmt.Printf("Container %s is not running (state: %s)\n", container.ShortID(containerInfo.ID), containerInfo.State)
 		return
 	}
 
@@ -480,9 +730,14 @@ func stopContainer() {
 		if err := syscall.Kill(containerInfo.PID, syscall.SIGTERM); err != nil {
 			fmt.Printf("Error stopping container: %v\n", err)
 		} else {
-			containerInfo.State = container.StateStopped
-			containerInfo.Finished = time.Now()
-			container.SaveContainer(containerInfo)
+			// The container's monitor may record its exit meanwhile
+			container.UpdateContainer(containerInfo.ID, func(c *container.Container) error {
+				if c.State == container.StateRunning {
+					c.State = container.StateStopped
+					c.Finished = time.Now()
+				}
+				return nil
+			})
 			fmt.Printf("Container %s stopped\n", containerID)
 		}
 	}
@@ -507,15 +762,18 @@ func removeContainer() {
 		os.Exit(1)
 	}
 
-	if err := container.RemoveContainer(containerID); err != nil {
+	if err := container.RemoveContainer(containerInfo.ID); err != nil {
 		fmt.Printf("Error removing container: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Clean up resources
-	cgroup.RemoveCgroup(containerID)
+	cgroup.RemoveCgroup(containerInfo.ID)
+	releaseNetworks(containerInfo)
 
-	overlay.CleanupOverlay(containerInfo.ID)
+	if snapshotter, err := snapshot.Get(containerInfo.StorageDriver); err == nil {
+		snapshotter.Remove(containerInfo.ID)
+	}
 
 	fmt.Printf("Container %s removed\n", containerID)
 }
@@ -527,7 +785,7 @@ func showLogs() {
 	}
 
 	containerID := os.Args[2]
-	containerInfo, err := container.LoadContainer(containerID)
+	containerInfo, err := container.FindContainerByPrefix(containerID)
 
 	if err != nil {
 		fmt.Printf("Container %s not found", containerID)
@@ -547,6 +805,46 @@ func showLogs() {
 	}
 }
 
+// showDiff lists the paths a container added (A), changed (C) or deleted (D)
+func showDiff() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: minidocker diff <container-id>")
+		os.Exit(1)
+	}
+
+	containerInfo, err := container.FindContainerByPrefix(os.Args[2])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Containers of monolithic images only have a snapshot since those
+	// are mounted with overlay, which is when storage drivers were recorded
+	baseImage := containerInfo.Image
+	if containerInfo.ImageID != "" {
+		baseImage = containerInfo.ImageID
+	}
+	if _, err := image.GetImageManifest(baseImage); err != nil && containerInfo.StorageDriver == "" {
+		fmt.Println("Error: diff is not supported for containers run directly on a monolithic image's rootfs")
+		os.Exit(1)
+	}
+
+	snapshotter, err := snapshot.Get(containerInfo.StorageDriver)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	changes, err := snapshotter.Changes(containerInfo.ID)
+	if err != nil {
+		fmt.Printf("Error: no filesystem changes recorded for container %s: %v\n", container.ShortID(containerInfo.ID), err)
+		os.Exit(1)
+	}
+
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", change.Kind, change.Path)
+	}
+}
+
 func listImages() {
     images, err := image.ListImages()
     if err != nil {
@@ -554,159 +852,808 @@ func listImages() {
         os.Exit(1)
     }
 
-    fmt.Println("Available images:")
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+
     for _, img := range images {
-        fmt.Printf("  %s\n", img)
+	    id, size := "-", "-"
+	    if img.Layered {
+		    id = image.ShortID(img.ID)
+		    size = fmt.Sprintf("%.2f MB", float64(img.Size)/(1024*1024))
+	    }
+	    fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+		    img.Repository, img.Tag, id, img.Created.Format("2006-01-02 15:04:05"), size)
     }
+    w.Flush()
 }
 
-func execContainer() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: minidocker exec <container-id> <command>")
-		os.Exit(1)
+// containerImageName returns the image a container was created from, or its
+// short ID once that reference points at a different image
+func containerImageName(c *container.Container) string {
+	if c.ImageID == "" {
+		return c.Image
 	}
-
-	containerID := os.Args[2]
-	command := os.Args[3:]
-
-	// Find the container by prefix
-	containerInfo, err := container.FindContainerByPrefix(containerID)
-	if err != nil {
-		fmt.Printf(
-			"Container %s is not running (state: %s)\n", 
-			containerInfo.ID[:12], 
-			containerInfo.State,
-		)
-		os.Exit(1)
+	if id, err := image.ResolveID(c.Image); err != nil || id != c.ImageID {
+		return image.ShortID(c.ImageID)
 	}
+	return c.Image
+}
 
-	if containerInfo.State != container.StateRunning {
-		fmt.Printf("Container %s is not running (state: %s)\n", containerInfo.ID[:12], containerInfo.State)
+func tagImage() {
+	if len(os.Args) != 4 {
+		fmt.Println("Usage: minidocker tag <source-image> <target-image[:tag]>")
+		fmt.Println("Example: minidocker tag ubuntu:24.04 localhost:5000/ubuntu:24.04")
 		os.Exit(1)
 	}
 
-	// Use the nsenter command to enter the container namespace
-	nsenterArgs := []string{
-		"nsenter",
-		"--target",
-		strconv.Itoa(containerInfo.PID),
-		"--pid",
-		"--uts",
-		"--mount",
+	if err := image.TagImage(os.Args[2], os.Args[3]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
-	nsenterArgs = append(nsenterArgs, command...)
+}
 
-	cmd := exec.Command(nsenterArgs[0], nsenterArgs[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func removeImages() {
+	rmiCmd := flag.NewFlagSet("rmi", flag.ExitOnError)
+	var force bool
+	rmiCmd.BoolVar(&force, "f", false, "Force removal of the image")
+	rmiCmd.BoolVar(&force, "force", false, "Force removal of the image")
+	rmiCmd.Parse(os.Args[2:])
 
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error executing command:  %v\n", err)
+	if rmiCmd.NArg() < 1 {
+		fmt.Println("Usage: minidocker rmi [-f|--force] <image> [image...]")
 		os.Exit(1)
 	}
-}
 
-func handleVolumeCommand() {
-    if len(os.Args) < 3 {
-        fmt.Println("Usage: minidocker volume <subcommand>")
-        fmt.Println("Subcommands:")
-        fmt.Println("  create <name>    - Create a volume")
-        fmt.Println("  ls               - List volumes")
-        fmt.Println("  rm <name>        - Remove a volume")
-        fmt.Println("  inspect <name>   - Inspect a volume")
-        os.Exit(1)
-    }
-    
-    subcommand := os.Args[2]
-    
-    switch subcommand {
-    case "create":
-        volumeCreate()
-    case "ls":
-        volumeList()
-    case "rm":
-        volumeRemove()
-    case "inspect":
-        volumeInspect()
-    default:
-        fmt.Printf("Unknown volume subcommand: %s\n", subcommand)
-        os.Exit(1)
-    }
-}
+	failed := false
+	for _, name := range rmiCmd.Args() {
+		if err := removeImage(name, force); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			failed = true
+		}
+	}
 
-func volumeCreate() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: minidocker volume create <name>")
+	if failed {
 		os.Exit(1)
 	}
+}
 
-	volumeName := os.Args[3]
+// removeImage untags an image, deleting it and its unused layers once no
+// tags are left. Images used by a container are only untagged, and only
+// with force; an image in use by a running container is never deleted.
+func removeImage(name string, force bool) error {
+	id, err := image.ResolveID(name)
+	if err != nil {
+		if rootfs, monoErr := image.GetImageRootfs(name); monoErr == nil {
+			return removeMonolithicImage(name, rootfs, force)
+		}
+		return err
+	}
 
-	vol, err := volume.CreateVolume(volumeName)
+	refs, err := image.References(id)
 	if err != nil {
-		fmt.Printf("Error creating volume: %v", err)
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf("Volume %s created\n", vol.Name)
-}
+	byReference := false
+	if r, err := reference.Parse(name); err == nil {
+		for _, ref := range refs {
+			if ref == r.FamiliarString() {
+				name, byReference = ref, true
+			}
+		}
+	}
 
-func volumeList() {
-    volumes, err := volume.ListVolumes()
-    if err != nil {
-        fmt.Printf("Error listing volumes: %v\n", err)
-        os.Exit(1)
-    }
+	// Digest references do not keep an image alive on their own
+	var tags []string
+	for _, ref := range refs {
+		if !strings.Contains(ref, "@") {
+			tags = append(tags, ref)
+		}
+	}
 
-    if len(volumes) == 0 {
-        fmt.Println("No volumes found")
-        return
-    }
+	isDigest := strings.Contains(name, "@")
+	if byReference && ((!isDigest && len(tags) > 1) || (isDigest && len(tags) > 0)) {
+		if _, err := image.Untag(name); err != nil {
+			return err
+		}
+		fmt.Printf("Untagged: %s\n", name)
+		return nil
+	}
 
-    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-    fmt.Fprintln(w, "VOLUME NAME\tDRIVER\tCREATED")
+	if !byReference && len(tags) > 1 && !force {
+		return fmt.Errorf("conflict: unable to delete %s (must be forced) - image is referenced in multiple repositories", image.ShortID(id))
+	}
 
-    for _, vol := range volumes {
-        created := vol.Created.Format("2006-01-02 15:04:05")
-        fmt.Fprintf(w, "%s\t%s\t%s\n", vol.Name, vol.Driver, created)
-    }
-    w.Flush()
-}
+	if user, err := findImageUser(id); err != nil {
+		return err
+	} else if user != nil {
+		running := user.State == container.StateRunning
+		switch {
+		case running && !byReference:
+			return fmt.Errorf("conflict: unable to delete %s (cannot be forced) - image is being used by running container %s", image.ShortID(id), container.ShortID(user.ID))
+		case !force && byReference:
+			return fmt.Errorf("conflict: unable to remove repository reference %q (must force) - container %s is using its referenced image %s", name, container.ShortID(user.ID), image.ShortID(id))
+		case !force:
+			return fmt.Errorf("conflict: unable to delete %s (must be forced) - image is being used by %s container %s", image.ShortID(id), user.State, container.ShortID(user.ID))
+		}
 
-func volumeRemove() {
-    if len(os.Args) < 4 {
-        fmt.Println("Usage: minidocker volume rm <name>")
-        os.Exit(1)
-    }
+		// Forced: drop the tags but keep the image for the container
+		untag := tags
+		if byReference {
+			untag = []string{name}
+		}
+		for _, ref := range untag {
+			if _, err := image.Untag(ref); err != nil {
+				return err
+			}
+			fmt.Printf("Untagged: %s\n", ref)
+		}
+		return nil
+	}
 
-    volumeName := os.Args[3]
+	// Drop the remaining tag and digest references along with the image
+	for _, ref := range refs {
+		if _, err := image.Untag(ref); err != nil {
+			return err
+		}
+		fmt.Printf("Untagged: %s\n", ref)
+	}
 
-    if err := volume.RemoveVolume(volumeName); err != nil {
-        fmt.Printf("Error removing volume: %v\n", err)
-        os.Exit(1)
-    }
+	deletedLayers, err := image.RemoveImage(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted: sha256:%s\n", id)
+	for _, layerID := range deletedLayers {
+		fmt.Printf("Deleted: sha256:%s\n", layerID)
+	}
 
-    fmt.Printf("Volume %s removed\n", volumeName)
+	return nil
 }
 
-func volumeInspect() {
-    if len(os.Args) < 4 {
+// findImageUser returns a container created from an image, preferring a running one
+func findImageUser(imageID string) (*container.Container, error) {
+	containers, err := container.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var user *container.Container
+	for _, c := range containers {
+		usedID := c.ImageID
+		if usedID == "" {
+			// Containers created before image IDs were recorded
+			usedID, _ = image.ResolveID(c.Image)
+		}
+		if usedID != imageID {
+			continue
+		}
+		if c.State == container.StateRunning {
+			return c, nil
+		}
+		if user == nil {
+			user = c
+		}
+	}
+
+	return user, nil
+}
+
+// removeMonolithicImage deletes a monolithic image directory if no container uses it
+func removeMonolithicImage(name, rootfs string, force bool) error {
+	containers, err := container.ListContainers()
+	if err != nil {
+		return err
+	}
+
+	// Containers record the image as e.g. ubuntu:latest, so compare the
+	// rootfs they were started from rather than the name given to rmi
+	for _, c := range containers {
+		if c.ImageID != "" {
+			continue
+		}
+		if used, err := image.GetImageRootfs(c.Image); err != nil || used != rootfs {
+			continue
+		}
+		if c.State == container.StateRunning || !force {
+			return fmt.Errorf("conflict: unable to delete %s - image is being used by %s container %s", name, c.State, container.ShortID(c.ID))
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Dir(rootfs)); err != nil {
+		return fmt.Errorf("failed to remove image %s: %v", name, err)
+	}
+	fmt.Printf("Deleted: %s\n", name)
+
+	return nil
+}
+
+// historyRow is one line of history output, exposed to --format templates
+type historyRow struct {
+	ID           string
+	CreatedAt    string
+	CreatedSince string
+	CreatedBy    string
+	Size         string
+	Comment      string
+}
+
+func showHistory() {
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	noTrunc := historyCmd.Bool("no-trunc", false, "Don't truncate output")
+	format := historyCmd.String("format", "", "Format output using a Go template, e.g. '{{.ID}}: {{.CreatedBy}}'")
+	historyCmd.Parse(os.Args[2:])
+
+	if historyCmd.NArg() != 1 {
+		fmt.Println("Usage: minidocker history [--no-trunc] [--format TEMPLATE] <image>")
+		os.Exit(1)
+	}
+
+	manifest, err := image.GetImageManifest(historyCmd.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	history, err := image.GetHistory(manifest)
+	if err != nil {
+		fmt.Printf("Error loading history: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Pair each non-empty entry with its layer to get sizes
+	sizes := make([]int64, len(history))
+	layerIndex := 0
+	for i, h := range history {
+		if h.EmptyLayer {
+			continue
+		}
+		if l, err := layer.GetLayer(manifest.Layers[layerIndex]); err == nil {
+			sizes[i] = l.Size
+		}
+		layerIndex++
+	}
+
+	var rows []historyRow
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+
+		// Like Docker, only the top entry is an image we know the ID of
+		id := "<missing>"
+		if i == len(history)-1 {
+			id = "sha256:" + manifest.ID
+			if !*noTrunc {
+				id = image.ShortID(manifest.ID)
+			}
+		}
+
+		createdBy := strings.Join(strings.Fields(h.CreatedBy), " ")
+		if !*noTrunc && len(createdBy) > 45 {
+			createdBy = createdBy[:44] + "…"
+		}
+
+		rows = append(rows, historyRow{
+			ID:           id,
+			CreatedAt:    h.Created.Format(time.RFC3339),
+			CreatedSince: timeAgo(h.Created),
+			CreatedBy:    createdBy,
+			Size:         fmt.Sprintf("%.2f MB", float64(sizes[i])/(1024*1024)),
+			Comment:      h.Comment,
+		})
+	}
+
+	if *format != "" {
+		tmpl, err := template.New("history").Parse(*format)
+		if err != nil {
+			fmt.Printf("Error: invalid format: %v\n", err)
+			os.Exit(1)
+		}
+		for _, row := range rows {
+			if err := tmpl.Execute(os.Stdout, row); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.ID, row.CreatedSince, row.CreatedBy, row.Size, row.Comment)
+	}
+	w.Flush()
+}
+
+// timeAgo describes how long ago t was, e.g. "3 hours ago"
+func timeAgo(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+
+	d := time.Since(t)
+	unit := func(n int, name string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", name)
+		}
+		return fmt.Sprintf("%d %ss ago", n, name)
+	}
+
+	switch {
+	case d < time.Minute:
+		return "Less than a minute ago"
+	case d < time.Hour:
+		return unit(int(d.Minutes()), "minute")
+	case d < 48*time.Hour:
+		return unit(int(d.Hours()), "hour")
+	case d < 14*24*time.Hour:
+		return unit(int(d.Hours()/24), "day")
+	case d < 60*24*time.Hour:
+		return unit(int(d.Hours()/24/7), "week")
+	case d < 365*24*time.Hour:
+		return unit(int(d.Hours()/24/30), "month")
+	default:
+		return unit(int(d.Hours()/24/365), "year")
+	}
+}
+
+func execContainer() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: minidocker exec <container-id> <command>")
+		os.Exit(1)
+	}
+
+	containerID := os.Args[2]
+	command := os.Args[3:]
+
+	// Find the container by prefix
+	containerInfo, err := container.FindContainerByPrefix(containerID)
+	if err != nil {
+		fmt.Printf(
+			"Container %s is not running (state: %s)\n", 
+			container.ShortID(containerInfo.ID), 
+			containerInfo.State,
+		)
+		os.Exit(1)
+	}
+
+	if containerInfo.State != container.StateRunning {
+		fmt.Printf("Container %s is not running (state: %s)\n", container.ShortID(containerInfo.ID), containerInfo.State)
+		os.Exit(1)
+	}
+
+	// Use the nsenter command to enter the container namespace
+	nsenterArgs := []string{
+		"nsenter",
+		"--target",
+		strconv.Itoa(containerInfo.PID),
+		"--pid",
+		"--uts",
+		"--mount",
+	}
+	nsenterArgs = append(nsenterArgs, command...)
+
+	cmd := exec.Command(nsenterArgs[0], nsenterArgs[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Error executing command:  %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleVolumeCommand() {
+    if len(os.Args) < 3 {
+        fmt.Println("Usage: minidocker volume <subcommand>")
+        fmt.Println("Subcommands:")
+        fmt.Println("  create <name>    - Create a volume")
+        fmt.Println("  ls               - List volumes")
+        fmt.Println("  rm <name>        - Remove a volume")
+        fmt.Println("  inspect <name>   - Inspect a volume")
+        os.Exit(1)
+    }
+    
+    subcommand := os.Args[2]
+    
+    switch subcommand {
+    case "create":
+        volumeCreate()
+    case "ls":
+        volumeList()
+    case "rm":
+        volumeRemove()
+    case "inspect":
+        volumeInspect()
+    default:
+        fmt.Printf("Unknown volume subcommand: %s\n", subcommand)
+        os.Exit(1)
+    }
+}
+
+func volumeCreate() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: minidocker volume create <name>")
+		os.Exit(1)
+	}
+
+	volumeName := os.Args[3]
+
+	vol, err := volume.CreateVolume(volumeName)
+	if err != nil {
+		fmt.Printf("Error creating volume: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Volume %s created\n", vol.Name)
+}
+
+func volumeList() {
+    volumes, err := volume.ListVolumes()
+    if err != nil {
+        fmt.Printf("Error listing volumes: %v\n", err)
+        os.Exit(1)
+    }
+
+    if len(volumes) == 0 {
+        fmt.Println("No volumes found")
+        return
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "VOLUME NAME\tDRIVER\tCREATED")
+
+    for _, vol := range volumes {
+        created := vol.Created.Format("2006-01-02 15:04:05")
+        fmt.Fprintf(w, "%s\t%s\t%s\n", vol.Name, vol.Driver, created)
+    }
+    w.Flush()
+}
+
+func volumeRemove() {
+    if len(os.Args) < 4 {
+        fmt.Println("Usage: minidocker volume rm <name>")
+        os.Exit(1)
+    }
+
+    volumeName := os.Args[3]
+
+    if err := volume.RemoveVolume(volumeName); err != nil {
+        fmt.Printf("Error removing volume: %v\n", err)
+        os.Exit(1)
+    }
+
+    fmt.Printf("Volume %s removed\n", volumeName)
+}
+
+func volumeInspect() {
+    if len(os.Args) < 4 {
         fmt.Println("Usage: minidocker volume rm <name>")
         os.Exit(1)
     }
 
-    volumeName := os.Args[3]
+    volumeName := os.Args[3]
+
+    vol, err := volume.GetVolume(volumeName)
+    if err != nil {
+	    fmt.Printf("Error: %v\n", err)
+	    os.Exit(1)
+    }
+
+    data, _ := json.MarshalIndent(vol, "", "  ")
+    fmt.Println(string(data))
+
+}
+
+func handleNetworkCommand() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: minidocker network <subcommand>")
+		fmt.Println("Subcommands:")
+		fmt.Println("  create [--subnet CIDR] <name>                - Create a network")
+		fmt.Println("  ls                                           - List networks")
+		fmt.Println("  rm <network...>                              - Remove networks")
+		fmt.Println("  inspect <network>                            - Inspect a network")
+		fmt.Println("  connect [--ip IP] <network> <container>      - Connect a running container to a network")
+		fmt.Println("  disconnect <network> <container>             - Disconnect a container from a network")
+		os.Exit(1)
+	}
+
+	subcommand := os.Args[2]
+
+	switch subcommand {
+	case "create":
+		networkCreate()
+	case "ls":
+		networkList()
+	case "rm":
+		networkRemove()
+	case "inspect":
+		networkInspect()
+	case "connect":
+		networkConnect()
+	case "disconnect":
+		networkDisconnect()
+	default:
+		fmt.Printf("Unknown network subcommand: %s\n", subcommand)
+		os.Exit(1)
+	}
+}
+
+func networkCreate() {
+	createCmd := flag.NewFlagSet("network create", flag.ExitOnError)
+	subnet := createCmd.String("subnet", "", "Subnet in CIDR format (default: a free /24 of 172.19.0.0/16)")
+	createCmd.Parse(os.Args[3:])
+
+	if createCmd.NArg() != 1 {
+		fmt.Println("Usage: minidocker network create [--subnet CIDR] <name>")
+		os.Exit(1)
+	}
+
+	n, err := network.CreateNetwork(createCmd.Arg(0), *subnet)
+	if err != nil {
+		fmt.Printf("Error creating network: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Network %s created with subnet %s (bridge %s)\n", n.Name, n.Subnet, n.Bridge)
+	fmt.Println(n.ID)
+}
+
+func networkList() {
+	networks, err := network.ListNetworks()
+	if err != nil {
+		fmt.Printf("Error listing networks: %v\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tGATEWAY\tBRIDGE")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", n.ID[:12], n.Name, n.Driver, n.Subnet, n.Gateway, n.Bridge)
+	}
+	w.Flush()
+}
+
+func networkRemove() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: minidocker network rm <network> [network...]")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, name := range os.Args[3:] {
+		n, err := network.RemoveNetwork(name)
+		if err != nil {
+			fmt.Printf("Error removing network %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Network %s removed\n", n.Name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// networkDetails is a network along with the containers connected to it
+type networkDetails struct {
+	*network.Network
+	Containers map[string]*network.Endpoint `json:"containers"`
+}
+
+// describeNetwork collects the endpoints of the containers on a network
+func describeNetwork(n *network.Network) (*networkDetails, error) {
+	containers, err := container.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	details := &networkDetails{Network: n, Containers: make(map[string]*network.Endpoint)}
+	for _, c := range containers {
+		if endpoint := c.Networks[n.Name]; endpoint != nil {
+			details.Containers[c.ID] = endpoint
+		}
+	}
+	return details, nil
+}
+
+func networkInspect() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: minidocker network inspect <network>")
+		os.Exit(1)
+	}
+
+	n, err := network.GetNetwork(os.Args[3])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	details, err := describeNetwork(n)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, _ := json.MarshalIndent(details, "", "  ")
+	fmt.Println(string(data))
+}
+
+func networkConnect() {
+	connectCmd := flag.NewFlagSet("network connect", flag.ExitOnError)
+	requestedIP := connectCmd.String("ip", "", "IPv4 address for the container (default: the next free one)")
+	connectCmd.Parse(os.Args[3:])
+
+	if connectCmd.NArg() != 2 {
+		fmt.Println("Usage: minidocker network connect [--ip IP] <network> <container>")
+		os.Exit(1)
+	}
+
+	n, err := network.GetNetwork(connectCmd.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	containerInfo, err := container.FindContainerByPrefix(connectCmd.Arg(1))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The container's lock keeps it from exiting or connecting elsewhere meanwhile
+	var endpoint *network.Endpoint
+	_, err = container.UpdateContainer(containerInfo.ID, func(c *container.Container) error {
+		if c.State != container.StateRunning || c.PID == 0 {
+			return fmt.Errorf("container %s is not running", container.ShortID(c.ID))
+		}
+		if c.NetworkMode == network.NoNetwork {
+			return fmt.Errorf("container %s was started without a network namespace (--network none)", container.ShortID(c.ID))
+		}
+		if c.Networks[n.Name] != nil {
+			return fmt.Errorf("container %s is already connected to network %s", container.ShortID(c.ID), n.Name)
+		}
 
-    vol, err := volume.GetVolume(volumeName)
-    if err != nil {
-	    fmt.Printf("Error: %v\n", err)
-	    os.Exit(1)
-    }
+		ip, err := network.AllocateIP(n.Name, n.Subnet, c.ID, *requestedIP)
+		if err != nil {
+			return err
+		}
+		ifName := nextInterface(c)
+		if err := n.SetupBridge(); err != nil {
+			network.ReleaseIP(n.Name, c.ID)
+			return err
+		}
+		vethHost, err := network.SetupContainerNetwork(n, c.PID, ip, ifName)
+		if err != nil {
+			network.ReleaseIP(n.Name, c.ID)
+			return err
+		}
 
-    data, _ := json.MarshalIndent(vol, "", "  ")
-    fmt.Println(string(data))
+		endpoint = &network.Endpoint{
+			NetworkID: n.ID,
+			Interface: ifName,
+			IPAddress: ip,
+			Gateway:   n.Gateway,
+			VethHost:  vethHost,
+		}
+		if c.Networks == nil {
+			c.Networks = make(map[string]*network.Endpoint)
+		}
+		c.Networks[n.Name] = endpoint
+		if ifName == "eth0" {
+			c.IPAddress = ip
+			c.VethHost = vethHost
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error connecting to network %s: %v\n", n.Name, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Container %s connected to network %s as %s with IP %s\n",
+		container.ShortID(containerInfo.ID), n.Name, endpoint.Interface, endpoint.IPAddress)
+}
+
+// nextInterface returns the first of eth0, eth1... a container doesn't have
+func nextInterface(c *container.Container) string {
+	used := make(map[string]bool)
+	if c.IPAddress != "" {
+		used["eth0"] = true
+	}
+	for _, endpoint := range c.Networks {
+		used[endpoint.Interface] = true
+	}
+
+	for i := 0; ; i++ {
+		if name := fmt.Sprintf("eth%d", i); !used[name] {
+			return name
+		}
+	}
+}
+
+func networkDisconnect() {
+	if len(os.Args) != 5 {
+		fmt.Println("Usage: minidocker network disconnect <network> <container>")
+		os.Exit(1)
+	}
+
+	n, err := network.GetNetwork(os.Args[3])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	containerInfo, err := container.FindContainerByPrefix(os.Args[4])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, err = container.UpdateContainer(containerInfo.ID, func(c *container.Container) error {
+		endpoint := c.Networks[n.Name]
+		if endpoint == nil {
+			return fmt.Errorf("container %s is not connected to network %s", container.ShortID(c.ID), n.Name)
+		}
+
+		// Deleting the host end removes the container's interface too
+		if err := network.CleanupContainerNetwork(endpoint.VethHost); err != nil {
+			return err
+		}
+		network.ReleaseIP(n.Name, c.ID)
+		delete(c.Networks, n.Name)
+
+		if endpoint.Interface == "eth0" {
+			ip := strings.Split(endpoint.IPAddress, "/")[0]
+			for _, port := range c.Ports {
+				network.RemovePortForwarding(port.HostPort, port.ContainerPort, ip, port.Protocol)
+			}
+			c.IPAddress = ""
+			c.VethHost = ""
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error disconnecting from network %s: %v\n", n.Name, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Container %s disconnected from network %s\n", container.ShortID(containerInfo.ID), n.Name)
+}
+
+// inspectObjects prints containers, networks or images as JSON, looked up
+// in that order
+func inspectObjects() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: minidocker inspect <container|network|image> [...]")
+		os.Exit(1)
+	}
+
+	var objects []interface{}
+	for _, name := range os.Args[2:] {
+		if c, err := container.FindContainerByPrefix(name); err == nil {
+			objects = append(objects, c)
+			continue
+		}
+		if n, err := network.GetNetwork(name); err == nil {
+			details, err := describeNetwork(n)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			objects = append(objects, details)
+			continue
+		}
+		if manifest, err := image.GetImageManifest(name); err == nil {
+			objects = append(objects, manifest)
+			continue
+		}
+
+		fmt.Printf("Error: no such object: %s\n", name)
+		os.Exit(1)
+	}
 
+	data, _ := json.MarshalIndent(objects, "", "  ")
+	fmt.Println(string(data))
 }
 
 // Custom flag type for multiple -v flags
@@ -1003,15 +1950,110 @@ func layerRemove() {
     fmt.Printf("Layer %s removed\n", l.ID[:12])
 }
 
+func handleImageCommand() {
+    if len(os.Args) < 3 {
+        fmt.Println("Usage: minidocker image <subcommand>")
+        fmt.Println("Subcommands:")
+        fmt.Println("  create <name[:tag]> <layer-id1> [layer-id2...]  - Create an image from layers")
+        fmt.Println("  migrate [name...]                               - Convert monolithic images into layered images")
+        os.Exit(1)
+    }
+
+    subcommand := os.Args[2]
+
+    switch subcommand {
+    case "create":
+        imageCreate()
+    case "migrate":
+        imageMigrate()
+    default:
+        fmt.Printf("Unknown image subcommand: %s\n", subcommand)
+        os.Exit(1)
+    }
+}
+
 func buildImage() {
-    if len(os.Args) < 4 {
-        fmt.Println("Usage: minidocker build <image-name> <layer-id1> [layer-id2] ...")
-        fmt.Println("Example: minidocker build myapp abc123 def456 ghi789")
+	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
+	var tags arrayFlags
+	buildCmd.Var(&tags, "t", "Name and optionally a tag in the name:tag format (can be repeated)")
+	dockerfile := buildCmd.String("f", "", "Path to the Dockerfile (default: <context>/Dockerfile)")
+	noCache := buildCmd.Bool("no-cache", false, "Do not use cache when building the image")
+	var cacheFrom arrayFlags
+	buildCmd.Var(&cacheFrom, "cache-from", "Image to consider as a cache source (can be repeated)")
+	target := buildCmd.String("target", "", "Name of the build stage to build")
+	var buildArgs arrayFlags
+	buildCmd.Var(&buildArgs, "build-arg", "Build-time variable: --build-arg KEY=VALUE, or KEY to take it from the environment")
+	var secretSpecs arrayFlags
+	buildCmd.Var(&secretSpecs, "secret", "Secret to expose to RUN --mount=type=secret: --secret id=name[,src=path|,env=VAR]")
+	buildCmd.Parse(os.Args[2:])
+
+	if buildCmd.NArg() != 1 {
+		fmt.Println("Usage: minidocker build [-t name[:tag]] [-f Dockerfile] [--no-cache] [--cache-from image] [--target stage] [--build-arg KEY=VALUE] [--secret id=name,src=path] <context-dir|->")
+		fmt.Println("Example: minidocker build -t myapp:v1 .")
+		fmt.Println("         tar -c . | minidocker build -t myapp:v1 -")
+		os.Exit(1)
+	}
+
+	args := make(map[string]string)
+	for _, arg := range buildArgs {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			// Like Docker, a bare name is taken from the environment if set
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		args[key] = value
+	}
+
+	var secrets []builder.Secret
+	for _, spec := range secretSpecs {
+		secret, err := builder.ParseSecret(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	// "-" reads a tar archive or a lone Dockerfile from stdin
+	var context io.Reader
+	if buildCmd.Arg(0) == "-" {
+		context = os.Stdin
+	}
+
+	b, err := builder.NewBuilder(builder.Options{
+		ContextDir: buildCmd.Arg(0),
+		Context:    context,
+		Dockerfile: *dockerfile,
+		Tags:       tags,
+		NoCache:    *noCache,
+		CacheFrom:  cacheFrom,
+		Target:     *target,
+		BuildArgs:  args,
+		Secrets:    secrets,
+		Storage:    storageDriver,
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if _, err := b.Build(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func imageCreate() {
+    if len(os.Args) < 5 {
+        fmt.Println("Usage: minidocker image create <name[:tag]> <layer-id1> [layer-id2] ...")
+        fmt.Println("Example: minidocker image create myapp abc123 def456 ghi789")
         os.Exit(1)
     }
 
-    imageName := os.Args[2]
-    layerPrefixes := os.Args[3:]
+    imageName := os.Args[3]
+    layerPrefixes := os.Args[4:]
 
     fmt.Printf("Building image '%s' from %d layers...\n", imageName, len(layerPrefixes))
 
@@ -1027,33 +2069,128 @@ func buildImage() {
         fmt.Printf("  Layer %s: %s\n", prefix, l.Comment)
     }
 
-    // Create image manifest
+    // Create image manifest; there is no default command to assume
     config := image.ImageConfig{
-        Cmd:        []string{"/bin/bash"},
         Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
         WorkingDir: "/",
     }
 
-    manifest, err := image.CreateImageFromLayers(imageName, "latest", layerIDs, config)
+    manifest, err := image.CreateImageFromLayers(imageName, layerIDs, config)
     if err != nil {
         fmt.Printf("Error creating image: %v\n", err)
         os.Exit(1)
     }
 
     fmt.Printf("Image '%s' created successfully!\n", imageName)
+    fmt.Printf("ID: sha256:%s\n", manifest.ID)
     fmt.Printf("Layers: %d\n", len(manifest.Layers))
     fmt.Printf("Created: %s\n", manifest.Created.Format("2006-01-02 15:04:05"))
 }
 
+// imageMigrate converts monolithic images, all of them if none are named,
+// into images with a single layer under the same name
+func imageMigrate() {
+	names := os.Args[3:]
+	if len(names) == 0 {
+		images, err := image.ListImages()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, img := range images {
+			if !img.Layered {
+				names = append(names, img.Repository)
+			}
+		}
+		if len(names) == 0 {
+			fmt.Println("No monolithic images to migrate")
+			return
+		}
+	}
+
+	failed := false
+	for _, name := range names {
+		if err := migrateImage(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// migrateImage stores a monolithic image's rootfs as a layer, replaces the
+// image with one made of that layer and deletes the rootfs
+func migrateImage(name string) error {
+	if ref, err := reference.Parse(name); err == nil {
+		name = ref.FamiliarString()
+	}
+	if image.IsLayeredImage(name) {
+		return fmt.Errorf("%s is already a layered image", name)
+	}
+	rootfs, err := image.GetImageRootfs(name)
+	if err != nil {
+		return err
+	}
+
+	// Containers of the image run on its rootfs
+	containers, err := container.ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if c.ImageID == "" && containerImageName(c) == name {
+			return fmt.Errorf("conflict: unable to migrate %s - image is being used by %s container %s", name, c.State, container.ShortID(c.ID))
+		}
+	}
+
+	fmt.Printf("Migrating %s...\n", name)
+	base, err := layer.CreateLayer(rootfs, fmt.Sprintf("base: %s", name), fmt.Sprintf("Base layer from %s", name))
+	if err != nil {
+		return fmt.Errorf("failed to create base layer: %v", err)
+	}
+
+	config := image.ImageConfig{
+		Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+		WorkingDir: "/",
+	}
+	manifest, err := image.CreateImageFromLayers(name, []string{base.ID}, config)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Dir(rootfs)); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", filepath.Dir(rootfs), err)
+	}
+	fmt.Printf("Migrated %s to image %s (layer %s)\n", name, image.ShortID(manifest.ID), base.ID[:12])
+
+	return nil
+}
+
 func commitContainer() {
-    if len(os.Args) < 4 {
-        fmt.Println("Usage: minidocker commit <container-id> <new-image-name>")
-        fmt.Println("Example: minidocker commit c1234567 ubuntu-modified")
+    commitCmd := flag.NewFlagSet("commit", flag.ExitOnError)
+    var message, author string
+    commitCmd.StringVar(&message, "m", "", "Commit message")
+    commitCmd.StringVar(&message, "message", "", "Commit message")
+    commitCmd.StringVar(&author, "a", "", "Author (e.g. \"Jane Doe <jane@example.com>\")")
+    commitCmd.StringVar(&author, "author", "", "Author (e.g. \"Jane Doe <jane@example.com>\")")
+    var changes arrayFlags
+    commitCmd.Var(&changes, "c", "Apply a Dockerfile instruction to the image config (can be repeated)")
+    commitCmd.Var(&changes, "change", "Apply a Dockerfile instruction to the image config (can be repeated)")
+    pause := true
+    commitCmd.BoolVar(&pause, "p", true, "Pause the container while committing")
+    commitCmd.BoolVar(&pause, "pause", true, "Pause the container while committing")
+    commitCmd.Parse(os.Args[2:])
+
+    if commitCmd.NArg() < 1 || commitCmd.NArg() > 2 {
+        fmt.Println("Usage: minidocker commit [-m MSG] [-a AUTHOR] [-c INSTRUCTION] [--pause=false] <container-id> [name[:tag]]")
+        fmt.Println("Example: minidocker commit -m \"add curl\" -c 'CMD [\"curl\"]' c1234567 ubuntu-modified:v1")
         os.Exit(1)
     }
     
-    containerPrefix := os.Args[2]
-    newImageName := os.Args[3]
+    containerPrefix := commitCmd.Arg(0)
+    newImageName := commitCmd.Arg(1)
     
     // Find container
     containerInfo, err := container.FindContainerByPrefix(containerPrefix)
@@ -1062,26 +2199,44 @@ func commitContainer() {
         os.Exit(1)
     }
     
-    fmt.Printf("Committing container %s to image %s...\n", containerInfo.ID[:12], newImageName)
-    
-    // Check if image already exists
-    if image.ImageExists(newImageName) {
-        fmt.Printf("Error: image %s already exists\n", newImageName)
-        os.Exit(1)
+    // An existing tag is moved to the new image, like Docker does
+    if newImageName != "" {
+        if ref, err := reference.Parse(newImageName); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        } else if ref.Digest != "" {
+            fmt.Println("Error: cannot commit to a digest reference, use a tag")
+            os.Exit(1)
+        }
+        fmt.Printf("Committing container %s to image %s...\n", container.ShortID(containerInfo.ID), newImageName)
+    } else {
+        fmt.Printf("Committing container %s...\n", container.ShortID(containerInfo.ID))
     }
     
-    // Get the original image's layers (if it's a layered image)
+    // The tag the container was started from may have moved since
+    baseImage := containerInfo.Image
+    if containerInfo.ImageID != "" {
+        baseImage = containerInfo.ImageID
+    }
+
+    // Get the original image's layers and config (if it's a layered image)
     var baseLayers []string
-    var isLayered bool
+    var baseHistory []image.HistoryEntry
+    var baseConfig image.ImageConfig
     
-    if image.IsLayeredImage(containerInfo.Image) {
-        isLayered = true
-        manifest, err := image.GetImageManifest(containerInfo.Image)
+    if image.IsLayeredImage(baseImage) {
+        manifest, err := image.GetImageManifest(baseImage)
         if err != nil {
             fmt.Printf("Error loading base image manifest: %v\n", err)
             os.Exit(1)
         }
         baseLayers = manifest.Layers
+        baseConfig = manifest.Config
+        baseHistory, err = image.GetHistory(manifest)
+        if err != nil {
+            fmt.Printf("Error loading base image history: %v\n", err)
+            os.Exit(1)
+        }
         fmt.Printf("Base image has %d layers\n", len(baseLayers))
     } else {
         // Non-layered image - we need to create a layer from it first
@@ -1101,77 +2256,290 @@ func commitContainer() {
             os.Exit(1)
         }
         baseLayers = []string{baseLayer.ID}
+        baseHistory, _ = image.LayerHistory(baseLayers)
         fmt.Printf("Created base layer: %s\n", baseLayer.ID[:12])
-        isLayered = true
     }
 
-    fmt.Printf("=========\n\n{%s}\n\n========", isLayered)
-    
-    // Check if container has changes (upperdir/diff)
-    overlayPath := filepath.Join("/var/lib/minidocker/overlay", containerInfo.ID, "diff")
-    
-    // Check if diff directory exists and has content
-    diffExists := false
-    if info, err := os.Stat(overlayPath); err == nil && info.IsDir() {
-        // Check if directory has files
-        entries, _ := os.ReadDir(overlayPath)
-        diffExists = len(entries) > 0
+    // The container's settings go on top of the inherited config, then --change
+    config, err := builder.ApplyChanges(commitConfig(baseConfig, containerInfo), changes)
+    if err != nil {
+        fmt.Printf("Error: invalid --change: %v\n", err)
+        os.Exit(1)
     }
-    
-    if !diffExists {
-        fmt.Println("Warning: Container has no changes in overlay diff directory")
-        fmt.Println("Creating image without changes layer...")
-        
-        // Just create image with existing layers
-        config := image.ImageConfig{
-            Cmd:        containerInfo.Command,
-            Env:        containerInfo.Env,
-            WorkingDir: containerInfo.WorkingDir,
-        }
-        
-        _, err := image.CreateImageFromLayers(newImageName, "latest", baseLayers, config)
-        if err != nil {
-            fmt.Printf("Error creating image: %v\n", err)
-            os.Exit(1)
-        }
-        
-        fmt.Printf("Image %s created (no changes)\n", newImageName)
-        return
+
+    comment := message
+    if comment == "" {
+        comment = fmt.Sprintf("Changes from container %s", container.ShortID(containerInfo.ID))
     }
-    
-    // Create a new layer from the container's changes (diff directory)
-    fmt.Println("Creating layer from container changes...")
-    changeLayer, err := layer.CreateLayer(overlayPath,
-        fmt.Sprintf("commit: %s", containerInfo.ID[:12]),
-        fmt.Sprintf("Changes from container %s", containerInfo.ID[:12]))
+
+    // Capture the container's changes while it can't modify them
+    changeLayer, err := snapshotContainer(containerInfo, comment, pause)
     if err != nil {
         fmt.Printf("Error creating change layer: %v\n", err)
         os.Exit(1)
     }
-    
-    fmt.Printf("Change layer created: %s (%.2f MB)\n", 
-        changeLayer.ID[:12], 
-        float64(changeLayer.Size)/(1024*1024))
-    
-    // Build new image with base layers + change layer
-    newLayers := append(baseLayers, changeLayer.ID)
-    
-    // Create image config (preserve container settings)
-    config := image.ImageConfig{
-        Cmd:        containerInfo.Command,
-        Env:        containerInfo.Env,
-        WorkingDir: containerInfo.WorkingDir,
+
+    newLayers := baseLayers
+    history := image.HistoryEntry{
+        Created:   time.Now(),
+        CreatedBy: strings.Join(containerInfo.Command, " "),
+        Author:    author,
+        Comment:   message,
+    }
+    if changeLayer == nil {
+        fmt.Println("Container has no changes in overlay diff directory, creating image without a changes layer...")
+        history.EmptyLayer = true
+    } else {
+        fmt.Printf("Change layer created: %s (%.2f MB)\n", 
+            changeLayer.ID[:12], 
+            float64(changeLayer.Size)/(1024*1024))
+        newLayers = append(append([]string(nil), baseLayers...), changeLayer.ID)
+        history.Created = changeLayer.Created
     }
     
-    manifest, err := image.CreateImageFromLayers(newImageName, "latest", newLayers, config)
+    manifest, err := createCommitImage(newImageName, &image.ImageManifest{
+        Layers:  newLayers,
+        Created: history.Created,
+        Author:  author,
+        Comment: message,
+        Config:  config,
+        History: append(append([]image.HistoryEntry(nil), baseHistory...), history),
+    })
     if err != nil {
         fmt.Printf("Error creating image: %v\n", err)
         os.Exit(1)
     }
     
-    fmt.Printf("\nImage '%s' created successfully!\n", newImageName)
+    if newImageName != "" {
+        fmt.Printf("\nImage '%s' created successfully!\n", newImageName)
+    } else {
+        fmt.Println("\nImage created successfully!")
+    }
+    fmt.Printf("ID: sha256:%s\n", manifest.ID)
     fmt.Printf("Total layers: %d\n", len(manifest.Layers))
     fmt.Printf("  Base layers: %d\n", len(baseLayers))
-    fmt.Printf("  Change layer: 1\n")
-    fmt.Printf("\nYou can now run: sudo ./minidocker run %s <command>\n", newImageName)
+    fmt.Printf("  Change layer: %d\n", len(manifest.Layers)-len(baseLayers))
+    if newImageName != "" {
+        fmt.Printf("\nYou can now run: sudo ./minidocker run %s <command>\n", newImageName)
+    }
+}
+
+// commitConfig returns the parent image's config updated with how the
+// container was run: its command, environment and working directory
+func commitConfig(base image.ImageConfig, c *container.Container) image.ImageConfig {
+	config := base
+	config.Env = append([]string(nil), base.Env...)
+
+	// run prepends the entrypoint, which the config keeps separately
+	command := c.Command
+	if len(command) >= len(base.Entrypoint) && strings.Join(command[:len(base.Entrypoint)], "\x00") == strings.Join(base.Entrypoint, "\x00") {
+		command = command[len(base.Entrypoint):]
+	} else {
+		config.Entrypoint = nil
+	}
+	if len(command) > 0 {
+		config.Cmd = append([]string(nil), command...)
+	}
+
+	for _, kv := range c.Env {
+		key, _, _ := strings.Cut(kv, "=")
+		replaced := false
+		for i, existing := range config.Env {
+			if k, _, _ := strings.Cut(existing, "="); k == key {
+				config.Env[i] = kv
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			config.Env = append(config.Env, kv)
+		}
+	}
+
+	if c.WorkingDir != "" {
+		config.WorkingDir = c.WorkingDir
+	}
+
+	return config
+}
+
+// snapshotContainer creates a layer from a container's changes, pausing a
+// running container first so the snapshot is consistent. It returns nil
+// if the container changed nothing.
+func snapshotContainer(c *container.Container, comment string, pause bool) (*layer.Layer, error) {
+	snapshotter, err := snapshot.Get(c.StorageDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	if pause && c.State == container.StateRunning && c.PID > 0 {
+		resume, err := pauseContainer(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pause container: %v", err)
+		}
+		defer resume()
+	}
+
+	fmt.Println("Creating layer from container changes...")
+	return snapshotter.Commit(c.ID, fmt.Sprintf("commit: %s", container.ShortID(c.ID)), comment)
+}
+
+// pauseContainer freezes a container's cgroup, or stops its processes with
+// SIGSTOP when it has no cgroup, and returns a function that resumes it
+func pauseContainer(c *container.Container) (func(), error) {
+	if err := cgroup.Freeze(c.ID); err == nil {
+		return func() { cgroup.Thaw(c.ID) }, nil
+	}
+
+	pids := append([]int{c.PID}, descendantPIDs(c.PID)...)
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil && pid == c.PID {
+			return nil, err
+		}
+	}
+	return func() {
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGCONT)
+		}
+	}, nil
+}
+
+// descendantPIDs lists the children of a process, recursively
+func descendantPIDs(pid int) []int {
+	var pids []int
+	tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pid))
+	for _, task := range tasks {
+		data, err := os.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(field); err == nil {
+				pids = append(pids, child)
+				pids = append(pids, descendantPIDs(child)...)
+			}
+		}
+	}
+	return pids
+}
+
+// createCommitImage stores a committed image and points the reference, if any, at it
+func createCommitImage(refStr string, m *image.ImageManifest) (*image.ImageManifest, error) {
+	manifest, err := image.CreateImage(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if refStr != "" {
+		if err := image.TagImage(manifest.ID, refStr); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+func pullImage() {
+	pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+	insecure := pullCmd.Bool("insecure", false, "Use plain HTTP to talk to the registry")
+	maxDownloads := pullCmd.Int("max-concurrent-downloads", 3, "Number of layers to download in parallel")
+	pullCmd.Parse(os.Args[2:])
+
+	if pullCmd.NArg() != 1 {
+		fmt.Println("Usage: minidocker pull [--insecure] <name[:tag|@digest]>")
+		fmt.Println("Example: minidocker pull ubuntu:24.04")
+		os.Exit(1)
+	}
+
+	opts := registry.PullOptions{
+		Insecure:               *insecure,
+		MaxConcurrentDownloads: *maxDownloads,
+	}
+
+	manifest, err := registry.Pull(pullCmd.Arg(0), opts)
+	if err != nil {
+		fmt.Printf("Error pulling image: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Image %s pulled with %d layers\n", image.ShortID(manifest.ID), len(manifest.Layers))
+}
+
+func pushImage() {
+	pushCmd := flag.NewFlagSet("push", flag.ExitOnError)
+	insecure := pushCmd.Bool("insecure", false, "Use plain HTTP to talk to the registry")
+	chunkMB := pushCmd.Int("chunk-size", 8, "Upload layers larger than this many MB in chunks")
+	pushCmd.Parse(os.Args[2:])
+
+	if pushCmd.NArg() != 1 {
+		fmt.Println("Usage: minidocker push [--insecure] <name[:tag]>")
+		fmt.Println("Example: minidocker push localhost:5000/myapp:v1")
+		os.Exit(1)
+	}
+
+	opts := registry.PushOptions{
+		Insecure:  *insecure,
+		ChunkSize: int64(*chunkMB) * 1024 * 1024,
+	}
+
+	if _, err := registry.Push(pushCmd.Arg(0), opts); err != nil {
+		fmt.Printf("Error pushing image: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func loginRegistry() {
+	loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
+	username := loginCmd.String("u", "", "Username")
+	password := loginCmd.String("p", "", "Password")
+	passwordStdin := loginCmd.Bool("password-stdin", false, "Read the password from stdin")
+	insecure := loginCmd.Bool("insecure", false, "Use plain HTTP to talk to the registry")
+	loginCmd.Parse(os.Args[2:])
+
+	domain := reference.DefaultDomain
+	if loginCmd.NArg() > 0 {
+		domain = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(loginCmd.Arg(0), "https://"), "http://"), "/")
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+
+	if *passwordStdin {
+		if *username == "" {
+			fmt.Println("Error: --password-stdin requires -u")
+			os.Exit(1)
+		}
+		line, _ := stdin.ReadString('\n')
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	if *username == "" {
+		fmt.Print("Username: ")
+		line, _ := stdin.ReadString('\n')
+		*username = strings.TrimSpace(line)
+	}
+
+	if *password == "" {
+		fmt.Print("Password: ")
+		// Hide the password while it is typed
+		exec.Command("stty", "-F", "/dev/tty", "-echo").Run()
+		line, _ := stdin.ReadString('\n')
+		exec.Command("stty", "-F", "/dev/tty", "echo").Run()
+		fmt.Println()
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	if *username == "" || *password == "" {
+		fmt.Println("Error: username and password are required")
+		os.Exit(1)
+	}
+
+	auth := &registry.AuthConfig{Username: *username, Password: *password}
+	if err := registry.Login(domain, auth, *insecure); err != nil {
+		fmt.Printf("Error logging in to %s: %v\n", domain, err)
+		os.Exit(1)
+	}
+
+	configPath, _ := registry.ConfigPath()
+	fmt.Printf("Credentials saved to %s\n", configPath)
+	fmt.Println("Login Succeeded")
 }
@@ -0,0 +1,221 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandable lists the instructions whose arguments see $VAR substitution.
+// RUN, CMD and ENTRYPOINT are left to the shell in the container.
+var expandable = map[string]bool{
+	"FROM":    true,
+	"ARG":     true,
+	"COPY":    true,
+	"ADD":     true,
+	"ENV":     true,
+	"WORKDIR": true,
+	"USER":    true,
+	"EXPOSE":  true,
+}
+
+// expandInstruction substitutes variables in the parsed arguments and flag
+// values of an instruction. Values are substituted into single arguments,
+// so spaces, quotes or --flags in them never add arguments or options.
+func expandInstruction(inst *Instruction, lookup func(string) (string, bool)) (*Instruction, error) {
+	if !expandable[inst.Command] {
+		return inst, nil
+	}
+
+	expanded := *inst
+	expanded.Flags = make(map[string]string, len(inst.Flags))
+	var err error
+	for key, value := range inst.Flags {
+		if expanded.Flags[key], err = expand(value, lookup); err != nil {
+			return nil, fmt.Errorf("line %d: %v", inst.Line, err)
+		}
+	}
+
+	switch inst.Command {
+	case "ENV", "ARG":
+		// Splitting removed the quotes that decide what is expanded, so these
+		// are split again with the substitution done during the split
+		_, rest, _ := strings.Cut(inst.Original, " ")
+		rest = strings.TrimSpace(rest)
+		if inst.Command == "ENV" {
+			expanded.Args, err = parseKeyValues(rest, lookup)
+		} else {
+			expanded.Args, err = splitWords(rest, lookup)
+		}
+	default:
+		expanded.Args = make([]string, len(inst.Args))
+		for i, arg := range inst.Args {
+			if expanded.Args[i], err = expand(arg, lookup); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", inst.Line, err)
+	}
+
+	return &expanded, nil
+}
+
+// expand substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR:+alternative}.
+// Text in single quotes and an escaped \$ are left as they are; unset
+// variables expand to nothing.
+func expand(s string, lookup func(string) (string, bool)) (string, error) {
+	var out strings.Builder
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != '$' {
+				out.WriteByte(c)
+			}
+			out.WriteByte(s[i])
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+			out.WriteByte(c)
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+			out.WriteByte(c)
+		case c == '$' && !inSingle:
+			value, end, err := expandReference(s, i, lookup)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i = end
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// expandReference expands the $VAR or ${...} starting at s[i]. It returns
+// the value and the index of the reference's last byte; a $ that starts no
+// reference is returned as is.
+func expandReference(s string, i int, lookup func(string) (string, bool)) (string, int, error) {
+	switch {
+	case i+1 < len(s) && s[i+1] == '{':
+		end := matchingBrace(s, i+1)
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing '}' in %q", s)
+		}
+		value, err := expandBraced(s[i+2:end], lookup)
+		return value, end, err
+	case i+1 < len(s) && isNameChar(s[i+1], true):
+		j := i + 1
+		for j < len(s) && isNameChar(s[j], false) {
+			j++
+		}
+		value, _ := lookup(s[i+1 : j])
+		return value, j - 1, nil
+	}
+	return "$", i, nil
+}
+
+// expandBraced expands the inside of ${...}
+func expandBraced(body string, lookup func(string) (string, bool)) (string, error) {
+	name, word, op := body, "", ""
+	for _, modifier := range []string{":-", ":+"} {
+		if i := strings.Index(body, modifier); i >= 0 {
+			name, op, word = body[:i], modifier, body[i+2:]
+			break
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("bad substitution: ${%s}", body)
+	}
+
+	value, set := lookup(name)
+	switch {
+	case op == ":-" && (!set || value == ""):
+		return expand(word, lookup)
+	case op == ":+" && set && value != "":
+		return expand(word, lookup)
+	case op == ":+":
+		return "", nil
+	}
+	return value, nil
+}
+
+// matchingBrace returns the index of the } closing the { at open
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// envLookup looks a name up in KEY=value lists; earlier lists win
+func envLookup(lists ...[]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		for _, list := range lists {
+			for _, kv := range list {
+				if key, value, _ := strings.Cut(kv, "="); key == name {
+					return value, true
+				}
+			}
+		}
+		return "", false
+	}
+}
+
+// argValue returns the value an ARG declaration takes: the --build-arg
+// value, else its default, else the value of the global ARG it redeclares
+func (b *Builder) argValue(decl string) (string, string, bool) {
+	name, def, hasDefault := strings.Cut(decl, "=")
+
+	if value, ok := b.opts.BuildArgs[name]; ok {
+		b.consumedArgs[name] = true
+		return name, value, true
+	}
+	if hasDefault {
+		return name, def, true
+	}
+	value, ok := envLookup(b.globalArgs)(name)
+	return name, value, ok
+}
+
+// declareArgs applies ARG declarations to a list of KEY=value build arguments
+func (b *Builder) declareArgs(args []string, inst *Instruction) []string {
+	for _, decl := range inst.Args {
+		if name, value, ok := b.argValue(decl); ok {
+			args = setEnv(args, name+"="+value)
+		}
+	}
+	return args
+}
+
+// unusedBuildArgs returns the --build-arg names no ARG declared
+func (b *Builder) unusedBuildArgs() []string {
+	var unused []string
+	for name := range b.opts.BuildArgs {
+		if !b.consumedArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
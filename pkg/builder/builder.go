@@ -0,0 +1,817 @@
+package builder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/image"
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/namespace"
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+	"github.com/jagjeet-singh-23/minidocker/pkg/registry"
+	"github.com/jagjeet-singh-23/minidocker/pkg/snapshot"
+)
+
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Options configures a build
+type Options struct {
+	ContextDir string            // Directory COPY and ADD read from
+	Context    io.Reader         // Tar archive or lone Dockerfile used instead of ContextDir, e.g. stdin
+	Dockerfile string            // Defaults to Dockerfile, then Containerfile, in the context
+	Tags       []string          // References to point at the built image
+	NoCache    bool              // Run every step even if a cached result exists
+	CacheFrom  []string          // Images whose layers may be reused as cache
+	Target     string            // Stage to build; defaults to the last one
+	BuildArgs  map[string]string // --build-arg values for ARG declarations
+	Secrets    []Secret          // Secrets RUN --mount=type=secret can expose
+	Storage    string            // Storage driver steps run on; defaults to overlay
+}
+
+// buildStage is the instructions from one FROM up to the next
+type buildStage struct {
+	index        int
+	name         string // Lower-cased AS name, empty if the stage has none
+	instructions []*Instruction
+}
+
+// stage is the image assembled by the instructions following a FROM
+type stage struct {
+	index   int // Position of the build stage producing it
+	layers  []string
+	config  image.ImageConfig
+	history []image.HistoryEntry
+	args    []string // Build arguments declared in this stage, as KEY=value
+	cmdSet  bool     // CMD was set in this stage, so ENTRYPOINT keeps it
+}
+
+// Builder executes the instructions of one Dockerfile
+type Builder struct {
+	opts         Options
+	ignore       *ignoreMatcher
+	tempContext  string // Context extracted from Options.Context, removed after the build
+	stages       []*buildStage
+	target       int
+	built        map[int]*stage
+	globalArgs   []string // ARGs declared before the first FROM
+	consumedArgs map[string]bool
+	cacheSources []*cacheSource
+	snapshotter  snapshot.Snapshotter
+}
+
+// NewBuilder reads and parses the Dockerfile for a build
+func NewBuilder(opts Options) (*Builder, error) {
+	if opts.Context != nil {
+		dir, err := extractContext(opts.Context)
+		if err != nil {
+			return nil, err
+		}
+		// A -f path names a file inside the streamed context
+		if opts.Dockerfile != "" && !filepath.IsAbs(opts.Dockerfile) {
+			opts.Dockerfile = filepath.Join(dir, opts.Dockerfile)
+		}
+		opts.ContextDir = dir
+
+		b, err := newBuilder(opts)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		b.tempContext = dir
+		return b, nil
+	}
+
+	return newBuilder(opts)
+}
+
+func newBuilder(opts Options) (*Builder, error) {
+	contextDir, err := filepath.Abs(opts.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("build context %s is not a directory", opts.ContextDir)
+	}
+	opts.ContextDir = contextDir
+
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = filepath.Join(contextDir, "Dockerfile")
+		if _, err := os.Stat(opts.Dockerfile); os.IsNotExist(err) {
+			opts.Dockerfile = filepath.Join(contextDir, "Containerfile")
+		}
+	}
+
+	for _, tag := range opts.Tags {
+		if err := validateTag(tag); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(opts.Dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Dockerfile: %v", err)
+	}
+	defer file.Close()
+
+	instructions, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filepath.Base(opts.Dockerfile), err)
+	}
+
+	globals, stages, err := splitStages(instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := loadIgnore(contextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotter, err := snapshot.Get(opts.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Builder{
+		opts:         opts,
+		ignore:       ignore,
+		snapshotter:  snapshotter,
+		stages:       stages,
+		target:       len(stages) - 1,
+		built:        make(map[int]*stage),
+		consumedArgs: make(map[string]bool),
+	}
+
+	// Global ARGs are only in scope for FROM lines
+	for _, inst := range globals {
+		if inst, err = expandInstruction(inst, envLookup(b.globalArgs)); err != nil {
+			return nil, err
+		}
+		b.globalArgs = b.declareArgs(b.globalArgs, inst)
+	}
+	for _, bs := range stages {
+		if bs.instructions[0], err = expandInstruction(bs.instructions[0], envLookup(b.globalArgs)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Target != "" {
+		if b.target = findStage(stages, opts.Target, len(stages)); b.target < 0 {
+			return nil, fmt.Errorf("target stage %q could not be found", opts.Target)
+		}
+	}
+
+	b.cacheSources = loadCacheSources(opts.CacheFrom)
+	return b, nil
+}
+
+// splitStages groups instructions into stages, one per FROM. ARGs before
+// the first FROM are returned separately.
+func splitStages(instructions []*Instruction) ([]*Instruction, []*buildStage, error) {
+	var globals []*Instruction
+	var stages []*buildStage
+	for _, inst := range instructions {
+		if len(stages) == 0 && inst.Command == "ARG" {
+			globals = append(globals, inst)
+			continue
+		}
+		if inst.Command == "FROM" {
+			bs := &buildStage{index: len(stages)}
+			if len(inst.Args) == 3 {
+				bs.name = strings.ToLower(inst.Args[2])
+				if findStage(stages, bs.name, len(stages)) >= 0 {
+					return nil, nil, fmt.Errorf("line %d: duplicate stage name %q", inst.Line, inst.Args[2])
+				}
+			}
+			stages = append(stages, bs)
+		}
+		current := stages[len(stages)-1]
+		current.instructions = append(current.instructions, inst)
+	}
+	return globals, stages, nil
+}
+
+// findStage returns the index of the stage a FROM or --from value names,
+// looking only at stages before the given one, or -1 if it names an image
+func findStage(stages []*buildStage, name string, before int) int {
+	if i, err := strconv.Atoi(name); err == nil {
+		if i >= 0 && i < before {
+			return i
+		}
+		return -1
+	}
+	for _, bs := range stages[:before] {
+		if bs.name != "" && bs.name == strings.ToLower(name) {
+			return bs.index
+		}
+	}
+	return -1
+}
+
+// requiredStages returns the stages the target depends on, in build order.
+// Stages nothing refers to are never built.
+func (b *Builder) requiredStages() []*buildStage {
+	needed := make(map[int]bool)
+	var visit func(i int)
+	visit = func(i int) {
+		if needed[i] {
+			return
+		}
+		needed[i] = true
+		for _, inst := range b.stages[i].instructions {
+			ref := ""
+			switch {
+			case inst.Command == "FROM":
+				ref = inst.Args[0]
+			case inst.Command == "COPY" && inst.Flags["from"] != "":
+				ref = inst.Flags["from"]
+			default:
+				continue
+			}
+			if dep := findStage(b.stages, ref, i); dep >= 0 {
+				visit(dep)
+			}
+		}
+	}
+	visit(b.target)
+
+	var stages []*buildStage
+	for _, bs := range b.stages[:b.target+1] {
+		if needed[bs.index] {
+			stages = append(stages, bs)
+		}
+	}
+	return stages
+}
+
+// Build runs every instruction and stores the resulting image
+func (b *Builder) Build() (*image.ImageManifest, error) {
+	if b.tempContext != "" {
+		defer os.RemoveAll(b.tempContext)
+	}
+
+	stages := b.requiredStages()
+
+	total := 0
+	for _, bs := range stages {
+		total += len(bs.instructions)
+	}
+
+	var st *stage
+	step := 0
+	for _, bs := range stages {
+		for _, inst := range bs.instructions {
+			step++
+			fmt.Printf("Step %d/%d : %s\n", step, total, inst.Original)
+
+			var err error
+			if inst.Command == "FROM" {
+				st, err = b.from(inst, bs.index)
+			} else {
+				err = b.dispatch(st, inst)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		b.built[bs.index] = st
+	}
+
+	// A fully cached build reproduces the same image ID
+	var created time.Time
+	if len(st.history) > 0 {
+		created = st.history[len(st.history)-1].Created
+	}
+
+	manifest, err := image.CreateImage(&image.ImageManifest{
+		Layers:  st.layers,
+		Created: created,
+		Config:  st.config,
+		History: st.history,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Successfully built %s\n", image.ShortID(manifest.ID))
+
+	for _, tag := range b.opts.Tags {
+		if err := image.TagImage(manifest.ID, tag); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Successfully tagged %s\n", tag)
+	}
+
+	if unused := b.unusedBuildArgs(); len(unused) > 0 {
+		fmt.Printf("[Warning] One or more build-args %v were not consumed\n", unused)
+	}
+
+	return manifest, nil
+}
+
+// dispatch runs one non-FROM instruction on the current stage, reusing the
+// recorded result of an identical earlier step when there is one
+func (b *Builder) dispatch(st *stage, inst *Instruction) error {
+	inst, err := expandInstruction(inst, envLookup(st.config.Env, st.args))
+	if err != nil {
+		return err
+	}
+
+	var c *copier
+	var sources string
+	if inst.Command == "COPY" || inst.Command == "ADD" {
+		c = &copier{contextDir: b.opts.ContextDir, ignore: b.ignore, allowAdd: inst.Command == "ADD"}
+		if from := inst.Flags["from"]; from != "" {
+			if inst.Command == "ADD" {
+				return fmt.Errorf("line %d: ADD does not support --from, use COPY", inst.Line)
+			}
+			dir, cleanup, err := b.copySource(st, from)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			c.contextDir, c.ignore = dir, nil
+		}
+
+		if sources, err = c.checksum(inst.Args[:len(inst.Args)-1]); err != nil {
+			return fmt.Errorf("%s failed: %v", inst.Command, err)
+		}
+	}
+
+	createdBy := stepCreatedBy(st, inst, sources)
+	key := stepKey(st, inst, sources)
+
+	entry, cached := b.lookupStep(st, key, createdBy)
+	if cached {
+		fmt.Println(" ---> Using cache")
+	}
+
+	switch inst.Command {
+	case "RUN":
+		if !cached {
+			entry, err = b.run(st, inst, createdBy)
+		}
+	case "COPY", "ADD":
+		if !cached {
+			entry, err = b.copy(st, inst, c, createdBy)
+		}
+	default:
+		err = b.applyConfig(st, inst)
+		if err == nil && !cached {
+			entry = &cacheEntry{History: image.HistoryEntry{
+				Created:    time.Now(),
+				CreatedBy:  createdBy,
+				EmptyLayer: true,
+			}}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !cached {
+		if err := storeCache(key, entry); err != nil {
+			fmt.Printf("Warning: failed to record build cache: %v\n", err)
+		}
+	}
+
+	if entry.LayerID != "" {
+		st.layers = append(st.layers, entry.LayerID)
+		fmt.Printf(" ---> %s\n", entry.LayerID[:12])
+	}
+	st.history = append(st.history, entry.History)
+
+	return nil
+}
+
+// lookupStep finds a step's result in the local cache or a --cache-from image
+func (b *Builder) lookupStep(st *stage, key, createdBy string) (*cacheEntry, bool) {
+	if b.opts.NoCache {
+		return nil, false
+	}
+
+	if entry, ok := lookupCache(key); ok {
+		return entry, true
+	}
+	for _, source := range b.cacheSources {
+		if entry, ok := source.match(st, createdBy); ok {
+			return entry, true
+		}
+	}
+
+	return nil, false
+}
+
+// applyConfig folds a config-only instruction into the stage's image config
+func (b *Builder) applyConfig(st *stage, inst *Instruction) error {
+	switch inst.Command {
+	case "ARG":
+		st.args = b.declareArgs(st.args, inst)
+	case "ENV":
+		for _, kv := range inst.Args {
+			st.config.Env = setEnv(st.config.Env, kv)
+		}
+	case "WORKDIR":
+		dir := inst.Args[0]
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(workingDir(st), dir)
+		}
+		st.config.WorkingDir = filepath.Clean(dir)
+	case "CMD":
+		st.config.Cmd = commandArgs(inst)
+		st.cmdSet = true
+	case "ENTRYPOINT":
+		st.config.Entrypoint = commandArgs(inst)
+		// An inherited CMD would become arguments to the new entrypoint
+		if !st.cmdSet {
+			st.config.Cmd = nil
+		}
+	case "USER":
+		st.config.User = inst.Args[0]
+	case "EXPOSE":
+		for _, port := range inst.Args {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			if !contains(st.config.ExposedPorts, port) {
+				st.config.ExposedPorts = append(st.config.ExposedPorts, port)
+			}
+		}
+	default:
+		return fmt.Errorf("line %d: %s is not supported", inst.Line, inst.Command)
+	}
+
+	return nil
+}
+
+// ApplyChanges applies Dockerfile instructions, as given to commit --change,
+// to an image config. Only instructions that just change the config are allowed.
+func ApplyChanges(config image.ImageConfig, changes []string) (image.ImageConfig, error) {
+	st := &stage{config: copyConfig(config)}
+	b := &Builder{}
+
+	for _, change := range changes {
+		inst, err := ParseInstruction(change)
+		if err != nil {
+			return config, err
+		}
+
+		switch inst.Command {
+		case "CMD", "ENTRYPOINT", "ENV", "EXPOSE", "USER", "WORKDIR":
+		default:
+			return config, fmt.Errorf("%s is not a valid change command", inst.Command)
+		}
+
+		if inst, err = expandInstruction(inst, envLookup(st.config.Env)); err != nil {
+			return config, err
+		}
+		if err := b.applyConfig(st, inst); err != nil {
+			return config, err
+		}
+	}
+
+	return st.config, nil
+}
+
+// from starts a new stage from an earlier stage or an image
+func (b *Builder) from(inst *Instruction, index int) (*stage, error) {
+	name := inst.Args[0]
+
+	var st *stage
+	if dep := findStage(b.stages, name, index); dep >= 0 {
+		parent := b.built[dep]
+		st = &stage{
+			layers:  append([]string(nil), parent.layers...),
+			config:  copyConfig(parent.config),
+			history: append([]image.HistoryEntry(nil), parent.history...),
+		}
+		fmt.Printf(" ---> Using stage %s\n", name)
+	} else {
+		var err error
+		if st, err = imageStage(name); err != nil {
+			return nil, err
+		}
+	}
+
+	st.index = index
+	return st, nil
+}
+
+// copySource returns the root a COPY --from reads from: a read-only view
+// of an earlier stage, or of an image. The cleanup function removes it.
+func (b *Builder) copySource(st *stage, from string) (string, func(), error) {
+	var source *stage
+	if dep := findStage(b.stages, from, st.index); dep >= 0 {
+		source = b.built[dep]
+	} else {
+		// Monolithic images already have a rootfs to read from
+		if _, err := image.GetImageManifest(from); err != nil {
+			if rootfs, monoErr := image.GetImageRootfs(from); monoErr == nil {
+				return rootfs, func() {}, nil
+			}
+		}
+		var err error
+		if source, err = imageStage(from); err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, rootfs, cleanup, err := b.prepare(source, true)
+	if err != nil {
+		return "", nil, err
+	}
+	return rootfs, cleanup, nil
+}
+
+// imageStage starts a stage from a local image, pulling it if necessary
+func imageStage(name string) (*stage, error) {
+	if name == "scratch" {
+		fmt.Println(" ---> scratch")
+		return &stage{}, nil
+	}
+
+	manifest, err := image.GetImageManifest(name)
+	if err != nil {
+		if rootfs, monoErr := image.GetImageRootfs(name); monoErr == nil {
+			return monolithicStage(name, rootfs)
+		}
+
+		fmt.Printf("Unable to find image '%s' locally\n", name)
+		if manifest, err = registry.Pull(name, registry.PullOptions{MaxConcurrentDownloads: 3}); err != nil {
+			return nil, err
+		}
+	}
+
+	history, err := image.GetHistory(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf(" ---> %s\n", image.ShortID(manifest.ID))
+	return &stage{
+		layers:  append([]string(nil), manifest.Layers...),
+		config:  copyConfig(manifest.Config),
+		history: append([]image.HistoryEntry(nil), history...),
+	}, nil
+}
+
+// monolithicStage turns a monolithic image's rootfs into a single base layer
+func monolithicStage(name, rootfs string) (*stage, error) {
+	base, err := layer.CreateLayer(rootfs, fmt.Sprintf("base: %s", name), fmt.Sprintf("Base layer from %s", name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create base layer: %v", err)
+	}
+
+	fmt.Printf(" ---> %s\n", base.ID[:12])
+	history, err := image.LayerHistory([]string{base.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &stage{
+		layers:  []string{base.ID},
+		config:  image.ImageConfig{Env: []string{defaultPath}},
+		history: history,
+	}, nil
+}
+
+// run executes a RUN instruction in a temporary container on the stage's layers
+func (b *Builder) run(st *stage, inst *Instruction, createdBy string) (*cacheEntry, error) {
+	args := commandArgs(inst)
+
+	key, rootfs, cleanup, err := b.prepare(st, false)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fmt.Printf(" ---> Running in %s\n", key)
+
+	mounts, err := b.mountRunMounts(inst, rootfs)
+	if err != nil {
+		return nil, err
+	}
+	defer mounts.release()
+
+	// WORKDIR directories are created on first use
+	workdir := workingDir(st)
+	if err := os.MkdirAll(filepath.Join(rootfs, workdir), 0755); err != nil {
+		return nil, err
+	}
+
+	// Build arguments are visible to RUN, but ENV wins over them
+	env := st.config.Env
+	for _, arg := range st.args {
+		if key, _, _ := strings.Cut(arg, "="); !hasEnv(env, key) {
+			env = append(env, arg)
+		}
+	}
+	if !hasEnv(env, "PATH") {
+		env = append([]string{defaultPath}, env...)
+	}
+
+	// The build shares the host network so RUN can fetch packages
+	pid, err := namespace.RunInNewNamespaceWithCgroup(args, rootfs, "", false, env, workdir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start RUN: %v", err)
+	}
+
+	process, _ := os.FindProcess(pid)
+	state, err := process.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("RUN failed: %v", err)
+	}
+	if !state.Success() {
+		return nil, fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(args, " "), state.ExitCode())
+	}
+
+	mounts.release()
+	if err := mounts.removeMountPoints(); err != nil {
+		return nil, err
+	}
+
+	return b.captureLayer(key, createdBy)
+}
+
+// copy executes COPY and ADD by copying from the copier's source into the stage's root filesystem
+func (b *Builder) copy(st *stage, inst *Instruction, c *copier, createdBy string) (*cacheEntry, error) {
+	key, rootfs, cleanup, err := b.prepare(st, false)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	c.rootfs = rootfs
+	if chown := inst.Flags["chown"]; chown != "" {
+		if c.uid, c.gid, err = lookupOwner(rootfs, chown); err != nil {
+			return nil, err
+		}
+		c.chown = true
+	}
+
+	if err := c.copyAll(inst.Args[:len(inst.Args)-1], copyDestination(st, inst)); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", inst.Command, err)
+	}
+
+	return b.captureLayer(key, createdBy)
+}
+
+// copyDestination returns the absolute COPY/ADD destination, ending in "/"
+// when the instruction names a directory
+func copyDestination(st *stage, inst *Instruction) string {
+	dest := inst.Args[len(inst.Args)-1]
+	destIsDir := strings.HasSuffix(dest, "/") || dest == "." || strings.HasSuffix(dest, "/.")
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(workingDir(st), dest)
+	}
+	if destIsDir && !strings.HasSuffix(dest, "/") {
+		dest += "/"
+	}
+	return dest
+}
+
+// prepare creates a temporary root filesystem of the stage's layers with
+// the build's storage driver. The returned cleanup function removes it.
+func (b *Builder) prepare(st *stage, readOnly bool) (string, string, func(), error) {
+	key := "build-" + randomHex(6)
+
+	prepare := b.snapshotter.Prepare
+	if readOnly {
+		prepare = b.snapshotter.View
+	}
+	rootfs, err := prepare(key, st.layers)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return key, rootfs, func() { b.snapshotter.Remove(key) }, nil
+}
+
+// captureLayer turns the changes of a step into its result. Steps that
+// changed nothing get an empty-layer history entry instead.
+func (b *Builder) captureLayer(key, createdBy string) (*cacheEntry, error) {
+	l, err := b.snapshotter.Commit(key, createdBy, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create layer: %v", err)
+	}
+
+	if l == nil {
+		return &cacheEntry{History: image.HistoryEntry{
+			Created:    time.Now(),
+			CreatedBy:  createdBy,
+			EmptyLayer: true,
+		}}, nil
+	}
+
+	return &cacheEntry{
+		LayerID: l.ID,
+		History: image.HistoryEntry{Created: l.Created, CreatedBy: createdBy},
+	}, nil
+}
+
+// stepCreatedBy describes a step in the image history the way Docker does
+func stepCreatedBy(st *stage, inst *Instruction, sources string) string {
+	switch inst.Command {
+	case "RUN":
+		// Like Docker, record the build arguments a RUN saw
+		if len(st.args) > 0 {
+			return fmt.Sprintf("|%d %s %s", len(st.args), strings.Join(st.args, " "), strings.Join(commandArgs(inst), " "))
+		}
+		return strings.Join(commandArgs(inst), " ")
+	case "COPY", "ADD":
+		return fmt.Sprintf("/bin/sh -c #(nop) %s %s in %s", inst.Command, sources, copyDestination(st, inst))
+	default:
+		return nopCreatedBy(inst)
+	}
+}
+
+// commandArgs returns the argv for RUN, CMD or ENTRYPOINT
+func commandArgs(inst *Instruction) []string {
+	if inst.JSONForm {
+		return inst.Args
+	}
+	return []string{"/bin/sh", "-c", inst.Args[0]}
+}
+
+// nopCreatedBy describes a config-only instruction the way Docker's history does
+func nopCreatedBy(inst *Instruction) string {
+	switch inst.Command {
+	case "CMD", "ENTRYPOINT":
+		args, _ := json.Marshal(commandArgs(inst))
+		return fmt.Sprintf("/bin/sh -c #(nop)  %s %s", inst.Command, args)
+	default:
+		return fmt.Sprintf("/bin/sh -c #(nop)  %s %s", inst.Command, strings.Join(inst.Args, " "))
+	}
+}
+
+func workingDir(st *stage) string {
+	if st.config.WorkingDir == "" {
+		return "/"
+	}
+	return st.config.WorkingDir
+}
+
+// setEnv sets KEY=value in an environment list, replacing an existing KEY
+func setEnv(env []string, kv string) []string {
+	key, _, _ := strings.Cut(kv, "=")
+	for i, existing := range env {
+		if k, _, _ := strings.Cut(existing, "="); k == key {
+			result := append([]string(nil), env...)
+			result[i] = kv
+			return result
+		}
+	}
+	return append(append([]string(nil), env...), kv)
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// copyConfig returns a config that shares no slices with the original
+func copyConfig(c image.ImageConfig) image.ImageConfig {
+	c.Cmd = append([]string(nil), c.Cmd...)
+	c.Entrypoint = append([]string(nil), c.Entrypoint...)
+	c.Env = append([]string(nil), c.Env...)
+	c.ExposedPorts = append([]string(nil), c.ExposedPorts...)
+	return c
+}
+
+// validateTag checks that a -t value is a name[:tag] reference
+func validateTag(tag string) error {
+	ref, err := reference.Parse(tag)
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" {
+		return fmt.Errorf("invalid tag %q: digests are not allowed", tag)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
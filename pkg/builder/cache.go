@@ -0,0 +1,146 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/image"
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// Cache entries live next to the layers they point to
+func cachePath() string { return store.Path("layers", ".buildcache") }
+
+// cacheEntry is the recorded result of one build step
+type cacheEntry struct {
+	LayerID string             `json:"layer_id,omitempty"` // Empty for config-only steps
+	History image.HistoryEntry `json:"history"`
+}
+
+// cacheKey identifies a build step by everything that affects its result
+type cacheKey struct {
+	ChainID     string   `json:"chain_id"`       // Layers the step starts from
+	Config      string   `json:"config"`         // Digest of the config the step starts from
+	Instruction string   `json:"instruction"`    // Normalized instruction
+	Sources     string   `json:"sources"`        // Checksum of COPY/ADD sources
+	Args        []string `json:"args,omitempty"` // Build arguments in scope
+}
+
+func (k cacheKey) digest() string {
+	data, _ := json.Marshal(k)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// stepKey builds the cache key for running an instruction on a stage
+func stepKey(st *stage, inst *Instruction, sources string) string {
+	config, _ := json.Marshal(st.config)
+	sum := sha256.Sum256(config)
+
+	return cacheKey{
+		ChainID:     layer.ChainID(st.layers),
+		Config:      hex.EncodeToString(sum[:]),
+		Instruction: normalizeInstruction(inst),
+		Sources:     sources,
+		Args:        st.args,
+	}.digest()
+}
+
+// normalizeInstruction renders an instruction independent of spacing and flag order
+func normalizeInstruction(inst *Instruction) string {
+	var flags []string
+	for k, v := range inst.Flags {
+		flags = append(flags, "--"+k+"="+v)
+	}
+
+	for _, m := range inst.Mounts {
+		flags = append(flags, "--mount="+m)
+	}
+	sort.Strings(flags)
+
+	args, _ := json.Marshal(inst.Args)
+	return fmt.Sprintf("%s %s %t %s", inst.Command, strings.Join(flags, " "), inst.JSONForm, args)
+}
+
+// lookupCache returns the recorded result of a step, if its layer still exists
+func lookupCache(key string) (*cacheEntry, bool) {
+	var entry cacheEntry
+	if err := store.ReadJSON(filepath.Join(cachePath(), key+".json"), &entry, nil); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring build cache entry: %v\n", err)
+		}
+		return nil, false
+	}
+	if entry.LayerID != "" {
+		if _, err := layer.GetLayer(entry.LayerID); err != nil {
+			return nil, false
+		}
+	}
+
+	return &entry, true
+}
+
+// storeCache records the result of a step
+func storeCache(key string, entry *cacheEntry) error {
+	return store.WriteJSON(filepath.Join(cachePath(), key+".json"), entry)
+}
+
+// cacheSource is an image given with --cache-from
+type cacheSource struct {
+	manifest *image.ImageManifest
+	history  []image.HistoryEntry
+}
+
+// loadCacheSources resolves the --cache-from images that exist locally
+func loadCacheSources(names []string) []*cacheSource {
+	var sources []*cacheSource
+	for _, name := range names {
+		manifest, err := image.GetImageManifest(name)
+		if err != nil {
+			fmt.Printf("Warning: cache source %s not found locally, skipping\n", name)
+			continue
+		}
+		history, err := image.GetHistory(manifest)
+		if err != nil {
+			continue
+		}
+		sources = append(sources, &cacheSource{manifest: manifest, history: history})
+	}
+	return sources
+}
+
+// match returns the cache source's next step if the stage so far is a prefix
+// of the source image and that next step was created by the same instruction
+func (s *cacheSource) match(st *stage, createdBy string) (*cacheEntry, bool) {
+	if len(st.history) >= len(s.history) || len(st.layers) > len(s.manifest.Layers) {
+		return nil, false
+	}
+	for i, h := range st.history {
+		if h.CreatedBy != s.history[i].CreatedBy || h.EmptyLayer != s.history[i].EmptyLayer {
+			return nil, false
+		}
+	}
+	for i, layerID := range st.layers {
+		if s.manifest.Layers[i] != layerID {
+			return nil, false
+		}
+	}
+
+	next := s.history[len(st.history)]
+	if next.CreatedBy != createdBy {
+		return nil, false
+	}
+
+	entry := &cacheEntry{History: next}
+	if !next.EmptyLayer {
+		entry.LayerID = s.manifest.Layers[len(st.layers)]
+	}
+	return entry, true
+}
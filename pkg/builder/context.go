@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+)
+
+// extractContext unpacks a streamed build context into a temporary
+// directory. The stream is a tar archive, possibly compressed, or a lone
+// Dockerfile, which gives an empty context.
+func extractContext(r io.Reader) (string, error) {
+	stream, err := layer.DecompressStream(r)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	dir, err := os.MkdirTemp("", "minidocker-context-")
+	if err != nil {
+		return "", err
+	}
+
+	buf := bufio.NewReaderSize(stream, 1024)
+	if isTar(buf) {
+		cmd := exec.Command("tar", "-xf", "-", "-C", dir, "--no-same-owner")
+		cmd.Stdin = buf
+		if output, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to extract build context: %v, output: %s", err, string(output))
+		}
+		return dir, nil
+	}
+
+	file, err := os.Create(filepath.Join(dir, "Dockerfile"))
+	if err == nil {
+		_, err = io.Copy(file, buf)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to read Dockerfile from stdin: %v", err)
+	}
+
+	return dir, nil
+}
+
+// isTar checks for the ustar magic at offset 257 of a tar header
+func isTar(r *bufio.Reader) bool {
+	header, err := r.Peek(262)
+	if err != nil {
+		return false
+	}
+	return string(header[257:262]) == "ustar"
+}
@@ -0,0 +1,556 @@
+package builder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+)
+
+// copier copies COPY/ADD sources from the build context into a rootfs
+type copier struct {
+	contextDir string
+	ignore     *ignoreMatcher // .dockerignore of the build context, nil for other sources
+	rootfs     string
+	allowAdd   bool // ADD: fetch URLs and extract local archives
+	chown      bool
+	uid, gid   int
+	keepOwner  bool // Without chown, keep the source's owner instead of root
+}
+
+// copyAll copies every source to dest, following Docker's rules: dest is
+// a directory if it ends in "/", already is one, or there are several sources
+func (c *copier) copyAll(srcs []string, dest string) error {
+	var sources []string
+	for _, src := range srcs {
+		if c.allowAdd && isURL(src) {
+			sources = append(sources, src)
+			continue
+		}
+
+		matches, err := c.resolve(src)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matches...)
+	}
+
+	destPath, err := c.inRoot(dest, true)
+	if err != nil {
+		return err
+	}
+	destIsDir := strings.HasSuffix(dest, "/") || len(sources) > 1
+	if info, err := os.Stat(destPath); err == nil && info.IsDir() {
+		destIsDir = true
+	}
+
+	for _, src := range sources {
+		if isURL(src) {
+			if err := c.download(src, dest, destIsDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			// A directory's contents are copied, not the directory itself
+			if err := c.copyTree(src, dest); err != nil {
+				return err
+			}
+		case c.allowAdd && info.Mode().IsRegular() && isArchive(src):
+			if err := c.extract(src, dest); err != nil {
+				return err
+			}
+		default:
+			target := dest
+			if destIsDir {
+				target = path.Join(dest, filepath.Base(src))
+			}
+			target, err = c.inRoot(target, info.Mode()&os.ModeSymlink == 0)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := c.copyEntry(src, target, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checksum hashes the COPY/ADD sources for the build cache, in Docker's
+// file:<hash>, dir:<hash> or multi:<hash> form. Remote ADD sources are
+// identified by their URL.
+func (c *copier) checksum(srcs []string) (string, error) {
+	hash := sha256.New()
+	kind := "multi"
+
+	var paths []string
+	for _, src := range srcs {
+		if c.allowAdd && isURL(src) {
+			paths = append(paths, src)
+			continue
+		}
+		matches, err := c.resolve(src)
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, matches...)
+	}
+
+	for _, p := range paths {
+		if isURL(p) {
+			fmt.Fprintf(hash, "url %s\n", p)
+			continue
+		}
+
+		// Names are hashed relative to the source's parent, except for the
+		// context root whose own name should not matter
+		base := filepath.Dir(p)
+		if p == c.contextDir {
+			base = p
+		}
+
+		err := filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if skip, err := c.excluded(file, info); skip {
+				return err
+			}
+			rel, _ := filepath.Rel(base, file)
+			fmt.Fprintf(hash, "%s %o\n", rel, info.Mode())
+
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(file)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(hash, "-> %s\n", target)
+			case info.Mode().IsRegular():
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(hash, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(paths) == 1 && !isURL(paths[0]) {
+		kind = "file"
+		if info, err := os.Lstat(paths[0]); err == nil && info.IsDir() {
+			kind = "dir"
+		}
+	}
+
+	return kind + ":" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// resolve expands a source pattern within the build context. Symlinks in
+// the directories on the way are resolved as if the context were /, so a
+// link such as etc -> /etc can't pull host files into the image; the
+// matched entries themselves are not followed.
+func (c *copier) resolve(src string) ([]string, error) {
+	matches, err := c.glob(path.Clean("/" + filepath.ToSlash(src)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid source pattern %q: %v", src, err)
+	}
+
+	var found, included []string
+	for _, match := range matches {
+		p, err := scopedPath(c.contextDir, match, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %s: %v", src, err)
+		}
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, p)
+		if skip, _ := c.excluded(p, info); !skip {
+			included = append(included, p)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("file not found in build context: %s", src)
+	}
+	if len(included) == 0 {
+		return nil, fmt.Errorf("file not found in build context or excluded by .dockerignore: %s", src)
+	}
+
+	return included, nil
+}
+
+// glob matches a pattern against the build context one component at a
+// time, listing directories through the context-scoped resolver
+func (c *copier) glob(pattern string) ([]string, error) {
+	matches := []string{"/"}
+	for _, part := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		var next []string
+		for _, dir := range matches {
+			if !strings.ContainsAny(part, `*?[\`) {
+				next = append(next, path.Join(dir, part))
+				continue
+			}
+
+			resolved, err := layer.ResolveInRoot(c.contextDir, dir)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := os.ReadDir(filepath.Join(c.contextDir, resolved))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				ok, err := path.Match(part, entry.Name())
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					next = append(next, path.Join(dir, entry.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+
+	return matches, nil
+}
+
+// excluded reports whether .dockerignore excludes a context path. For a
+// directory nothing inside can be re-included from, the error is
+// filepath.SkipDir so walks prune it.
+func (c *copier) excluded(p string, info os.FileInfo) (bool, error) {
+	if c.ignore == nil {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(c.contextDir, p)
+	if err != nil || rel == "." {
+		return false, nil
+	}
+	rel = filepath.ToSlash(rel)
+	if !c.ignore.ignored(rel) {
+		return false, nil
+	}
+
+	if info.IsDir() {
+		if c.ignore.prunable(rel) {
+			return true, filepath.SkipDir
+		}
+		// Walked anyway for the entries a "!" line re-includes
+		return false, nil
+	}
+	return true, nil
+}
+
+// inRoot maps a container path into the rootfs. Symlinks on the way,
+// including ones from the base image, are resolved as if the rootfs were /,
+// so the result never leaves it. Unless follow is set, the last component
+// itself is not resolved.
+func (c *copier) inRoot(p string, follow bool) (string, error) {
+	return scopedPath(c.rootfs, p, follow)
+}
+
+// scopedPath maps p into root, resolving symlinks as if root were /
+func scopedPath(root, p string, follow bool) (string, error) {
+	p = path.Clean("/" + p)
+	if !follow && p != "/" {
+		dir, err := layer.ResolveInRoot(root, path.Dir(p))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(root, dir, path.Base(p)), nil
+	}
+
+	resolved, err := layer.ResolveInRoot(root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// copyTree copies the contents of the directory src into dest, a container path
+func (c *copier) copyTree(src, dest string) error {
+	destPath, err := c.inRoot(dest, true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip, err := c.excluded(p, info); skip {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		// Every entry is resolved again, as the image may have symlinks below dest
+		target, err := c.inRoot(path.Join(dest, filepath.ToSlash(rel)), info.Mode()&os.ModeSymlink == 0)
+		if err != nil {
+			return err
+		}
+		return c.copyEntry(p, target, info)
+	})
+}
+
+// copyEntry copies one file, directory or symlink, keeping mode and mtime
+func (c *copier) copyEntry(src, dest string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dest)
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+
+	case info.Mode().IsRegular():
+		if err := copyFile(src, dest, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("cannot copy %s: unsupported file type", src)
+	}
+
+	return c.finish(dest, info)
+}
+
+// finish applies ownership and modification time to a copied entry
+func (c *copier) finish(dest string, info os.FileInfo) error {
+	uid, gid := 0, 0
+	if c.chown {
+		uid, gid = c.uid, c.gid
+	} else if c.keepOwner && info != nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+	if err := os.Lchown(dest, uid, gid); err != nil {
+		return err
+	}
+
+	if info != nil && info.Mode()&os.ModeSymlink == 0 {
+		return os.Chtimes(dest, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(dest, perm)
+}
+
+// download fetches an ADD URL into the rootfs with mode 0600, as Docker does
+func (c *copier) download(rawURL, dest string, destIsDir bool) error {
+	target := dest
+	if destIsDir {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return fmt.Errorf("cannot determine a filename from %s, use a file destination", rawURL)
+		}
+		target = path.Join(dest, name)
+	}
+	target, err := c.inRoot(target, true)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return c.finish(target, nil)
+}
+
+// extract unpacks a local tar archive given to ADD into dest. tar would
+// follow symlinks the image has under dest, so the archive is unpacked
+// into a scratch directory and copied from there.
+func (c *copier) extract(archive, dest string) error {
+	tmpDir, err := os.MkdirTemp("", "minidocker-add-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	output, err := exec.Command("tar", "-xf", archive, "-C", tmpDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %v, output: %s", filepath.Base(archive), err, string(output))
+	}
+
+	unpacked := *c
+	unpacked.contextDir, unpacked.ignore, unpacked.keepOwner = tmpDir, nil, true
+	return unpacked.copyTree(tmpDir, dest)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func isArchive(p string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar.zst"} {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupOwner resolves a --chown user[:group] value, using the rootfs's
+// /etc/passwd and /etc/group for names
+func lookupOwner(rootfs, spec string) (int, int, error) {
+	user, group, hasGroup := strings.Cut(spec, ":")
+
+	passwd, err := layer.ResolveInRoot(rootfs, "/etc/passwd")
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, primaryGID, err := lookupID(filepath.Join(rootfs, passwd), user, true)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to find user %s: %v", user, err)
+	}
+
+	gid := uid
+	if primaryGID >= 0 {
+		gid = primaryGID
+	}
+	if hasGroup {
+		groupFile, err := layer.ResolveInRoot(rootfs, "/etc/group")
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, _, err = lookupID(filepath.Join(rootfs, groupFile), group, false); err != nil {
+			return 0, 0, fmt.Errorf("unable to find group %s: %v", group, err)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupID returns the ID of a name in a passwd-style file, plus the
+// primary group if the file is /etc/passwd (-1 if unknown). Numeric names
+// are returned as is.
+func lookupID(file, name string, passwd bool) (int, int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, -1, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, err
+		}
+		primary := -1
+		if len(fields) > 3 && passwd {
+			primary, _ = strconv.Atoi(fields[3])
+		}
+		return id, primary, nil
+	}
+
+	return 0, 0, fmt.Errorf("no such entry")
+}
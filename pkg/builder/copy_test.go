@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestContext creates a build context and an empty rootfs
+func newTestContext(t *testing.T) *copier {
+	dir := t.TempDir()
+	c := &copier{contextDir: filepath.Join(dir, "context"), rootfs: filepath.Join(dir, "rootfs")}
+	for _, d := range []string{c.contextDir, c.rootfs, filepath.Join(c.contextDir, "src")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(c.contextDir, "src", "app.txt"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCopySourcesStayInContext(t *testing.T) {
+	c := newTestContext(t)
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"abs":   outside,
+		"rel":   "../../../../../../../.." + outside,
+		"inner": "src",
+	} {
+		if err := os.Symlink(target, filepath.Join(c.contextDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, src := range []string{"abs/secret", "rel/secret", "abs/*", "rel/sec*"} {
+		if err := c.copyAll([]string{src}, "/out/"); err == nil {
+			t.Errorf("COPY %s succeeded", src)
+		}
+		if _, err := c.checksum([]string{src}); err == nil {
+			t.Errorf("checksum of %s succeeded", src)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.rootfs, "out", "secret")); err == nil {
+		t.Error("a host file was copied into the rootfs")
+	}
+
+	// Links that stay in the context are followed as before
+	if err := c.copyAll([]string{"inner/*.txt"}, "/out/"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(c.rootfs, "out", "app.txt")); err != nil || string(data) != "app" {
+		t.Errorf("copied file = %q, %v", data, err)
+	}
+}
+
+func TestCopyDestinationStaysInRootfs(t *testing.T) {
+	c := newTestContext(t)
+
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(c.rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.copyAll([]string{"src/app.txt"}, "/link/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "app.txt")); err == nil {
+		t.Error("COPY wrote through a symlink out of the rootfs")
+	}
+	if _, err := os.Stat(filepath.Join(c.rootfs, outside, "app.txt")); err != nil {
+		t.Errorf("file was not copied to the link target inside the rootfs: %v", err)
+	}
+}
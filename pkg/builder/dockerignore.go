@@ -0,0 +1,157 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignorePattern is one line of a .dockerignore file
+type ignorePattern struct {
+	re        *regexp.Regexp
+	exception bool   // The line started with "!" and re-includes matches
+	literal   string // Leading part of the pattern before any wildcard
+}
+
+// ignoreMatcher decides which context paths a .dockerignore excludes.
+// Later lines win over earlier ones, as in Docker.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// loadIgnore reads the .dockerignore at the root of a build context. It
+// returns nil when there is none.
+func loadIgnore(contextDir string) (*ignoreMatcher, error) {
+	file, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &ignoreMatcher{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+		if line == "" {
+			continue
+		}
+
+		if p.re, err = compileIgnorePattern(line); err != nil {
+			return nil, fmt.Errorf("invalid .dockerignore pattern %q: %v", line, err)
+		}
+		p.literal = line
+		if i := strings.IndexAny(line, "*?[\\"); i >= 0 {
+			p.literal = line[:i]
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// compileIgnorePattern turns a pattern into an anchored regexp. "*" and "?"
+// stay within one path element, "**" spans any number of them.
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				i++
+				expr.WriteString("(.*/)?")
+			} else {
+				expr.WriteString(".*")
+			}
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// matches reports whether a pattern matches a path or one of its parents,
+// so excluding a directory excludes everything in it
+func (p *ignorePattern) matches(rel string) bool {
+	for {
+		if p.re.MatchString(rel) {
+			return true
+		}
+		i := strings.LastIndex(rel, "/")
+		if i < 0 {
+			return false
+		}
+		rel = rel[:i]
+	}
+}
+
+// ignored reports whether a slash-separated context-relative path is excluded
+func (m *ignoreMatcher) ignored(rel string) bool {
+	if m == nil {
+		return false
+	}
+
+	ignored := false
+	for i := range m.patterns {
+		p := &m.patterns[i]
+		if p.exception == ignored && p.matches(rel) {
+			ignored = !p.exception
+		}
+	}
+	return ignored
+}
+
+// prunable reports whether an excluded directory can be skipped entirely
+// because no "!" line could re-include anything below it
+func (m *ignoreMatcher) prunable(dir string) bool {
+	prefix := dir + "/"
+	for _, p := range m.patterns {
+		if p.exception && (strings.HasPrefix(p.literal, prefix) || strings.HasPrefix(prefix, p.literal)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/volume"
+)
+
+// Secret is a value RUN --mount=type=secret can expose to a build step
+type Secret struct {
+	ID   string
+	File string // Read from this file...
+	Env  string // ...or from this environment variable
+}
+
+// ParseSecret parses a --secret value: id=name[,src=path|,env=VAR]. Without
+// a source the secret comes from the environment variable named like its id.
+func ParseSecret(spec string) (Secret, error) {
+	var s Secret
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "id":
+			s.ID = value
+		case "src", "source":
+			s.File = value
+		case "env":
+			s.Env = value
+		case "type":
+			if value != "file" && value != "env" {
+				return s, fmt.Errorf("unsupported secret type %q", value)
+			}
+		default:
+			return s, fmt.Errorf("unknown secret option %q", key)
+		}
+	}
+
+	if s.ID == "" {
+		return s, fmt.Errorf("secret %q has no id", spec)
+	}
+	if s.File == "" && s.Env == "" {
+		s.Env = s.ID
+	}
+	return s, nil
+}
+
+// read returns the secret's value, or false if its source does not exist
+func (s Secret) read() ([]byte, bool, error) {
+	if s.File != "" {
+		data, err := os.ReadFile(s.File)
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return data, err == nil, err
+	}
+	value, ok := os.LookupEnv(s.Env)
+	return []byte(value), ok, nil
+}
+
+// runMount is one RUN --mount option
+type runMount struct {
+	Type     string // secret or cache
+	ID       string
+	Target   string
+	Required bool // secret: fail when the secret was not given
+	ReadOnly bool // cache: mount read-only
+}
+
+func parseRunMount(spec string) (*runMount, error) {
+	m := &runMount{Type: "bind"}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			m.Type = value
+		case "id":
+			m.ID = value
+		case "target", "dst", "destination":
+			m.Target = value
+		case "required":
+			m.Required = !hasValue || value == "true"
+		case "readonly", "ro":
+			m.ReadOnly = !hasValue || value == "true"
+		case "sharing", "mode", "uid", "gid":
+			// Accepted for compatibility, not applied
+		default:
+			return nil, fmt.Errorf("unknown mount option %q", key)
+		}
+	}
+
+	switch m.Type {
+	case "secret":
+		if m.ID == "" && m.Target == "" {
+			return nil, fmt.Errorf("secret mount requires an id or a target")
+		}
+		if m.ID == "" {
+			m.ID = path.Base(m.Target)
+		}
+		if m.Target == "" {
+			m.Target = "/run/secrets/" + m.ID
+		}
+	case "cache":
+		if m.Target == "" {
+			return nil, fmt.Errorf("cache mount requires a target")
+		}
+		if m.ID == "" {
+			m.ID = m.Target
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mount type %q (use secret or cache)", m.Type)
+	}
+
+	m.Target = path.Clean("/" + m.Target)
+	return m, nil
+}
+
+// stepMounts are the bind mounts set up for one RUN step
+type stepMounts struct {
+	rootfs   string
+	targets  []string // Mounted container paths, in mount order
+	created  []string // Paths created for mount points, children first
+	tmpDir   string   // Holds copies of the mounted secrets
+	released bool
+}
+
+// mountRunMounts sets up an instruction's --mount options inside rootfs
+func (b *Builder) mountRunMounts(inst *Instruction, rootfs string) (*stepMounts, error) {
+	m := &stepMounts{rootfs: rootfs}
+
+	for _, spec := range inst.Mounts {
+		rm, err := parseRunMount(spec)
+		if err != nil {
+			m.release()
+			return nil, fmt.Errorf("line %d: invalid --mount: %v", inst.Line, err)
+		}
+
+		var source string
+		switch rm.Type {
+		case "secret":
+			if source, err = m.secretSource(b.opts.Secrets, rm); err == nil && source == "" {
+				// Optional secrets that were not given are left out
+				continue
+			}
+		case "cache":
+			source, err = cacheVolume(rm)
+		}
+		if err == nil {
+			err = m.bind(source, rm.Target, rm.Type == "secret" || rm.ReadOnly)
+		}
+		if err != nil {
+			m.release()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// secretSource copies a secret to a private file for bind mounting. Secrets
+// are copied rather than mounted from their source so they are always
+// read-only and owned by root inside the container.
+func (m *stepMounts) secretSource(secrets []Secret, rm *runMount) (string, error) {
+	for _, s := range secrets {
+		if s.ID != rm.ID {
+			continue
+		}
+
+		data, ok, err := s.read()
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret %s: %v", s.ID, err)
+		}
+		if !ok {
+			break
+		}
+
+		if m.tmpDir == "" {
+			if m.tmpDir, err = os.MkdirTemp("", "minidocker-secrets-"); err != nil {
+				return "", err
+			}
+		}
+		file := filepath.Join(m.tmpDir, fmt.Sprintf("%d", len(m.targets)))
+		if err := os.WriteFile(file, data, 0400); err != nil {
+			return "", err
+		}
+		return file, nil
+	}
+
+	if rm.Required {
+		return "", fmt.Errorf("secret %s is required but was not provided", rm.ID)
+	}
+	return "", nil
+}
+
+// cacheVolume returns the volume backing a cache mount, creating it on first use
+func cacheVolume(rm *runMount) (string, error) {
+	sum := sha256.Sum256([]byte(rm.ID))
+	return volume.PrepareMount(&volume.Mount{
+		Type:        "volume",
+		Source:      "buildcache-" + hex.EncodeToString(sum[:])[:12],
+		Destination: rm.Target,
+	})
+}
+
+// bind mounts source over target in the rootfs, creating the mount point
+func (m *stepMounts) bind(source, target string, readOnly bool) error {
+	resolved, err := layer.ResolveInRoot(m.rootfs, target)
+	if err != nil {
+		return err
+	}
+	mountPoint := filepath.Join(m.rootfs, resolved)
+
+	// Remember what is created for the mount point so it can be removed again
+	var created []string
+	for p := resolved; p != "/"; p = path.Dir(p) {
+		if _, err := os.Lstat(filepath.Join(m.rootfs, p)); err == nil {
+			break
+		}
+		created = append(created, p)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(mountPoint, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(mountPoint), 0755); err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(mountPoint, os.O_CREATE|os.O_WRONLY, 0400); err == nil {
+			file.Close()
+		}
+	}
+	m.created = append(created, m.created...)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point %s: %v", target, err)
+	}
+
+	if err := overlay.BindMount(source, mountPoint, readOnly); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", target, err)
+	}
+	m.targets = append(m.targets, resolved)
+	return nil
+}
+
+// release unmounts everything and removes the secret copies. It is safe to call twice.
+func (m *stepMounts) release() {
+	if m.released {
+		return
+	}
+	m.released = true
+
+	for i := len(m.targets) - 1; i >= 0; i-- {
+		overlay.Unmount(filepath.Join(m.rootfs, m.targets[i]))
+	}
+	if m.tmpDir != "" {
+		os.RemoveAll(m.tmpDir)
+	}
+}
+
+// removeMountPoints deletes the files and directories created for the
+// mounts, after release, so they stay out of the layer. Anything the
+// step put there itself is kept.
+func (m *stepMounts) removeMountPoints() error {
+	for _, p := range m.created {
+		hostPath := filepath.Join(m.rootfs, p)
+		info, err := os.Lstat(hostPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Size() != 0 {
+			continue
+		}
+		if err := os.Remove(hostPath); err != nil && !errors.Is(err, syscall.ENOTEMPTY) {
+			return fmt.Errorf("failed to remove mount point %s: %v", p, err)
+		}
+	}
+	m.created = nil
+	return nil
+}
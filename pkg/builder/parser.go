@@ -0,0 +1,314 @@
+package builder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction is one parsed Dockerfile instruction
+type Instruction struct {
+	Command  string            // Upper-case keyword, e.g. RUN
+	Flags    map[string]string // Leading --key=value options, e.g. --from for COPY
+	Mounts   []string          // RUN --mount values, the one option that may repeat
+	Args     []string          // Arguments; a shell-form RUN/CMD/ENTRYPOINT has a single argument
+	JSONForm bool              // Arguments were given as a JSON array (exec form)
+	Original string            // The instruction as written, continuation lines joined
+	Line     int               // Line the instruction starts on
+}
+
+// commands lists the instructions the builder understands
+var commands = map[string]bool{
+	"FROM":       true,
+	"ARG":        true,
+	"RUN":        true,
+	"COPY":       true,
+	"ADD":        true,
+	"ENV":        true,
+	"WORKDIR":    true,
+	"CMD":        true,
+	"ENTRYPOINT": true,
+	"USER":       true,
+	"EXPOSE":     true,
+}
+
+// flagCommands lists the instructions that accept --key=value options
+var flagCommands = map[string]bool{
+	"FROM": true,
+	"RUN":  true,
+	"COPY": true,
+	"ADD":  true,
+}
+
+// Parse reads a Dockerfile into its instructions
+func Parse(r io.Reader) ([]*Instruction, error) {
+	var instructions []*Instruction
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNo := 0
+	var current strings.Builder
+	startLine := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		// Comments and blank lines may appear between continuation lines
+		if strings.HasPrefix(trimmed, "#") || (trimmed == "" && current.Len() > 0) {
+			continue
+		}
+		if trimmed == "" {
+			continue
+		}
+
+		if current.Len() == 0 {
+			startLine = lineNo
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		current.WriteString(line)
+
+		inst, err := parseLine(strings.TrimSpace(current.String()), startLine)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if current.Len() > 0 {
+		inst, err := parseLine(strings.TrimSpace(current.String()), startLine)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("the Dockerfile is empty")
+	}
+	// Only ARG may come before the first FROM
+	for i, inst := range instructions {
+		if inst.Command == "FROM" {
+			break
+		}
+		if inst.Command != "ARG" || i == len(instructions)-1 {
+			return nil, fmt.Errorf("line %d: the first instruction must be FROM", inst.Line)
+		}
+	}
+
+	return instructions, nil
+}
+
+// ParseInstruction parses a single instruction, e.g. a commit --change value
+func ParseInstruction(s string) (*Instruction, error) {
+	return parseLine(strings.TrimSpace(s), 1)
+}
+
+func parseLine(line string, lineNo int) (*Instruction, error) {
+	keyword, rest, _ := strings.Cut(line, " ")
+	inst := &Instruction{
+		Command:  strings.ToUpper(keyword),
+		Flags:    make(map[string]string),
+		Original: line,
+		Line:     lineNo,
+	}
+	rest = strings.TrimSpace(rest)
+
+	if !commands[inst.Command] {
+		return nil, fmt.Errorf("line %d: unknown instruction: %s", lineNo, keyword)
+	}
+
+	if flagCommands[inst.Command] {
+		for strings.HasPrefix(rest, "--") {
+			var flag string
+			flag, rest, _ = strings.Cut(rest, " ")
+			rest = strings.TrimSpace(rest)
+
+			key, value, _ := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+			if inst.Command == "RUN" && key == "mount" {
+				inst.Mounts = append(inst.Mounts, value)
+				continue
+			}
+			inst.Flags[key] = value
+		}
+	}
+
+	if rest == "" {
+		return nil, fmt.Errorf("line %d: %s requires at least one argument", lineNo, inst.Command)
+	}
+
+	switch inst.Command {
+	case "RUN", "CMD", "ENTRYPOINT":
+		if args, ok := parseJSONArray(rest); ok {
+			inst.Args, inst.JSONForm = args, true
+		} else {
+			inst.Args = []string{rest}
+		}
+
+	case "COPY", "ADD":
+		if args, ok := parseJSONArray(rest); ok {
+			inst.Args, inst.JSONForm = args, true
+		} else {
+			inst.Args = strings.Fields(rest)
+		}
+		if len(inst.Args) < 2 {
+			return nil, fmt.Errorf("line %d: %s requires at least two arguments", lineNo, inst.Command)
+		}
+
+	case "ENV":
+		args, err := parseKeyValues(rest, nil)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		inst.Args = args
+
+	case "ARG":
+		args, err := splitWords(rest, nil)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		for _, arg := range args {
+			if name, _, _ := strings.Cut(arg, "="); name == "" {
+				return nil, fmt.Errorf("line %d: ARG requires a name: %q", lineNo, arg)
+			}
+		}
+		inst.Args = args
+
+	case "FROM":
+		inst.Args = strings.Fields(rest)
+		if len(inst.Args) != 1 && !(len(inst.Args) == 3 && strings.EqualFold(inst.Args[1], "AS")) {
+			return nil, fmt.Errorf("line %d: FROM requires either one or three arguments", lineNo)
+		}
+
+	case "WORKDIR", "USER":
+		inst.Args = []string{rest}
+
+	default:
+		inst.Args = strings.Fields(rest)
+	}
+
+	return inst, nil
+}
+
+// parseJSONArray decodes an exec-form argument list such as ["a", "b"]
+func parseJSONArray(s string) ([]string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(s), &args); err != nil {
+		return nil, false
+	}
+	return args, true
+}
+
+// parseKeyValues parses ENV arguments into KEY=value pairs. It accepts
+// both "KEY=value KEY2=value2" and the legacy "KEY value" form. A non-nil
+// lookup expands variables in the values, as in splitWords.
+func parseKeyValues(s string, lookup func(string) (string, bool)) ([]string, error) {
+	words, err := splitWords(s, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// A name that expands to nothing leaves no words at all
+	if len(words) == 0 {
+		return nil, fmt.Errorf("ENV requires a name")
+	}
+
+	if !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(s, " ")
+		value = strings.TrimSpace(value)
+		if lookup != nil {
+			if key, err = expand(key, lookup); err != nil {
+				return nil, err
+			}
+			if value, err = expand(value, lookup); err != nil {
+				return nil, err
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("ENV requires a name")
+		}
+		return []string{key + "=" + value}, nil
+	}
+
+	for _, w := range words {
+		name, _, ok := strings.Cut(w, "=")
+		if !ok {
+			return nil, fmt.Errorf("syntax error - can't find = in %q, must be of the form: name=value", w)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("ENV requires a name: %q", w)
+		}
+	}
+	return words, nil
+}
+
+// splitWords splits on whitespace, honoring quotes and backslash escapes.
+// With a lookup, variables outside single quotes are expanded while
+// splitting; their values never split into more words.
+func splitWords(s string, lookup func(string) (string, bool)) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == '$' && quote != '\'' && lookup != nil:
+			value, end, err := expandReference(s, i, lookup)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			inWord = inWord || value != "" || quote != 0
+			i = end
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
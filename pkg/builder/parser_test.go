@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	lookup := envLookup([]string{"NAME=app", "DIR=/srv/app", "SPACED=a b"})
+
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"A=1 B=2", []string{"A=1", "B=2"}},
+		{`A="x y" B='$NAME'`, []string{"A=x y", "B=$NAME"}},
+		{"HOME=$DIR PATH=${DIR}/bin", []string{"HOME=/srv/app", "PATH=/srv/app/bin"}},
+		{"X=$SPACED", []string{"X=a b"}},
+		{"GREETING hello $NAME", []string{"GREETING=hello app"}},
+		{"$NAME value", []string{"app=value"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseKeyValues(tt.in, lookup)
+		if err != nil {
+			t.Errorf("parseKeyValues(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseKeyValues(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseKeyValuesRequiresName(t *testing.T) {
+	lookup := envLookup(nil)
+
+	for _, in := range []string{"$UNSET", "${UNSET}", "$UNSET value", "=value", "A=1 $UNSET=2"} {
+		_, err := parseKeyValues(in, lookup)
+		if err == nil || !strings.Contains(err.Error(), "ENV requires a name") {
+			t.Errorf("parseKeyValues(%q) gave error %v, want a missing name", in, err)
+		}
+	}
+}
+
+func TestExpandEnvWithUnsetName(t *testing.T) {
+	// The name is only known to be empty once the variable is looked up
+	instructions, err := Parse(strings.NewReader("FROM scratch\nENV $UNSET\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = expandInstruction(instructions[1], envLookup(nil))
+	if err == nil || !strings.Contains(err.Error(), "line 2: ENV requires a name") {
+		t.Errorf("got error %v, want a missing name on line 2", err)
+	}
+}
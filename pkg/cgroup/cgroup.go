@@ -6,10 +6,20 @@ import (
     "path/filepath"
     "strconv"
     "strings"
+    "time"
 )
 
 const cgroupBasePath = "/sys/fs/cgroup"
 
+// Parent is the cgroup, relative to the cgroup root, that container cgroups
+// are created in. Empty means the root.
+var Parent string
+
+// Path returns the cgroup directory of a container
+func Path(containerID string) string {
+    return filepath.Join(cgroupBasePath, Parent, "minidocker-"+containerID)
+}
+
 type ContainerLimits struct {
     MemoryMB int
     CPUQuota float64  // 0.5 = 50% of one CPU core
@@ -18,7 +28,7 @@ type ContainerLimits struct {
 // CreateCgroupForContainer creates cgroup and sets limits
 func CreateCgroupForContainer(containerID string, limits ContainerLimits) error {
     // Create cgroup directory
-    cgroupPath := filepath.Join(cgroupBasePath, "minidocker-"+containerID)
+    cgroupPath := Path(containerID)
     if err := os.MkdirAll(cgroupPath, 0755); err != nil {
         return fmt.Errorf("failed to create cgroup: %v", err)
     }
@@ -50,7 +60,7 @@ func CreateCgroupForContainer(containerID string, limits ContainerLimits) error
 
 // AddProcessToCgroup adds a process to the cgroup
 func AddProcessToCgroup(containerID string, pid int) error {
-    cgroupPath := filepath.Join(cgroupBasePath, "minidocker-"+containerID)
+    cgroupPath := Path(containerID)
     procsFile := filepath.Join(cgroupPath, "cgroup.procs")
     
     return os.WriteFile(procsFile, []byte(strconv.Itoa(pid)), 0644)
@@ -58,13 +68,42 @@ func AddProcessToCgroup(containerID string, pid int) error {
 
 // RemoveCgroup removes the cgroup directory
 func RemoveCgroup(containerID string) error {
-    cgroupPath := filepath.Join(cgroupBasePath, "minidocker-"+containerID)
+    cgroupPath := Path(containerID)
     return os.RemoveAll(cgroupPath)
 }
 
+// Freeze stops every process in the container's cgroup until Thaw is called
+func Freeze(containerID string) error {
+    cgroupPath := Path(containerID)
+    if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.freeze"), []byte("1"), 0644); err != nil {
+        return fmt.Errorf("failed to freeze cgroup: %v", err)
+    }
+
+    // Freezing is asynchronous, cgroup.events reports when it is done
+    for i := 0; i < 100; i++ {
+        data, err := os.ReadFile(filepath.Join(cgroupPath, "cgroup.events"))
+        if err == nil && strings.Contains(string(data), "frozen 1") {
+            return nil
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    Thaw(containerID)
+    return fmt.Errorf("timed out waiting for cgroup to freeze")
+}
+
+// Thaw resumes a container stopped by Freeze
+func Thaw(containerID string) error {
+    cgroupPath := Path(containerID)
+    if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.freeze"), []byte("0"), 0644); err != nil {
+        return fmt.Errorf("failed to thaw cgroup: %v", err)
+    }
+    return nil
+}
+
 // GetCgroupStats returns memory and CPU usage
 func GetCgroupStats(containerID string) (map[string]string, error) {
-    cgroupPath := filepath.Join(cgroupBasePath, "minidocker-"+containerID)
+    cgroupPath := Path(containerID)
     stats := make(map[string]string)
     
     // Get memory usage
@@ -81,3 +120,19 @@ func GetCgroupStats(containerID string) (map[string]string, error) {
     
     return stats, nil
 }
+
+// ListCgroups returns the IDs of the containers that have a cgroup
+func ListCgroups() ([]string, error) {
+    entries, err := os.ReadDir(filepath.Join(cgroupBasePath, Parent))
+    if err != nil {
+        return nil, err
+    }
+
+    var ids []string
+    for _, entry := range entries {
+        if entry.IsDir() && strings.HasPrefix(entry.Name(), "minidocker-") {
+            ids = append(ids, strings.TrimPrefix(entry.Name(), "minidocker-"))
+        }
+    }
+    return ids, nil
+}
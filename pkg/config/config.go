@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/cgroup"
+	"github.com/jagjeet-singh-23/minidocker/pkg/namespace"
+	"github.com/jagjeet-singh-23/minidocker/pkg/network"
+	"github.com/jagjeet-singh-23/minidocker/pkg/snapshot"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// DefaultPath is where the config file is read from, unless MINIDOCKER_CONFIG
+// or --config names another one
+const DefaultPath = "/etc/minidocker/config.json"
+
+// Log drivers: file keeps a container's output in the state root, none
+// keeps nothing
+const (
+	LogDriverFile = "file"
+	LogDriverNone = "none"
+)
+
+// Config holds the settings shared by every command. Fields left out of the
+// config file keep their defaults.
+type Config struct {
+	DataRoot       string                      `json:"data-root"`
+	StorageDriver  string                      `json:"storage-driver"`
+	BridgeSubnet   string                      `json:"bridge-subnet"`
+	LogDriver      string                      `json:"log-driver"`
+	DefaultUlimits map[string]namespace.Ulimit `json:"default-ulimits"`
+	CgroupParent   string                      `json:"cgroup-parent"`
+}
+
+// Default returns the settings used without a config file
+func Default() *Config {
+	return &Config{
+		DataRoot:      store.Root,
+		StorageDriver: snapshot.DefaultDriver,
+		BridgeSubnet:  network.SubnetCIDR,
+		LogDriver:     LogDriverFile,
+	}
+}
+
+// Load reads the config file at path, or at the default path if path is
+// empty, on top of the defaults. Only the default file may be missing.
+// MINIDOCKER_ROOT overrides the file's data root.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv("MINIDOCKER_CONFIG")
+	}
+	required := path != ""
+	if path == "" {
+		path = DefaultPath
+	}
+
+	file, err := os.Open(path)
+	if err == nil {
+		defer file.Close()
+
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if root := os.Getenv("MINIDOCKER_ROOT"); root != "" {
+		cfg.DataRoot = root
+	}
+
+	return cfg, nil
+}
+
+// Apply checks the settings and hands them to the packages they configure.
+// The storage and log drivers are read from the config by the caller.
+func (c *Config) Apply() error {
+	if !filepath.IsAbs(c.DataRoot) {
+		return fmt.Errorf("data root %q must be an absolute path", c.DataRoot)
+	}
+	if _, err := snapshot.Get(c.StorageDriver); err != nil {
+		return err
+	}
+	if c.LogDriver != LogDriverFile && c.LogDriver != LogDriverNone {
+		return fmt.Errorf("unknown log driver %q (use %s or %s)", c.LogDriver, LogDriverFile, LogDriverNone)
+	}
+	if filepath.IsAbs(c.CgroupParent) || strings.Contains(c.CgroupParent, "..") {
+		return fmt.Errorf("cgroup parent %q must be relative to the cgroup root", c.CgroupParent)
+	}
+
+	var ulimits []namespace.Ulimit
+	for name, ulimit := range c.DefaultUlimits {
+		if ulimit.Name == "" {
+			ulimit.Name = name
+		}
+		if ulimit.Name != name {
+			return fmt.Errorf("ulimit %s is named %s", name, ulimit.Name)
+		}
+		if err := ulimit.Validate(); err != nil {
+			return err
+		}
+		ulimits = append(ulimits, ulimit)
+	}
+	sort.Slice(ulimits, func(i, j int) bool {
+		return ulimits[i].Name < ulimits[j].Name
+	})
+
+	if err := network.SetSubnet(c.BridgeSubnet); err != nil {
+		return err
+	}
+	store.Root = filepath.Clean(c.DataRoot)
+	cgroup.Parent = c.CgroupParent
+	namespace.DefaultUlimits = ulimits
+	return nil
+}
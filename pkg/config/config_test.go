@@ -0,0 +1,154 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/cgroup"
+	"github.com/jagjeet-singh-23/minidocker/pkg/namespace"
+	"github.com/jagjeet-singh-23/minidocker/pkg/network"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// keepGlobals restores the package settings Apply changes once a test ends
+func keepGlobals(t *testing.T) {
+	root, subnet, bridgeIP := store.Root, network.SubnetCIDR, network.BridgeIP
+	parent, ulimits := cgroup.Parent, namespace.DefaultUlimits
+	t.Cleanup(func() {
+		store.Root, network.SubnetCIDR, network.BridgeIP = root, subnet, bridgeIP
+		cgroup.Parent, namespace.DefaultUlimits = parent, ulimits
+	})
+	t.Setenv("MINIDOCKER_ROOT", "")
+	t.Setenv("MINIDOCKER_CONFIG", "")
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAppliesToPackages(t *testing.T) {
+	keepGlobals(t)
+	root := t.TempDir()
+
+	path := writeConfig(t, `{
+		"data-root": "`+root+`/",
+		"bridge-subnet": "10.77.0.0/24",
+		"cgroup-parent": "minidocker-test",
+		"default-ulimits": {
+			"nofile": {"Soft": 1024, "Hard": 4096},
+			"memlock": {"Soft": 65536, "Hard": "unlimited"},
+			"core": {"Soft": -1, "Hard": -1}
+		}
+	}`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Root != root {
+		t.Errorf("store.Root = %q, want %q", store.Root, root)
+	}
+	if network.SubnetCIDR != "10.77.0.0/24" || network.BridgeIP != "10.77.0.1/24" {
+		t.Errorf("subnet = %s, bridge IP = %s, want 10.77.0.0/24 and 10.77.0.1/24", network.SubnetCIDR, network.BridgeIP)
+	}
+	if cgroup.Parent != "minidocker-test" {
+		t.Errorf("cgroup.Parent = %q, want minidocker-test", cgroup.Parent)
+	}
+	want := []namespace.Ulimit{
+		{Name: "core", Soft: namespace.Unlimited, Hard: namespace.Unlimited},
+		{Name: "memlock", Soft: 65536, Hard: namespace.Unlimited},
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+	}
+	if !reflect.DeepEqual(namespace.DefaultUlimits, want) {
+		t.Errorf("ulimits = %+v, want %+v", namespace.DefaultUlimits, want)
+	}
+
+	// State written from now on lands in the temporary root
+	if _, err := network.AllocateIP(network.DefaultNetwork, network.SubnetCIDR, "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "ipam", network.DefaultNetwork+".json")); err != nil {
+		t.Errorf("allocation was not stored in the data root: %v", err)
+	}
+}
+
+func TestDataRootOverrides(t *testing.T) {
+	keepGlobals(t)
+	path := writeConfig(t, `{"data-root": "/var/lib/from-file"}`)
+
+	// MINIDOCKER_ROOT beats the config file
+	envRoot := t.TempDir()
+	t.Setenv("MINIDOCKER_ROOT", envRoot)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataRoot != envRoot {
+		t.Errorf("DataRoot = %q, want %q from MINIDOCKER_ROOT", cfg.DataRoot, envRoot)
+	}
+
+	// --data-root is set on the loaded config before it is applied
+	flagRoot := t.TempDir()
+	cfg.DataRoot = flagRoot
+	if err := cfg.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Root != flagRoot {
+		t.Errorf("store.Root = %q, want %q", store.Root, flagRoot)
+	}
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	keepGlobals(t)
+
+	// Only a file that was asked for must exist
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loading a missing config file named explicitly succeeded")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown key", `{"data-rot": "/x"}`, "unknown field"},
+		{"relative root", `{"data-root": "state"}`, "absolute path"},
+		{"log driver", `{"log-driver": "syslog"}`, "unknown log driver"},
+		{"small subnet", `{"bridge-subnet": "10.0.0.0/31"}`, "too small"},
+		{"escaping cgroup parent", `{"cgroup-parent": "../system.slice"}`, "cgroup parent"},
+		{"unknown ulimit", `{"default-ulimits": {"files": {"Soft": 1, "Hard": 1}}}`, "unknown ulimit"},
+		{"ulimit word", `{"default-ulimits": {"nofile": {"Soft": "lots", "Hard": 1}}}`, "must be a number or unlimited"},
+		{"ulimit below -1", `{"default-ulimits": {"nofile": {"Soft": -2, "Hard": 1}}}`, "-1 (unlimited) or more"},
+		{"soft above hard", `{"default-ulimits": {"nofile": {"Soft": 2048, "Hard": 1024}}}`, "above hard limit"},
+		{"unlimited soft", `{"default-ulimits": {"core": {"Soft": "unlimited", "Hard": 1024}}}`, "above hard limit"},
+		{"unlimited nofile", `{"default-ulimits": {"nofile": {"Soft": 1024, "Hard": "unlimited"}}}`, "fs.nr_open"},
+		{"ulimit key", `{"default-ulimits": {"nofile": {"Soft": 1, "Hard": 1, "Max": 1}}}`, "unknown field"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepGlobals(t)
+
+			cfg, err := Load(writeConfig(t, tt.content))
+			if err == nil {
+				err = cfg.Apply()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
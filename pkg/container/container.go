@@ -1,15 +1,42 @@
 package container
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"github.com/jagjeet-singh-23/minidocker/pkg/network"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 	"github.com/jagjeet-singh-23/minidocker/pkg/volume"
 )
 
-const containerStorePath = "/var/lib/minidocker/containers"
+// containerSchema versions container records
+var containerSchema = &store.Schema{
+	Kind: "container",
+	Migrations: []store.Migration{
+		nil,             // 1: schema_version added
+		migrateNetworks, // 2: endpoints moved to networks
+	},
+}
+
+// migrateNetworks records the address of a container on the default bridge
+// as its endpoint there
+func migrateNetworks(record map[string]interface{}) error {
+	ip, _ := record["ip_address"].(string)
+	if ip == "" || record["network_mode"] != network.DefaultNetwork {
+		return nil
+	}
+
+	record["networks"] = map[string]interface{}{
+		network.DefaultNetwork: map[string]interface{}{
+			"interface":  "eth0",
+			"ip_address": ip,
+			"veth_host":  record["veth_host"],
+		},
+	}
+	return nil
+}
 
 type ContainerState string
 
@@ -30,6 +57,7 @@ type Container struct {
     ID           string            `json:"id"`
     Name         string            `json:"name"`
     Image        string            `json:"image"`
+    ImageID      string            `json:"image_id"`
     Command      []string          `json:"command"`
     State        ContainerState    `json:"state"`
     PID          int               `json:"pid"`
@@ -44,35 +72,53 @@ type Container struct {
     Ports        []PortMapping     `json:"ports"`
     Env          []string          `json:"env"`
     WorkingDir   string		   `json:"working_dir"`
+    StorageDriver string           `json:"storage_driver,omitempty"` // Snapshotter holding the root filesystem
+    Rootfs       string            `json:"rootfs,omitempty"`
+    VethHost     string            `json:"veth_host,omitempty"` // Host end of the container's veth pair
+    Networks     map[string]*network.Endpoint `json:"networks,omitempty"` // By network name; IPAddress and VethHost are those of eth0
+    SchemaVersion int              `json:"schema_version"`
 }
 
 // SaveContainer persists container metadata
 func SaveContainer(container *Container) error {
-	if err := os.MkdirAll(containerStorePath, 0755); err != nil {
-		return err
-	}
-
-	containerFile := filepath.Join(containerStorePath, container.ID+".json")
-	data, err := json.MarshalIndent(container, "", "  ")
-
+	lock, err := store.Acquire("container-" + container.ID)
 	if err != nil {
 		return err
 	}
+	defer lock.Release()
 
-	return os.WriteFile(containerFile, data, 0644)
+	return saveContainer(container)
 }
 
-// LoadContainer loads container metadata
-func LoadContainer(containerID string) (*Container, error) {
-	containerFile := filepath.Join(containerStorePath, containerID+".json")
-	data, err := os.ReadFile(containerFile)
+func saveContainer(container *Container) error {
+	container.SchemaVersion = containerSchema.Version()
+	return store.WriteJSON(containerPath(container.ID), container)
+}
 
+// UpdateContainer applies fn to the latest metadata of a container and saves
+// it, holding the container's lock so concurrent updates are not lost
+func UpdateContainer(containerID string, fn func(*Container) error) (*Container, error) {
+	lock, err := store.Acquire("container-" + containerID)
 	if err != nil {
 		return nil, err
 	}
+	defer lock.Release()
+
+	container, err := LoadContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(container); err != nil {
+		return nil, err
+	}
+
+	return container, saveContainer(container)
+}
 
+// LoadContainer loads container metadata
+func LoadContainer(containerID string) (*Container, error) {
 	var container Container
-	if err := json.Unmarshal(data, &container); err != nil {
+	if err := store.ReadJSON(containerPath(containerID), &container, containerSchema); err != nil {
 		return nil, err
 	}
 
@@ -83,21 +129,26 @@ func LoadContainer(containerID string) (*Container, error) {
 func ListContainers() ([]*Container, error) {
 	var containers []*Container
 
-	if _, err := os.Stat(containerStorePath); os.IsNotExist(err) {
+	files, err := os.ReadDir(store.Path("containers"))
+	if os.IsNotExist(err) {
 		return containers, nil
 	}
-
-	files, err := os.ReadDir(containerStorePath)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			containerID := file.Name()[:len(file.Name()) - 5]
-			if container, err := LoadContainer(containerID); err == nil {
-				containers = append(containers, container)
+		if isRecord(file.Name()) {
+			containerID := strings.TrimSuffix(file.Name(), ".json")
+			container, err := LoadContainer(containerID)
+			if err != nil {
+				// Removed since the directory was read
+				if !os.IsNotExist(err) {
+					fmt.Fprintf(os.Stderr, "Warning: skipping container %s: %v\n", containerID, err)
+				}
+				continue
 			}
+			containers = append(containers, container)
 		}
 	}
 
@@ -106,6 +157,12 @@ func ListContainers() ([]*Container, error) {
 
 // RemoveContainer deletes container metadata and logs
 func RemoveContainer(containerID string) error {
+	lock, err := store.Acquire("container-" + containerID)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	container, err := LoadContainer(containerID)
 	if err != nil {
 		return err
@@ -115,21 +172,37 @@ func RemoveContainer(containerID string) error {
 		os.Remove(container.LogPath)
 	}
 
-	containerFile := filepath.Join(containerStorePath, containerID+".json")
-	return os.Remove(containerFile)
+	return os.Remove(containerPath(containerID))
 }
 
-// GenerateContainerID creates a unique container ID
-func GenerateContainerID() string {
-	return fmt.Sprintf("c%d", time.Now().UnixNano())
+// isRecord reports whether a file in the containers directory is a
+// container's metadata, rather than its log or a temporary file
+func isRecord(name string) bool {
+	return filepath.Ext(name) == ".json" && !strings.HasPrefix(name, ".")
 }
 
-// FindContainerByPrefix finds container by ID prefix
+func containerPath(containerID string) string {
+	return store.Path("containers", containerID+".json")
+}
+
+// FindContainerByPrefix finds a container by full ID, name or ID prefix,
+// in that order
 func FindContainerByPrefix(prefix string) (*Container, error) {
     containers, err := ListContainers()
     if err != nil {
         return nil, err
     }
+
+    for _, c := range containers {
+        if c.ID == prefix {
+            return c, nil
+        }
+    }
+    for _, c := range containers {
+        if c.Name == prefix {
+            return c, nil
+        }
+    }
     
     var matches []*Container
     for _, c := range containers {
@@ -0,0 +1,127 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// shortIDLength is the least number of characters a short ID has
+const shortIDLength = 12
+
+// validName is what container names may look like
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// GenerateContainerID returns a new random 64 hex character ID that no
+// existing container has
+func GenerateContainerID() (string, error) {
+	for i := 0; i < 10; i++ {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate container ID: %v", err)
+		}
+		id := hex.EncodeToString(b)
+
+		// An all-digit short ID would read like a number
+		if strings.Trim(id[:shortIDLength], "0123456789") == "" {
+			continue
+		}
+		if _, err := os.Stat(containerPath(id)); os.IsNotExist(err) {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique container ID")
+}
+
+// ShortID returns the shortest prefix of a container ID, at least 12
+// characters long, that no other container's ID starts with
+func ShortID(id string) string {
+	ids, _ := listIDs()
+	return shortID(id, ids)
+}
+
+func shortID(id string, ids []string) string {
+	length := shortIDLength
+	for _, other := range ids {
+		if other == id {
+			continue
+		}
+		common := 0
+		for common < len(id) && common < len(other) && id[common] == other[common] {
+			common++
+		}
+		if common+1 > length {
+			length = common + 1
+		}
+	}
+	if length > len(id) {
+		return id
+	}
+	return id[:length]
+}
+
+// listIDs returns the IDs of all containers without loading their metadata
+func listIDs() ([]string, error) {
+	files, err := os.ReadDir(store.Path("containers"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if isRecord(file.Name()) {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+// ValidateName checks that a name given with --name is usable
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	return nil
+}
+
+// CreateContainer saves the metadata of a new container. A container without
+// a name is given a random one; names and IDs must not be in use.
+func CreateContainer(container *Container) error {
+	lock, err := store.Acquire("names")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	containers, err := ListContainers()
+	if err != nil {
+		return err
+	}
+
+	taken := make(map[string]bool)
+	for _, c := range containers {
+		if c.ID == container.ID {
+			return fmt.Errorf("container ID %s is already in use", container.ID)
+		}
+		if container.Name != "" && c.Name == container.Name {
+			return fmt.Errorf("the container name %q is already in use by container %s", c.Name, ShortID(c.ID))
+		}
+		taken[c.Name] = true
+	}
+
+	if container.Name == "" {
+		container.Name = generateName(taken)
+	} else if err := ValidateName(container.Name); err != nil {
+		return err
+	}
+
+	return SaveContainer(container)
+}
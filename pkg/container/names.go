@@ -0,0 +1,60 @@
+package container
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+var adjectives = []string{
+	"admiring", "adoring", "affectionate", "agitated", "amazing", "angry",
+	"awesome", "beautiful", "blissful", "bold", "brave", "busy", "charming",
+	"clever", "compassionate", "competent", "confident", "cool", "cranky",
+	"crazy", "dazzling", "determined", "dreamy", "eager", "ecstatic",
+	"elastic", "elated", "elegant", "eloquent", "epic", "exciting",
+	"fervent", "festive", "flamboyant", "focused", "friendly", "frosty",
+	"funny", "gallant", "gifted", "goofy", "gracious", "great", "happy",
+	"hardcore", "heuristic", "hopeful", "hungry", "infallible", "inspiring",
+	"intelligent", "interesting", "jolly", "jovial", "keen", "kind",
+	"laughing", "loving", "lucid", "magical", "modest", "musing",
+	"mystifying", "naughty", "nervous", "nice", "nifty", "nostalgic",
+	"objective", "optimistic", "peaceful", "pedantic", "pensive", "practical",
+	"priceless", "quirky", "quizzical", "relaxed", "reverent", "romantic",
+	"sad", "serene", "sharp", "silly", "sleepy", "stoic", "strange",
+	"stupefied", "suspicious", "sweet", "tender", "thirsty", "trusting",
+	"unruffled", "upbeat", "vibrant", "vigilant", "vigorous", "wizardly",
+	"wonderful", "xenodochial", "youthful", "zealous", "zen",
+}
+
+// Scientists and engineers
+var surnames = []string{
+	"agnesi", "albattani", "allen", "archimedes", "babbage", "banach",
+	"bardeen", "bartik", "bell", "bhabha", "bohr", "booth", "borg", "bose",
+	"brahmagupta", "brown", "carson", "cerf", "chandrasekhar", "clarke",
+	"cori", "curie", "darwin", "diffie", "dijkstra", "einstein", "elion",
+	"euclid", "euler", "faraday", "fermat", "fermi", "feynman", "franklin",
+	"galileo", "gauss", "goldberg", "goodall", "hamilton", "hawking",
+	"heisenberg", "hertz", "hodgkin", "hofstadter", "hopper", "hypatia",
+	"jackson", "johnson", "kalam", "kapitsa", "kepler", "khorana",
+	"knuth", "kowalevski", "lamarr", "lamport", "leakey", "lovelace",
+	"lumiere", "mahavira", "maxwell", "mccarthy", "meitner", "mendel",
+	"minsky", "mirzakhani", "morse", "newton", "nobel", "noether",
+	"pascal", "pasteur", "payne", "perlman", "pike", "planck", "poincare",
+	"raman", "ramanujan", "ritchie", "saha", "shannon",
+	"shockley", "sinoussi", "stonebraker", "swanson", "tesla", "thompson",
+	"torvalds", "turing", "varahamihira", "visvesvaraya", "volhard",
+	"wiles", "williams", "wozniak", "wright", "yalow", "yonath",
+}
+
+// generateName returns a random adjective_surname name that is not taken.
+// A digit is appended once too many tries have collided.
+func generateName(taken map[string]bool) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s_%s", adjectives[rand.Intn(len(adjectives))], surnames[rand.Intn(len(surnames))])
+		if i >= 10 {
+			name += fmt.Sprint(rand.Intn(10 * i))
+		}
+		if !taken[name] {
+			return name
+		}
+	}
+}
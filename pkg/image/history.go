@@ -0,0 +1,51 @@
+package image
+
+import (
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+)
+
+// HistoryEntry records how one step of an image was created. Entries
+// with EmptyLayer set changed only the config and have no layer.
+type HistoryEntry struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// LayerHistory builds history entries for layers from their metadata
+func LayerHistory(layerIDs []string) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	for _, layerID := range layerIDs {
+		l, err := layer.GetLayer(layerID)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, HistoryEntry{
+			Created:   l.Created,
+			CreatedBy: l.CreatedBy,
+			Comment:   l.Comment,
+		})
+	}
+	return history, nil
+}
+
+// GetHistory returns an image's history oldest first, with exactly one
+// non-empty entry per layer. Images created before history was recorded
+// get entries synthesized from their layers' metadata.
+func GetHistory(manifest *ImageManifest) ([]HistoryEntry, error) {
+	layers := 0
+	for _, h := range manifest.History {
+		if !h.EmptyLayer {
+			layers++
+		}
+	}
+	if len(manifest.History) > 0 && layers == len(manifest.Layers) {
+		return manifest.History, nil
+	}
+
+	return LayerHistory(manifest.Layers)
+}
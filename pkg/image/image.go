@@ -4,37 +4,62 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
-const imageBasePath = "/var/lib/minidocker/images"
+func imageBasePath() string { return store.Path("images") }
+
+// imageDBPath holds image manifests, named by image ID, and repositories.json
+func imageDBPath() string { return store.Path("imagedb") }
+
+// ImageSummary is one row of the image list
+type ImageSummary struct {
+	ID         string // Empty for monolithic images
+	Repository string
+	Tag        string
+	Created    time.Time
+	Size       int64
+	Layered    bool
+}
+
+// monolithicPath returns the rootfs of a monolithic image. Those live in
+// images/<name>/rootfs and can only be referred to by name or name:latest.
+func monolithicPath(imageName string) (string, bool) {
+	ref, err := reference.Parse(imageName)
+	if err != nil || ref.Digest != "" || ref.Tag != reference.DefaultTag {
+		return "", false
+	}
+
+	rootfsPath := filepath.Join(imageBasePath(), ref.FamiliarName(), "rootfs")
+	if info, err := os.Stat(rootfsPath); err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	return rootfsPath, true
+}
 
 // ImageExists checks if an image exists locally
 func ImageExists(imageName string) bool {
-	imagePath := filepath.Join(imageBasePath, imageName)
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		return false
+	if IsLayeredImage(imageName) {
+		return true
 	}
-	return true
+	_, ok := monolithicPath(imageName)
+	return ok
 }
 
-// GetImageRootfs returns the path to image's rootfs
-// Works with both layered and non-layered images
+// GetImageRootfs returns the path to a monolithic image's rootfs
 func GetImageRootfs(imageName string) (string, error) {
-	if !ImageExists(imageName) {
-		return "", fmt.Errorf("image %s not found", imageName)
-	}
-
-	// Check if this is a layered image
-	if ImageHasManifest(imageName) {
-		// For layered images, we'll handle this differently in the container run
-		// For now, return empty to indicate layered image
+	if IsLayeredImage(imageName) {
 		return "", fmt.Errorf("layered image - use GetImageManifest instead")
 	}
 
-	// Non-layered image: return direct rootfs path
-	rootfsPath := filepath.Join(imageBasePath, imageName, "rootfs")
-	if _, err := os.Stat(rootfsPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("image rootfs not found for %s", imageName)
+	rootfsPath, ok := monolithicPath(imageName)
+	if !ok {
+		return "", fmt.Errorf("image %s not found", imageName)
 	}
 
 	return rootfsPath, nil
@@ -42,40 +67,78 @@ func GetImageRootfs(imageName string) (string, error) {
 
 // IsLayeredImage checks if an image uses layers
 func IsLayeredImage(imageName string) bool {
-	return ImageHasManifest(imageName)
+	_, err := ResolveID(imageName)
+	return err == nil
 }
 
-// ListImages returns all the available images
-func ListImages() ([]string, error) {
-	var images []string
+// ListImages returns one entry per tag, plus untagged and monolithic images
+func ListImages() ([]ImageSummary, error) {
+	var images []ImageSummary
 
-	if _, err := os.Stat(imageBasePath); os.IsNotExist(err) {
-		return images, nil
+	repos, err := loadRepositories()
+	if err != nil {
+		return nil, err
 	}
 
-	entries, err := os.ReadDir(imageBasePath)
+	ids, err := listImageIDs()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, entry := range entries {
-		if !entry.IsDir() {
+	for _, id := range ids {
+		manifest, err := GetImageByID(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping image %s: %v\n", ShortID(id), err)
 			continue
 		}
 
-		imageName := entry.Name()
-		if !ImageExists(imageName) {
-			continue
+		summary := ImageSummary{
+			ID:      id,
+			Created: manifest.Created,
+			Size:    manifest.Size,
+			Layered: true,
 		}
 
-		// Add layer indicator
-		if IsLayeredImage(imageName) {
-			imageName += " (layered)"
+		tagged := false
+		for _, ref := range repos.referencesTo(id) {
+			if ref.Digest != "" {
+				continue
+			}
+			tagged = true
+			summary.Repository, summary.Tag = ref.FamiliarName(), ref.Tag
+			images = append(images, summary)
 		}
 
-		images = append(images, imageName)
+		if !tagged {
+			summary.Repository, summary.Tag = "<none>", "<none>"
+			images = append(images, summary)
+		}
 	}
 
+	entries, err := os.ReadDir(imageBasePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, ok := monolithicPath(entry.Name()); !ok {
+			continue
+		}
+
+		info, _ := entry.Info()
+		images = append(images, ImageSummary{
+			Repository: entry.Name(),
+			Tag:        reference.DefaultTag,
+			Created:    info.ModTime(),
+		})
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+
 	return images, nil
 }
 
@@ -1,22 +1,37 @@
 package image
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
 // ImageManifest represents an image with its layers
 type ImageManifest struct {
-	Name        string            `json:"name"`
-	Tag         string            `json:"tag"`
+	ID          string            `json:"id"`           // Digest of the image config, without the sha256: prefix
 	Layers      []string          `json:"layers"`       // Layer IDs in order (bottom to top)
 	Created     time.Time         `json:"created"`
 	Author      string            `json:"author"`
+	Comment     string            `json:"comment,omitempty"` // Commit message
 	Config      ImageConfig       `json:"config"`
 	Size        int64             `json:"size"`         // Total size of all layers
+	History     []HistoryEntry    `json:"history,omitempty"` // Oldest first, including config-only steps
+	SchemaVersion int             `json:"schema_version"`
+}
+
+// manifestSchema versions image manifests. The version is not part of the
+// image ID.
+var manifestSchema = &store.Schema{
+	Kind:       "image",
+	Migrations: []store.Migration{nil}, // 1: schema_version added
 }
 
 // ImageConfig contains runtime configuration
@@ -29,26 +44,81 @@ type ImageConfig struct {
 	ExposedPorts []string         `json:"exposed_ports"`
 }
 
-// CreateImageFromLayers creates a new image from layer IDs
-func CreateImageFromLayers(name, tag string, layerIDs []string, config ImageConfig) (*ImageManifest, error) {
-	manifest := &ImageManifest{
-		Name:    name,
-		Tag:     tag,
-		Layers:  layerIDs,
-		Created: time.Now(),
-		Config:  config,
+// configBlob is the canonical form of an image hashed to produce its ID
+type configBlob struct {
+	Created time.Time   `json:"created"`
+	Author  string      `json:"author,omitempty"`
+	Comment string      `json:"comment,omitempty"`
+	Config  ImageConfig `json:"config"`
+	History []HistoryEntry `json:"history,omitempty"`
+	RootFS  struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// computeImageID returns the digest of the image's config
+func computeImageID(manifest *ImageManifest) (string, error) {
+	blob := configBlob{
+		Created: manifest.Created.UTC(),
+		Author:  manifest.Author,
+		Comment: manifest.Comment,
+		Config:  manifest.Config,
+		History: manifest.History,
+	}
+	blob.RootFS.Type = "layers"
+	for _, layerID := range manifest.Layers {
+		blob.RootFS.DiffIDs = append(blob.RootFS.DiffIDs, "sha256:"+layerID)
+	}
+
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CreateImage stores a new image from its layers and config, filling in the
+// ID and size. Identical content and creation time give the same image ID.
+// Without explicit history, one entry per layer is taken from layer metadata.
+func CreateImage(manifest *ImageManifest) (*ImageManifest, error) {
+	if manifest.Created.IsZero() {
+		manifest.Created = time.Now()
+	}
+
+	if manifest.History == nil {
+		history, err := LayerHistory(manifest.Layers)
+		if err != nil {
+			return nil, err
+		}
+		manifest.History = history
 	}
 
-	// Calculate total size
-	// TODO: Sum up layer sizes from layer metadata
+	// Checking the layers and saving the manifest under the lock RemoveImage
+	// holds keeps a concurrent rmi from deleting a layer this image needs
+	lock, err := store.Acquire("repositories")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	manifest.Size = 0
+	for _, layerID := range manifest.Layers {
+		l, err := layer.GetLayer(layerID)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s not found: %v", layerID, err)
+		}
+		manifest.Size += l.Size
+	}
 
-	// Create image directory
-	imagePath := filepath.Join(imageBasePath, name)
-	if err := os.MkdirAll(imagePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create image directory: %v", err)
+	id, err := computeImageID(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute image ID: %v", err)
 	}
+	manifest.ID = id
 
-	// Save manifest
 	if err := saveManifest(manifest); err != nil {
 		return nil, fmt.Errorf("failed to save manifest: %v", err)
 	}
@@ -56,38 +126,159 @@ func CreateImageFromLayers(name, tag string, layerIDs []string, config ImageConf
 	return manifest, nil
 }
 
-// GetImageManifest retrieves image manifest
-func GetImageManifest(imageName string) (*ImageManifest, error) {
-	manifestPath := filepath.Join(imageBasePath, imageName, "manifest.json")
-	
-	data, err := os.ReadFile(manifestPath)
+// CreateImageFromLayers creates a new image from layer IDs and tags it with a reference
+func CreateImageFromLayers(refStr string, layerIDs []string, config ImageConfig) (*ImageManifest, error) {
+	ref, err := parseTagReference(refStr)
 	if err != nil {
-		return nil, fmt.Errorf("image manifest not found: %s", imageName)
+		return nil, err
 	}
 
-	var manifest ImageManifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
+	manifest, err := CreateImage(&ImageManifest{Layers: layerIDs, Config: config})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SetReference(ref, manifest.ID); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// GetImageManifest retrieves the manifest of an image by reference or ID
+func GetImageManifest(refOrID string) (*ImageManifest, error) {
+	id, err := ResolveID(refOrID)
+	if err != nil {
 		return nil, err
 	}
+	return GetImageByID(id)
+}
+
+// GetImageByID retrieves an image manifest by its full ID
+func GetImageByID(id string) (*ImageManifest, error) {
+	id = strings.TrimPrefix(id, "sha256:")
+
+	var manifest ImageManifest
+	if err := store.ReadJSON(manifestPath(id), &manifest, manifestSchema); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such image: sha256:%s", id)
+		}
+		return nil, fmt.Errorf("invalid manifest for image %s: %v", ShortID(id), err)
+	}
 
 	return &manifest, nil
 }
 
 // saveManifest persists image manifest
 func saveManifest(manifest *ImageManifest) error {
-	manifestPath := filepath.Join(imageBasePath, manifest.Name, "manifest.json")
-	
-	data, err := json.MarshalIndent(manifest, "", "  ")
-	if err != nil {
+	manifest.SchemaVersion = manifestSchema.Version()
+	return store.WriteJSON(manifestPath(manifest.ID), manifest)
+}
+
+// removeManifest deletes an image manifest from the image store
+func removeManifest(id string) error {
+	if err := os.Remove(manifestPath(id)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	return nil
+}
+
+func manifestPath(id string) string {
+	return filepath.Join(imageDBPath(), id+".json")
+}
+
+// listImageIDs returns the IDs of every image in the image store
+func listImageIDs() ([]string, error) {
+	entries, err := os.ReadDir(imageDBPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return os.WriteFile(manifestPath, data, 0644)
+	var ids []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" || name == repositoriesFile {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+
+	return ids, nil
+}
+
+// ShortID returns the 12 character form of an image ID
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
 }
 
-// ImageHasManifest checks if an image has a manifest (layered image)
-func ImageHasManifest(imageName string) bool {
-	manifestPath := filepath.Join(imageBasePath, imageName, "manifest.json")
-	_, err := os.Stat(manifestPath)
-	return err == nil
+// RemoveImage deletes an image that no reference points to any more, along
+// with the layers no other image uses. It returns the deleted layer IDs.
+func RemoveImage(id string) ([]string, error) {
+	id = strings.TrimPrefix(id, "sha256:")
+
+	// Images created meanwhile must be counted before their layers go
+	migrateOnce.Do(migrateLegacyImages)
+	lock, err := store.Acquire("repositories")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	manifest, err := GetImageByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := References(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) > 0 {
+		return nil, fmt.Errorf("image %s is still referenced by %s", ShortID(id), strings.Join(refs, ", "))
+	}
+
+	if err := removeManifest(id); err != nil {
+		return nil, fmt.Errorf("failed to remove image %s: %v", ShortID(id), err)
+	}
+
+	// Count the layers every remaining image still uses
+	inUse := make(map[string]bool)
+	ids, err := listImageIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, otherID := range ids {
+		other, err := GetImageByID(otherID)
+		if err != nil {
+			// Keep layers rather than risk deleting ones an unreadable image needs
+			return nil, fmt.Errorf("image %s removed, but layers were kept: %v", ShortID(id), err)
+		}
+		for _, layerID := range other.Layers {
+			inUse[layerID] = true
+		}
+	}
+
+	var deleted []string
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		layerID := manifest.Layers[i]
+		if inUse[layerID] {
+			continue
+		}
+		// An image may list the same layer twice
+		inUse[layerID] = true
+
+		if err := layer.RemoveLayer(layerID); err != nil {
+			return deleted, fmt.Errorf("failed to remove layer %s: %v", layerID[:12], err)
+		}
+		deleted = append(deleted, layerID)
+	}
+
+	return deleted, nil
 }
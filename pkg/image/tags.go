@@ -0,0 +1,338 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+const repositoriesFile = "repositories.json"
+
+var (
+	imageIDRegexp = regexp.MustCompile(`^(sha256:)?[a-f0-9]{1,64}$`)
+	migrateOnce   sync.Once
+)
+
+// repositories maps repository names to their references and image IDs,
+// in the same layout as Docker's repositories.json
+type repositories struct {
+	Repositories map[string]map[string]string `json:"Repositories"`
+}
+
+func loadRepositories() (*repositories, error) {
+	migrateOnce.Do(migrateLegacyImages)
+
+	repos := &repositories{Repositories: make(map[string]map[string]string)}
+
+	err := store.ReadJSON(filepath.Join(imageDBPath(), repositoriesFile), repos, nil)
+	if os.IsNotExist(err) {
+		return repos, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repos.Repositories == nil {
+		repos.Repositories = make(map[string]map[string]string)
+	}
+
+	return repos, nil
+}
+
+func (r *repositories) save() error {
+	return store.WriteJSON(filepath.Join(imageDBPath(), repositoriesFile), r)
+}
+
+// lookup returns the image ID a reference points to
+func (r *repositories) lookup(ref *reference.Reference) (string, bool) {
+	id, ok := r.Repositories[ref.Name()][referenceKey(ref)]
+	return id, ok
+}
+
+// referencesTo returns every reference pointing at an image ID, sorted
+func (r *repositories) referencesTo(id string) []*reference.Reference {
+	var refs []*reference.Reference
+	for _, entries := range r.Repositories {
+		for key, target := range entries {
+			if target != id {
+				continue
+			}
+			if ref, err := reference.Parse(key); err == nil {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+
+	return refs
+}
+
+// referenceKey is the fully qualified name:tag or name@digest a reference is stored under
+func referenceKey(ref *reference.Reference) string {
+	if ref.Digest != "" {
+		return ref.Name() + "@" + ref.Digest
+	}
+	return ref.Name() + ":" + ref.Tag
+}
+
+// parseTagReference parses a reference that names a tag rather than a digest
+func parseTagReference(refStr string) (*reference.Reference, error) {
+	ref, err := reference.Parse(refStr)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest != "" {
+		return nil, fmt.Errorf("refusing to create a tag with a digest reference: %s", refStr)
+	}
+	return ref, nil
+}
+
+// SetReference points a tag or digest reference at an image ID, moving it if it already exists
+func SetReference(ref *reference.Reference, id string) error {
+	id = strings.TrimPrefix(id, "sha256:")
+	if _, err := GetImageByID(id); err != nil {
+		return err
+	}
+
+	// Legacy images are migrated under the same lock
+	migrateOnce.Do(migrateLegacyImages)
+	lock, err := store.Acquire("repositories")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	repos, err := loadRepositories()
+	if err != nil {
+		return err
+	}
+
+	entries, ok := repos.Repositories[ref.Name()]
+	if !ok {
+		entries = make(map[string]string)
+		repos.Repositories[ref.Name()] = entries
+	}
+	entries[referenceKey(ref)] = id
+
+	return repos.save()
+}
+
+// TagImage creates a tag target that refers to the image source
+func TagImage(source, target string) error {
+	id, err := ResolveID(source)
+	if err != nil {
+		return err
+	}
+
+	ref, err := parseTagReference(target)
+	if err != nil {
+		return err
+	}
+
+	return SetReference(ref, id)
+}
+
+// Untag removes a reference and returns the ID of the image it pointed to
+func Untag(refStr string) (string, error) {
+	ref, err := reference.Parse(refStr)
+	if err != nil {
+		return "", err
+	}
+
+	migrateOnce.Do(migrateLegacyImages)
+	lock, err := store.Acquire("repositories")
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	repos, err := loadRepositories()
+	if err != nil {
+		return "", err
+	}
+
+	id, ok := repos.lookup(ref)
+	if !ok {
+		return "", fmt.Errorf("no such image: %s", ref.FamiliarString())
+	}
+
+	delete(repos.Repositories[ref.Name()], referenceKey(ref))
+	if len(repos.Repositories[ref.Name()]) == 0 {
+		delete(repos.Repositories, ref.Name())
+	}
+
+	return id, repos.save()
+}
+
+// References returns the familiar form of every tag and digest pointing at an image
+func References(id string) ([]string, error) {
+	repos, err := loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, ref := range repos.referencesTo(strings.TrimPrefix(id, "sha256:")) {
+		names = append(names, ref.FamiliarString())
+	}
+
+	return names, nil
+}
+
+// ResolveID returns the full image ID for a reference, a full ID or a unique ID prefix
+func ResolveID(refOrID string) (string, error) {
+	if !strings.HasPrefix(refOrID, "sha256:") {
+		if ref, err := reference.Parse(refOrID); err == nil {
+			repos, err := loadRepositories()
+			if err != nil {
+				return "", err
+			}
+			if id, ok := repos.lookup(ref); ok {
+				return id, nil
+			}
+		}
+	}
+
+	if !imageIDRegexp.MatchString(refOrID) {
+		return "", fmt.Errorf("no such image: %s", refOrID)
+	}
+
+	prefix := strings.TrimPrefix(refOrID, "sha256:")
+	ids, err := listImageIDs()
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, prefix) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no such image: %s", refOrID)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous image ID prefix %s matches %d images", refOrID, len(matches))
+	}
+}
+
+// legacyManifest is the per-name manifest written before images were content addressed
+type legacyManifest struct {
+	Name    string      `json:"name"`
+	Tag     string      `json:"tag"`
+	Layers  []string    `json:"layers"`
+	Created time.Time   `json:"created"`
+	Author  string      `json:"author"`
+	Config  ImageConfig `json:"config"`
+}
+
+// migrateLegacyImages moves images/<name>/manifest.json files into the image store
+func migrateLegacyImages() {
+	var found []string
+	filepath.Walk(imageBasePath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Monolithic images keep their rootfs where it is
+		if info.IsDir() && info.Name() == "rootfs" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == "manifest.json" {
+			found = append(found, path)
+		}
+		return nil
+	})
+
+	for _, path := range found {
+		if err := migrateLegacyImage(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to migrate image %s: %v\n", filepath.Dir(path), err)
+		}
+	}
+}
+
+func migrateLegacyImage(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var legacy legacyManifest
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	name := legacy.Name
+	if name == "" {
+		name, _ = filepath.Rel(imageBasePath(), filepath.Dir(path))
+	}
+
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return err
+	}
+	// Old commits stored "latest" in Tag; a tag in the name itself wins
+	if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") && !strings.Contains(name, "@") {
+		if strings.HasPrefix(legacy.Tag, "sha256:") {
+			ref.Tag, ref.Digest = "", legacy.Tag
+		} else if legacy.Tag != "" {
+			ref.Tag = legacy.Tag
+		}
+	}
+
+	manifest, err := CreateImage(&ImageManifest{
+		Layers:  legacy.Layers,
+		Created: legacy.Created,
+		Author:  legacy.Author,
+		Config:  legacy.Config,
+	})
+	if err != nil {
+		return err
+	}
+
+	lock, err := store.Acquire("repositories")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	repos := &repositories{Repositories: make(map[string]map[string]string)}
+	err = store.ReadJSON(filepath.Join(imageDBPath(), repositoriesFile), repos, nil)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if repos.Repositories[ref.Name()] == nil {
+		repos.Repositories[ref.Name()] = make(map[string]string)
+	}
+	repos.Repositories[ref.Name()][referenceKey(ref)] = manifest.ID
+	if err := repos.save(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Remove the now empty image directories, e.g. images/localhost:5000/app
+	for dir := filepath.Dir(path); dir != imageBasePath() && strings.HasPrefix(dir, imageBasePath()); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,635 @@
+package layer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ImportLayer creates a new layer from a (possibly compressed) tar stream.
+// OCI whiteout entries are converted to overlayfs whiteouts so the layer
+// can be used directly as an overlay lowerdir. A non-empty diffID is the
+// sha256 digest the uncompressed stream must have.
+func ImportLayer(r io.Reader, diffID, createdBy, comment string) (*Layer, error) {
+	if err := os.MkdirAll(layerBasePath(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layer directory: %v", err)
+	}
+
+	tmpPath, err := os.MkdirTemp(layerBasePath(), ".import-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	stream, err := DecompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	hash := sha256.New()
+	if err := extractTar(io.TeeReader(stream, hash), tmpPath, false); err != nil {
+		return nil, fmt.Errorf("failed to extract layer: %v", err)
+	}
+	if diffID != "" {
+		// The padding after the end-of-archive marker is part of the digest
+		if _, err := io.Copy(hash, stream); err != nil {
+			return nil, fmt.Errorf("failed to read layer: %v", err)
+		}
+		if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != diffID {
+			return nil, fmt.Errorf("layer diff ID mismatch: expected %s, got %s", diffID, got)
+		}
+	}
+
+	if Compression != "" {
+		blobPath, layer, err := compressLayer(tmpPath, createdBy, comment)
+		if blobPath != "" {
+			defer os.RemoveAll(blobPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return commitStagedLayer(blobPath, layer)
+	}
+
+	layerID, size, err := calculateDirHash(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate layer hash: %v", err)
+	}
+
+	return commitStagedLayer(tmpPath, &Layer{
+		ID:        layerID,
+		Size:      size,
+		Created:   time.Now(),
+		CreatedBy: createdBy,
+		Comment:   comment,
+	})
+}
+
+// ExportLayer writes the contents of a layer to w as an uncompressed tar
+// stream, with overlayfs whiteouts converted to OCI whiteout entries
+func ExportLayer(layerID string, w io.Writer) error {
+	l, err := GetLayer(layerID)
+	if err != nil {
+		return err
+	}
+
+	// A compressed layer's blob already is the normalized stream
+	if l.Compression != "" {
+		stream, err := openBlob(l)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		_, err = io.Copy(w, stream)
+		return err
+	}
+
+	_, err = writeTar(l.Path, w)
+	return err
+}
+
+// writeTar archives a directory tree in lexical order, leaving out layer
+// metadata and overlayfs internals. Access times are dropped and mtimes
+// truncated to seconds, so the same tree always gives the same bytes. It
+// returns the number of file content bytes written.
+func writeTar(root string, w io.Writer) (int64, error) {
+	tw := tar.NewWriter(w)
+	hardlinks := make(map[uint64]string)
+	var size int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := writeHeader(tw, path, relPath, info, hardlinks)
+		if err != nil || hdr == nil || hdr.Typeflag != tar.TypeReg || IsWhiteout(info) {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, file)
+		file.Close()
+		size += n
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, tw.Close()
+}
+
+// writeHeader writes the tar header for one file of a tree: a .wh. entry
+// for a whiteout, and an extra opaque marker after an opaque directory.
+// It returns nil for the entries layers leave out. The caller writes the
+// contents of regular files.
+func writeHeader(tw *tar.Writer, path, relPath string, info os.FileInfo, hardlinks map[uint64]string) (*tar.Header, error) {
+	if relPath == "." || relPath == "metadata.json" || info.Mode()&os.ModeSocket != 0 {
+		return nil, nil
+	}
+
+	if IsWhiteout(info) {
+		hdr := whiteoutHeader(filepath.ToSlash(relPath))
+		return hdr, tw.WriteHeader(hdr)
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = filepath.ToSlash(relPath)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		if first, seen := hardlinks[stat.Ino]; seen {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			hardlinks[stat.Ino] = hdr.Name
+		}
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		for name, value := range readXattrs(path) {
+			if strings.HasPrefix(name, overlayXattrPrefix) {
+				continue
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattrPrefix+name] = value
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() && IsOpaque(path) {
+		if err := tw.WriteHeader(opaqueHeader(hdr.Name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return hdr, nil
+}
+
+// readXattrs returns the extended attributes of a file, ignoring errors
+func readXattrs(path string) map[string]string {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		valueSize, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize > 0 {
+			if valueSize, err = syscall.Getxattr(path, name, value); err != nil {
+				continue
+			}
+		}
+		attrs[name] = string(value[:valueSize])
+	}
+
+	return attrs
+}
+
+// ApplyLayer unpacks a layer onto a flattened root filesystem, as used by
+// snapshotters that do not stack layers with overlayfs
+func ApplyLayer(layerID, root string) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(ExportLayer(layerID, pw))
+	}()
+
+	if err := extractTar(pr, root, true); err != nil {
+		return fmt.Errorf("failed to apply layer %s: %v", layerID[:12], err)
+	}
+	return nil
+}
+
+// CreateLayerFromChanges creates a layer from a root filesystem holding
+// the changed paths, with their parent directories, and whiteouts for the
+// deleted ones. Paths are relative to root.
+func CreateLayerFromChanges(root string, changed, deleted []string, createdBy, comment string) (*Layer, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(writeChanges(root, changed, deleted, pw))
+	}()
+
+	return ImportLayer(pr, "", createdBy, comment)
+}
+
+// writeChanges archives the given paths of root and whiteouts for the deleted ones
+func writeChanges(root string, changed, deleted []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	hardlinks := make(map[uint64]string)
+	written := make(map[string]bool)
+
+	isDeleted := make(map[string]bool)
+	paths := append([]string(nil), changed...)
+	for _, p := range deleted {
+		isDeleted[p] = true
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// add writes the header and contents of one path of root
+	add := func(relPath string) error {
+		if written[relPath] {
+			return nil
+		}
+		written[relPath] = true
+
+		path := filepath.Join(root, relPath)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		hdr, err := writeHeader(tw, path, relPath, info, hardlinks)
+		if err != nil || hdr == nil || hdr.Typeflag != tar.TypeReg {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, file)
+		file.Close()
+		return err
+	}
+
+	for _, relPath := range paths {
+		relPath = filepath.Clean(relPath)
+
+		// Parent directories keep their attributes, as an overlayfs copy-up would
+		var parents []string
+		for dir := filepath.Dir(relPath); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := add(dir); err != nil {
+				return err
+			}
+		}
+
+		if isDeleted[relPath] {
+			if err := tw.WriteHeader(whiteoutHeader(filepath.ToSlash(relPath))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := add(relPath); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// commitStagedLayer moves a staged directory into layer storage under its content hash
+func commitStagedLayer(stagingPath string, layer *Layer) (*Layer, error) {
+	// Another process may be storing the same content
+	lock, err := store.Acquire("layer-" + layer.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	// Identical content is already stored, reuse it
+	if existing, err := GetLayer(layer.ID); err == nil {
+		return &existing.Layer, nil
+	}
+
+	layerPath := filepath.Join(layerBasePath(), layer.ID)
+	os.RemoveAll(layerPath)
+	if err := os.Rename(stagingPath, layerPath); err != nil {
+		return nil, fmt.Errorf("failed to move layer into place: %v", err)
+	}
+	os.Chmod(layerPath, 0755)
+
+	if err := saveLayerMetadata(layer); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %v", err)
+	}
+
+	return layer, nil
+}
+
+// DecompressStream detects gzip or zstd compression and returns a reader
+// for the uncompressed tar stream
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+	magic, _ := buf.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %v", err)
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return zstdReader(buf)
+	default:
+		return io.NopCloser(buf), nil
+	}
+}
+
+// zstdReader decompresses through the zstd binary, as the standard library has no zstd support
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("zstd", "-d", "-c")
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd (is it installed?): %v", err)
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd failed: %v", err)
+	}
+	return nil
+}
+
+// extractTar unpacks a tar stream into dest, converting OCI whiteouts to
+// overlayfs whiteouts, or with flatten, deleting the paths they hide
+func extractTar(r io.Reader, dest string, flatten bool) error {
+	tr := tar.NewReader(r)
+
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := securePath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			continue
+		}
+
+		parent := filepath.Dir(target)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+
+		whiteout := applyWhiteout
+		if flatten {
+			whiteout = removeWhiteout
+		}
+		if handled, err := whiteout(target); handled || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Replace anything already at the path, except directories being re-declared
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{path: target, mtime: hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := securePath(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devMode := uint32(syscall.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				devMode = syscall.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				devMode = syscall.S_IFBLK
+			}
+			dev := int(mkdev(hdr.Devmajor, hdr.Devminor))
+			if err := syscall.Mknod(target, devMode|uint32(mode), dev); err != nil {
+				return err
+			}
+		default:
+			// Skip unsupported entry types (e.g. GNU sparse metadata)
+			continue
+		}
+
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+
+		// chmod after chown so setuid/setgid bits survive
+		if err := os.Chmod(target, mode|specialModeBits(hdr.Mode)); err != nil {
+			return err
+		}
+
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				syscall.Setxattr(target, strings.TrimPrefix(key, paxXattrPrefix), []byte(value), 0)
+			}
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+	}
+
+	// Directory mtimes are set last since extracting children modifies them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+
+	return nil
+}
+
+// securePath joins name onto root. Symlinks already extracted into its
+// parent directories are followed as if root were /, so nothing is written
+// outside root. The last component is not resolved.
+func securePath(root, name string) (string, error) {
+	cleaned := filepath.Join("/", name)
+	if cleaned == "/" {
+		return root, nil
+	}
+
+	parent, err := ResolveInRoot(root, filepath.Dir(cleaned))
+	if err != nil {
+		return "", fmt.Errorf("invalid path in archive: %s: %v", name, err)
+	}
+	return filepath.Join(root, parent, filepath.Base(cleaned)), nil
+}
+
+// ResolveInRoot resolves the symlinks in p, a path as seen from inside
+// root, one component at a time as if root were /. Absolute link targets
+// start over at root and .. stops at root, as the kernel does at /, so
+// the result never leaves root.
+func ResolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if hops++; hops > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return resolved, nil
+}
+
+// specialModeBits converts tar setuid/setgid/sticky bits to os.FileMode
+func specialModeBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// mkdev encodes a device number the way the Linux kernel expects
+func mkdev(major, minor int64) uint64 {
+	return uint64((major&0xfff)<<8 | (minor & 0xff) | (minor&0xfff00)<<12 | (major&^0xfff)<<32)
+}
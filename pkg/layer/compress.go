@@ -0,0 +1,135 @@
+package layer
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Compression is how new layers are stored: "" keeps them as extracted
+// directories, "gzip" or "zstd" as compressed tar blobs that are only
+// extracted, into the snapshot cache, when a container needs them
+var Compression = ""
+
+// SetCompression validates and sets the storage format for new layers
+func SetCompression(compression string) error {
+	switch compression {
+	case "", "none":
+		Compression = ""
+	case "gzip", "zstd":
+		Compression = compression
+	default:
+		return fmt.Errorf("unsupported layer compression %q (use none, gzip or zstd)", compression)
+	}
+	return nil
+}
+
+// blobName is the file a compressed layer's tarball is stored in
+func blobName(compression string) string {
+	if compression == "zstd" {
+		return "layer.tar.zst"
+	}
+	return "layer.tar.gz"
+}
+
+// compressLayer archives a directory into a new staging directory that
+// holds only the compressed blob. The caller removes the staging directory.
+func compressLayer(sourcePath, createdBy, comment string) (string, *Layer, error) {
+	tmpPath, err := os.MkdirTemp(layerBasePath(), ".compress-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	file, err := os.Create(filepath.Join(tmpPath, blobName(Compression)))
+	if err != nil {
+		return tmpPath, nil, err
+	}
+	defer file.Close()
+
+	compressor, err := newCompressor(file, Compression)
+	if err != nil {
+		return tmpPath, nil, err
+	}
+
+	hash := sha256.New()
+	size, err := writeTar(sourcePath, io.MultiWriter(hash, compressor))
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return tmpPath, nil, fmt.Errorf("failed to compress layer: %v", err)
+	}
+
+	return tmpPath, &Layer{
+		ID:          hex.EncodeToString(hash.Sum(nil)),
+		Size:        size,
+		Created:     time.Now(),
+		CreatedBy:   createdBy,
+		Comment:     comment,
+		Compression: Compression,
+	}, nil
+}
+
+// newCompressor returns a writer compressing into w
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	if compression != "zstd" {
+		return gzip.NewWriter(w), nil
+	}
+
+	// Like decompression, zstd goes through the binary
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd (is it installed?): %v", err)
+	}
+	return &cmdWriter{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriter) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd failed: %v", err)
+	}
+	return nil
+}
+
+// openBlob returns the uncompressed tar stream of a compressed layer
+func openBlob(l *LayerMetadata) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(l.Path, blobName(l.Compression)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer blob: %v", err)
+	}
+
+	stream, err := DecompressStream(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &blobReader{ReadCloser: stream, file: file}, nil
+}
+
+type blobReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *blobReader) Close() error {
+	err := b.ReadCloser.Close()
+	b.file.Close()
+	return err
+}
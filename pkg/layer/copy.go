@@ -0,0 +1,198 @@
+package layer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// ficlone is the FICLONE ioctl, which shares the extents of a file on
+	// filesystems with reflink support (btrfs, xfs)
+	ficlone = 0x40049409
+
+	// lseek whences for finding the data in sparse files
+	seekData = 3
+	seekHole = 4
+
+	// progressStep is how many bytes copyTree copies between progress lines
+	progressStep = 100 << 20
+)
+
+// copyTree copies a directory into dst, keeping ownership, modes, mtimes,
+// hardlinks, holes in sparse files, xattrs and device nodes. In the same
+// walk it writes the tar stream writeTar would produce for the tree to
+// digest, and it returns the size of the file contents.
+func copyTree(src, dst string, digest io.Writer) (int64, error) {
+	tw := tar.NewWriter(digest)
+	hardlinks := make(map[uint64]string)
+	var size, reported int64
+
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := writeHeader(tw, path, relPath, info, hardlinks)
+		if err != nil || hdr == nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot stat %s", relPath)
+		}
+
+		switch {
+		case hdr.Typeflag == tar.TypeLink:
+			// The first link already carries the metadata
+			return os.Link(filepath.Join(dst, filepath.FromSlash(hdr.Linkname)), target)
+		case info.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{path: target, mtime: info.ModTime()})
+		case info.Mode().IsRegular():
+			n, err := copyFile(path, target, info.Size(), tw)
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %v", relPath, err)
+			}
+			size += n
+			if size-reported >= progressStep {
+				fmt.Printf("Copying layer contents: %.2f MB\n", float64(size)/(1024*1024))
+				reported = size
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, fifos and overlayfs whiteouts
+			if err := syscall.Mknod(target, stat.Mode, int(stat.Rdev)); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		// chmod after chown so setuid/setgid bits survive
+		if err := os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+
+		// Unlike the tar stream, the copy keeps overlayfs xattrs such as opaque markers
+		for name, value := range readXattrs(path) {
+			if err := syscall.Setxattr(target, name, []byte(value), 0); err != nil {
+				return fmt.Errorf("failed to set xattr %s on %s: %v", name, relPath, err)
+			}
+		}
+
+		if !info.IsDir() {
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Directory mtimes are set last since copying children modifies them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+
+	return size, tw.Close()
+}
+
+// copyFile copies a regular file and streams its contents to tw
+func copyFile(src, dst string, size int64, tw io.Writer) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	err = copyContents(out, in, size)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(tw, in)
+}
+
+// copyContents clones a file when the filesystem supports reflinks, and
+// otherwise copies only its data segments so holes stay holes. Copying
+// between two files makes the kernel use copy_file_range.
+func copyContents(out, in *os.File, size int64) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno == 0 {
+		return nil
+	}
+
+	for offset := int64(0); offset < size; {
+		start, err := in.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left
+			break
+		}
+		if err != nil {
+			// No SEEK_DATA support, copy everything
+			return copyRange(out, in, offset, size-offset)
+		}
+
+		end, err := in.Seek(start, seekHole)
+		if err != nil {
+			return err
+		}
+		if err := copyRange(out, in, start, end-start); err != nil {
+			return err
+		}
+		offset = end
+	}
+
+	return out.Truncate(size)
+}
+
+// copyRange copies length bytes at offset from in to the same offset in out
+func copyRange(out, in *os.File, offset, length int64) error {
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(out, in, length)
+	return err
+}
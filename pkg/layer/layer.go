@@ -3,21 +3,17 @@ package layer
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
-)
 
-const (
-	layerBasePath = "/var/lib/minidocker/layers"
-	overlayBasePath = "/var/lib/minidocker/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
+func layerBasePath() string { return store.Path("layers") }
+
 // Layer represents a filesystem layer
 type Layer struct {
 	ID         string    `json:"id"`          // SHA256 hash
@@ -26,6 +22,14 @@ type Layer struct {
 	Created    time.Time `json:"created"`
 	CreatedBy  string    `json:"created_by"`  // Command that created this layer
 	Comment    string    `json:"comment"`
+	Compression string    `json:"compression,omitempty"` // gzip or zstd when stored as a blob
+	SchemaVersion int     `json:"schema_version"`
+}
+
+// layerSchema versions layer metadata
+var layerSchema = &store.Schema{
+	Kind:       "layer",
+	Migrations: []store.Migration{nil}, // 1: schema_version added
 }
 
 // LayerMetadata stores information about a layer
@@ -36,62 +40,58 @@ type LayerMetadata struct {
 
 // CreateLayer creates a new layer from a directory
 func CreateLayer(sourcePath, createdBy, comment string) (*Layer, error) {
-	// Calculate SHA256 of directory contents
-	layerID, err := calculateDirHash(sourcePath)
+	if err := os.MkdirAll(layerBasePath(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layer directory: %v", err)
+	}
+
+	if Compression != "" {
+		tmpPath, layer, err := compressLayer(sourcePath, createdBy, comment)
+		if tmpPath != "" {
+			defer os.RemoveAll(tmpPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return commitStagedLayer(tmpPath, layer)
+	}
+
+	// Copy into a staging directory, hashing the contents on the way
+	tmpPath, err := os.MkdirTemp(layerBasePath(), ".create-")
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate layer hash: %v", err)
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
 	}
+	defer os.RemoveAll(tmpPath)
 
-	// Get directory size
-	size, err := getDirSize(sourcePath)
+	hash := sha256.New()
+	size, err := copyTree(sourcePath, tmpPath, hash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate size: %v", err)
+		return nil, fmt.Errorf("failed to copy layer contents: %v", err)
 	}
 
-	layer := &Layer{
-		ID:        layerID,
+	return commitStagedLayer(tmpPath, &Layer{
+		ID:        hex.EncodeToString(hash.Sum(nil)),
 		Size:      size,
 		Created:   time.Now(),
 		CreatedBy: createdBy,
 		Comment:   comment,
-	}
-
-	// Create layer directory
-	layerPath := filepath.Join(layerBasePath, layerID)
-	if err := os.MkdirAll(layerPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create layer directory: %v", err)
-	}
-
-	// Copy contents to layer storage
-	if err := copyDir(sourcePath, layerPath); err != nil {
-		return nil, fmt.Errorf("failed to copy layer contents: %v", err)
-	}
-
-	// Save layer metadata
-	if err := saveLayerMetadata(layer); err != nil {
-		return nil, fmt.Errorf("failed to save metadata: %v", err)
-	}
-
-	return layer, nil
+	})
 }
 
 // GetLayer retrieves layer metadata
 func GetLayer(layerID string) (*LayerMetadata, error) {
-	metadataPath := filepath.Join(layerBasePath, layerID, "metadata.json")
-	
-	data, err := os.ReadFile(metadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("layer not found: %s", layerID)
-	}
+	metadataPath := filepath.Join(layerBasePath(), layerID, "metadata.json")
 
 	var layer Layer
-	if err := json.Unmarshal(data, &layer); err != nil {
+	if err := store.ReadJSON(metadataPath, &layer, layerSchema); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("layer not found: %s", layerID)
+		}
 		return nil, err
 	}
 
 	return &LayerMetadata{
 		Layer: layer,
-		Path:  filepath.Join(layerBasePath, layerID),
+		Path:  filepath.Join(layerBasePath(), layerID),
 	}, nil
 }
 
@@ -133,12 +133,12 @@ func GetLayerOrPrefix(layerID string) (*LayerMetadata, error) {
 
 // ListLayers returns all layers
 func ListLayers() ([]*LayerMetadata, error) {
-	if _, err := os.Stat(layerBasePath); os.IsNotExist(err) {
+	if _, err := os.Stat(layerBasePath()); os.IsNotExist(err) {
 		return []*LayerMetadata{}, nil
 	}
 
 	var layers []*LayerMetadata
-	entries, err := os.ReadDir(layerBasePath)
+	entries, err := os.ReadDir(layerBasePath())
 	if err != nil {
 		return nil, err
 	}
@@ -148,8 +148,17 @@ func ListLayers() ([]*LayerMetadata, error) {
 			continue
 		}
 
+		// Staging directories and the build cache
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
 		layer, err := GetLayer(entry.Name())
 		if err != nil {
+			// Layers still being stored have no metadata yet
+			if _, statErr := os.Stat(filepath.Join(layerBasePath(), entry.Name(), "metadata.json")); statErr == nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping layer %s: %v\n", entry.Name(), err)
+			}
 			continue
 		}
 		layers = append(layers, layer)
@@ -158,109 +167,50 @@ func ListLayers() ([]*LayerMetadata, error) {
 	return layers, nil
 }
 
-// RemoveLayer deletes a layer
-func RemoveLayer(layerID string) error {
-	layerPath := filepath.Join(layerBasePath, layerID)
-	return os.RemoveAll(layerPath)
+// ChainID returns the chain ID of a stack of layers, bottom first. It
+// identifies the layers and their order, as in the OCI image spec.
+func ChainID(layerIDs []string) string {
+	chainID := ""
+	for i, layerID := range layerIDs {
+		if i == 0 {
+			chainID = layerID
+			continue
+		}
+		sum := sha256.Sum256([]byte("sha256:" + chainID + " sha256:" + layerID))
+		chainID = hex.EncodeToString(sum[:])
+	}
+	return chainID
 }
 
-// saveLayerMetadata persists layer metadata
-func saveLayerMetadata(layer *Layer) error {
-	metadataPath := filepath.Join(layerBasePath, layer.ID, "metadata.json")
-	
-	data, err := json.MarshalIndent(layer, "", "  ")
-	if err != nil {
+// RemoveLayer deletes a layer and its cached snapshot
+func RemoveLayer(layerID string) error {
+	if err := removeSnapshot(layerID); err != nil {
 		return err
 	}
 
-	return os.WriteFile(metadataPath, data, 0644)
+	layerPath := filepath.Join(layerBasePath(), layerID)
+	return os.RemoveAll(layerPath)
 }
 
-// calculateDirHash computes SHA256 hash of directory contents
-func calculateDirHash(dirPath string) (string, error) {
-	hash := sha256.New()
-	
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		
-		// Skip the root directory itself
-		if path == dirPath {
-			return nil
-		}
-		
-		// Get relative path
-		relPath, err := filepath.Rel(dirPath, path)
-		if err != nil {
-			return err
-		}
-		
-		// Hash the path
-		hash.Write([]byte(relPath))
-		
-		// Hash file contents if it's a regular file
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			
-			if _, err := io.Copy(hash, file); err != nil {
-				return err
-			}
-		}
-		
-		return nil
-	})
-	
-	if err != nil {
-		return "", err
-	}
-	
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
+// saveLayerMetadata persists layer metadata
+func saveLayerMetadata(layer *Layer) error {
+	metadataPath := filepath.Join(layerBasePath(), layer.ID, "metadata.json")
 
-// getDirSize calculates total size of directory
-func getDirSize(dirPath string) (int64, error) {
-	var size int64
-	
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	
-	return size, err
+	layer.SchemaVersion = layerSchema.Version()
+	return store.WriteJSON(metadataPath, layer)
 }
 
-// copyDir recursively copies a directory using system tar command
-func copyDir(src, dst string) error {
-	// Ensure destination exists
-	if err := os.MkdirAll(dst, 0755); err != nil {
-		return err
-	}
-	
-	// Use tar for reliable copying (handles symlinks, permissions, special files)
-	// tar -C source -cf - . | tar -C dest -xf -
-	cmd := exec.Command("sh", "-c", 
-		fmt.Sprintf("cd %s && tar -cf - . | tar -C %s -xf -", 
-			shellQuote(src), shellQuote(dst)))
+// calculateDirHash computes the SHA256 of the tar stream ExportLayer would
+// write for a directory, which makes it the layer's OCI diffID. Modes,
+// ownership, link targets, devices and xattrs are all part of the stream.
+// It also returns the size of the file contents.
+func calculateDirHash(dirPath string) (string, int64, error) {
+	hash := sha256.New()
 	
-	output, err := cmd.CombinedOutput()
+	size, err := writeTar(dirPath, hash)
 	if err != nil {
-		return fmt.Errorf("tar copy failed: %v, output: %s", err, string(output))
+		return "", 0, err
 	}
 	
-	return nil
-}
-
-// shellQuote quotes a string for use in shell commands
-func shellQuote(s string) string {
-	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
 }
@@ -0,0 +1,236 @@
+package layer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+func snapshotBasePath() string { return store.Path("snapshots") }
+
+// SnapshotCacheSize is how many bytes of extracted compressed layers the
+// snapshot cache keeps around once no container uses them
+var SnapshotCacheSize int64 = 10 << 30
+
+// snapshotEntry tracks one extracted layer in the snapshot cache
+type snapshotEntry struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	Refs     []string  `json:"refs,omitempty"` // Containers using the snapshot
+}
+
+// Acquire returns the directories holding the given layers, bottom first,
+// for use as overlay lowerdirs. Compressed layers are extracted into the
+// snapshot cache on first use and kept there while owner references them.
+func Acquire(owner string, layerIDs []string) ([]string, error) {
+	var paths []string
+	var compressed []*LayerMetadata
+	for _, layerID := range layerIDs {
+		l, err := GetLayer(layerID)
+		if err != nil {
+			return nil, err
+		}
+		if l.Compression == "" {
+			paths = append(paths, l.Path)
+			continue
+		}
+		compressed = append(compressed, l)
+		paths = append(paths, filepath.Join(snapshotBasePath(), layerID))
+	}
+	if len(compressed) == 0 {
+		return paths, nil
+	}
+
+	// Reference the snapshots first so Release cannot evict them while
+	// they are extracted
+	if err := addSnapshotRefs(owner, compressed); err != nil {
+		return nil, err
+	}
+
+	// Each layer is extracted under its own lock, so a large layer only
+	// holds up the containers that need it
+	for _, l := range compressed {
+		if err := ensureSnapshot(l); err != nil {
+			return nil, fmt.Errorf("failed to extract layer %s: %v", l.ID[:12], err)
+		}
+	}
+	return paths, nil
+}
+
+// addSnapshotRefs records that owner uses the snapshots of the given layers
+func addSnapshotRefs(owner string, layers []*LayerMetadata) error {
+	lock, err := store.Acquire("snapshots")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	index, err := loadSnapshotIndex()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range layers {
+		entry := index[l.ID]
+		if entry == nil {
+			entry = &snapshotEntry{Size: l.Size}
+			index[l.ID] = entry
+		}
+		entry.LastUsed = time.Now()
+		if !contains(entry.Refs, owner) {
+			entry.Refs = append(entry.Refs, owner)
+		}
+	}
+	return saveSnapshotIndex(index)
+}
+
+// ensureSnapshot extracts a layer into the snapshot cache unless it is
+// already there
+func ensureSnapshot(l *LayerMetadata) error {
+	snapshotPath := filepath.Join(snapshotBasePath(), l.ID)
+	if _, err := os.Stat(snapshotPath); err == nil {
+		return nil
+	}
+
+	lock, err := store.Acquire("snapshot-" + l.ID)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Another process may have extracted it while we waited
+	if _, err := os.Stat(snapshotPath); err == nil {
+		return nil
+	}
+	return extractSnapshot(l, snapshotPath)
+}
+
+// Release drops owner's references to cached snapshots, then evicts the
+// least recently used snapshots no container references until the cache
+// fits in SnapshotCacheSize
+func Release(owner string) error {
+	lock, err := store.Acquire("snapshots")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	index, err := loadSnapshotIndex()
+	if err != nil {
+		return err
+	}
+	if len(index) == 0 {
+		return nil
+	}
+
+	var total int64
+	var unused []string
+	for layerID, entry := range index {
+		for i, ref := range entry.Refs {
+			if ref == owner {
+				entry.Refs = append(entry.Refs[:i], entry.Refs[i+1:]...)
+				entry.LastUsed = time.Now()
+				break
+			}
+		}
+		total += entry.Size
+		if len(entry.Refs) == 0 {
+			unused = append(unused, layerID)
+		}
+	}
+
+	sort.Slice(unused, func(i, j int) bool {
+		return index[unused[i]].LastUsed.Before(index[unused[j]].LastUsed)
+	})
+	for _, layerID := range unused {
+		if total <= SnapshotCacheSize {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(snapshotBasePath(), layerID)); err != nil {
+			return fmt.Errorf("failed to evict snapshot %s: %v", layerID[:12], err)
+		}
+		total -= index[layerID].Size
+		delete(index, layerID)
+	}
+
+	return saveSnapshotIndex(index)
+}
+
+// removeSnapshot drops the cached snapshot of a layer unless a container uses it
+func removeSnapshot(layerID string) error {
+	lock, err := store.Acquire("snapshots")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	index, err := loadSnapshotIndex()
+	if err != nil {
+		return err
+	}
+	if entry := index[layerID]; entry != nil && len(entry.Refs) > 0 {
+		return fmt.Errorf("layer %s is in use by container %s", layerID[:12], entry.Refs[0])
+	}
+
+	if err := os.RemoveAll(filepath.Join(snapshotBasePath(), layerID)); err != nil {
+		return err
+	}
+	delete(index, layerID)
+	return saveSnapshotIndex(index)
+}
+
+// extractSnapshot unpacks a compressed layer into the snapshot cache
+func extractSnapshot(l *LayerMetadata, snapshotPath string) error {
+	if err := os.MkdirAll(snapshotBasePath(), 0755); err != nil {
+		return err
+	}
+
+	tmpPath, err := os.MkdirTemp(snapshotBasePath(), ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	stream, err := openBlob(l)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := extractTar(stream, tmpPath, false); err != nil {
+		return err
+	}
+	os.Chmod(tmpPath, 0755)
+
+	return os.Rename(tmpPath, snapshotPath)
+}
+
+func loadSnapshotIndex() (map[string]*snapshotEntry, error) {
+	index := make(map[string]*snapshotEntry)
+
+	err := store.ReadJSON(filepath.Join(snapshotBasePath(), "index.json"), &index, nil)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot index: %v", err)
+	}
+	return index, nil
+}
+
+func saveSnapshotIndex(index map[string]*snapshotEntry) error {
+	return store.WriteJSON(filepath.Join(snapshotBasePath(), "index.json"), index)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Overlayfs marks a deleted path with a 0/0 character device and a
+// directory whose lower contents are hidden with an xattr. Layer tarballs
+// use the OCI .wh. entries instead, so both forms are converted here.
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutOpaqueDir  = ".wh..wh..opq"
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	overlayXattrPrefix = "trusted.overlay."
+	paxXattrPrefix     = "SCHILY.xattr."
+)
+
+// IsWhiteout reports whether a file is an overlayfs whiteout, a 0/0
+// character device
+func IsWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// IsOpaque reports whether a directory hides the contents of lower layers
+func IsOpaque(path string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(path, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// whiteoutHeader is the tar entry recording that name was deleted
+func whiteoutHeader(name string) *tar.Header {
+	dir, base := filepath.Split(name)
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     dir + whiteoutPrefix + base,
+		Mode:     0600,
+	}
+}
+
+// opaqueHeader is the tar entry recording that dir replaces lower contents
+func opaqueHeader(dir string) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimSuffix(dir, "/") + "/" + whiteoutOpaqueDir,
+		Mode:     0600,
+	}
+}
+
+// applyWhiteout turns an OCI whiteout entry at target into its overlayfs
+// form. It returns false if target is an ordinary file.
+func applyWhiteout(target string) (bool, error) {
+	parent, base := filepath.Split(target)
+	parent = filepath.Clean(parent)
+
+	if base == whiteoutOpaqueDir {
+		if err := syscall.Setxattr(parent, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return true, fmt.Errorf("failed to mark %s opaque: %v", parent, err)
+		}
+		return true, nil
+	}
+
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
+
+	hidden := filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+	os.RemoveAll(hidden)
+	if err := syscall.Mknod(hidden, syscall.S_IFCHR, 0); err != nil {
+		return true, fmt.Errorf("failed to create whiteout for %s: %v", hidden, err)
+	}
+	return true, nil
+}
+
+// removeWhiteout applies an OCI whiteout entry at target to a flattened
+// tree by deleting what it hides. It returns false if target is an
+// ordinary file.
+func removeWhiteout(target string) (bool, error) {
+	parent, base := filepath.Split(target)
+	parent = filepath.Clean(parent)
+
+	if base == whiteoutOpaqueDir {
+		// The marker precedes the layer's own entries for the directory
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return true, err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(parent, entry.Name())); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
+
+	if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+		return true, fmt.Errorf("failed to apply whiteout for %s: %v", target, err)
+	}
+	return true, nil
+}
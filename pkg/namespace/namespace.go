@@ -1,14 +1,138 @@
 package namespace
 
 import (
+    "bytes"
+    "encoding/json"
     "fmt"
     "os"
     "os/exec"
     "strings"
     "syscall"
     "time"
+
+    "github.com/jagjeet-singh-23/minidocker/pkg/cgroup"
 )
 
+// DefaultUlimits are set on every container's processes
+var DefaultUlimits []Ulimit
+
+// Ulimit is a resource limit, named like the RLIMIT_ constants: nofile for
+// RLIMIT_NOFILE
+type Ulimit struct {
+    Name string `json:"Name"`
+    Soft int64  `json:"Soft"`
+    Hard int64  `json:"Hard"`
+}
+
+// Unlimited is the value of a limit without a bound. In JSON it may also be
+// written as "unlimited".
+const Unlimited int64 = -1
+
+// UnmarshalJSON reads a limit whose values are numbers or "unlimited"
+func (u *Ulimit) UnmarshalJSON(data []byte) error {
+    var raw struct {
+        Name string          `json:"Name"`
+        Soft json.RawMessage `json:"Soft"`
+        Hard json.RawMessage `json:"Hard"`
+    }
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&raw); err != nil {
+        return err
+    }
+
+    soft, err := parseUlimitValue(raw.Soft)
+    if err != nil {
+        return err
+    }
+    hard, err := parseUlimitValue(raw.Hard)
+    if err != nil {
+        return err
+    }
+
+    *u = Ulimit{Name: raw.Name, Soft: soft, Hard: hard}
+    return nil
+}
+
+func parseUlimitValue(raw json.RawMessage) (int64, error) {
+    if len(raw) == 0 {
+        return 0, nil
+    }
+
+    var s string
+    if json.Unmarshal(raw, &s) == nil {
+        if s != "unlimited" {
+            return 0, fmt.Errorf("invalid ulimit value %q: must be a number or unlimited", s)
+        }
+        return Unlimited, nil
+    }
+
+    var value int64
+    if err := json.Unmarshal(raw, &value); err != nil {
+        return 0, fmt.Errorf("invalid ulimit value %s: must be a number or unlimited", raw)
+    }
+    return value, nil
+}
+
+// ulimitValue formats a limit value the way the ulimit builtin takes it
+func ulimitValue(v int64) string {
+    if v == Unlimited {
+        return "unlimited"
+    }
+    return fmt.Sprint(v)
+}
+
+// ulimitFlags maps limit names to the options of the shell's ulimit builtin
+var ulimitFlags = map[string]string{
+    "as":         "v",
+    "core":       "c",
+    "cpu":        "t",
+    "data":       "d",
+    "fsize":      "f",
+    "locks":      "x",
+    "memlock":    "l",
+    "msgqueue":   "q",
+    "nice":       "e",
+    "nofile":     "n",
+    "nproc":      "u",
+    "rss":        "m",
+    "rtprio":     "r",
+    "sigpending": "i",
+    "stack":      "s",
+}
+
+// Validate checks that a limit exists and that its soft value is within the hard one
+func (u Ulimit) Validate() error {
+    if _, ok := ulimitFlags[u.Name]; !ok {
+        return fmt.Errorf("unknown ulimit %q", u.Name)
+    }
+    if u.Soft < Unlimited || u.Hard < Unlimited {
+        return fmt.Errorf("ulimit %s: values must be -1 (unlimited) or more", u.Name)
+    }
+    // The kernel caps open files at fs.nr_open, so RLIMIT_NOFILE can't be infinity
+    if u.Name == "nofile" && (u.Soft == Unlimited || u.Hard == Unlimited) {
+        return fmt.Errorf("ulimit nofile: cannot be unlimited, the kernel limits open files to fs.nr_open")
+    }
+    if u.Hard != Unlimited && (u.Soft == Unlimited || u.Soft > u.Hard) {
+        return fmt.Errorf("ulimit %s: soft limit %s is above hard limit %s", u.Name, ulimitValue(u.Soft), ulimitValue(u.Hard))
+    }
+    return nil
+}
+
+// ulimitScript sets the limits in the wrapper script. The soft limit is set
+// first in case the hard limit is being lowered below the current soft one,
+// and again once a raised hard limit allows it.
+func ulimitScript(ulimits []Ulimit) string {
+    script := ""
+    for _, u := range ulimits {
+        flag := ulimitFlags[u.Name]
+        script += fmt.Sprintf("ulimit -S -%s %s 2>/dev/null\n", flag, ulimitValue(u.Soft))
+        script += fmt.Sprintf("ulimit -H -%s %s || exit 1\n", flag, ulimitValue(u.Hard))
+        script += fmt.Sprintf("ulimit -S -%s %s || exit 1\n", flag, ulimitValue(u.Soft))
+    }
+    return script
+}
+
 func RunInNewNamespaceWithCgroup(command []string, rootfsPath, containerID string, enableNetwork bool, env []string, workingDir string) (int, error) {
     if rootfsPath == "" {
         return 0, fmt.Errorf("rootfs path required")
@@ -16,7 +140,7 @@ func RunInNewNamespaceWithCgroup(command []string, rootfsPath, containerID strin
     
     cgroupAdd := ""
     if containerID != "" {
-        cgroupPath := fmt.Sprintf("/sys/fs/cgroup/minidocker-%s", containerID)
+        cgroupPath := cgroup.Path(containerID)
         cgroupAdd = fmt.Sprintf(`
 if [ -d "%s" ]; then
     echo $$ > %s/cgroup.procs 2>/dev/null || true
@@ -42,12 +166,16 @@ fi
         escapedCmd[i] = shellescape(arg)
     }
 
+    // The command runs under a second shell inside the chroot, so it is quoted twice
+    inner := fmt.Sprintf("cd %s && exec %s", shellescape(workingDir), strings.Join(escapedCmd, " "))
+
     // Build the script with env vars and working directory
     script := fmt.Sprintf(`#!/bin/bash
 %s
 %s
-exec chroot %s /bin/sh -c 'cd %s && exec %s'
-`, cgroupAdd, envVars, rootfsPath, shellescape(workingDir), strings.Join(escapedCmd, " "))
+%s
+exec chroot %s /bin/sh -c %s
+`, cgroupAdd, ulimitScript(DefaultUlimits), envVars, shellescape(rootfsPath), shellescape(inner))
     
     tmpScript := "/tmp/container_wrapper.sh"
     if err := os.WriteFile(tmpScript, []byte(script), 0755); err != nil {
@@ -0,0 +1,217 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// DefaultNetwork is the name of the minidocker0 bridge network
+const DefaultNetwork = "bridge"
+
+// ipamSchema versions address allocation records
+var ipamSchema = &store.Schema{Kind: "ipam"}
+
+// ipamRecord holds the addresses handed out on one network
+type ipamRecord struct {
+	Subnet        string               `json:"subnet"`
+	Allocations   map[string]string    `json:"allocations"`         // IP to container ID
+	Allocated     map[string]time.Time `json:"allocated,omitempty"` // IP to when it was handed out
+	SchemaVersion int                  `json:"schema_version"`
+}
+
+// Allocation is an address held by a container
+type Allocation struct {
+	ContainerID string
+	Allocated   time.Time // Zero for addresses recorded before allocation times were
+}
+
+func ipamPath(networkName string) string {
+	return store.Path("ipam", networkName+".json")
+}
+
+// AllocateIP reserves an address of a network's subnet for a container and
+// returns it in CIDR form. requested picks a static address; otherwise the
+// lowest free one is used. The network address, the gateway (the first
+// address) and the broadcast address are never handed out.
+func AllocateIP(networkName, subnet, containerID, requested string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return "", fmt.Errorf("invalid subnet %q for network %s", subnet, networkName)
+	}
+	ones, _ := ipNet.Mask.Size()
+	size, err := subnetSize(ipNet)
+	if err != nil {
+		return "", fmt.Errorf("network %s: %v", networkName, err)
+	}
+
+	lock, err := store.Acquire("ipam-" + networkName)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	// The network may have been removed while we waited for the lock
+	if exists, err := networkExists(networkName); err != nil {
+		return "", err
+	} else if !exists {
+		return "", fmt.Errorf("network %s not found", networkName)
+	}
+
+	record, err := loadIPAM(networkName, ipNet)
+	if err != nil {
+		return "", err
+	}
+
+	var ip net.IP
+	if requested != "" {
+		ip = net.ParseIP(requested).To4()
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address %q", requested)
+		}
+		if !ipNet.Contains(ip) {
+			return "", fmt.Errorf("IP %s is not in subnet %s of network %s", ip, ipNet, networkName)
+		}
+		offset := uint64(ipOffset(ipNet.IP, ip))
+		if offset < 2 || offset == size-1 {
+			return "", fmt.Errorf("IP %s is reserved in subnet %s of network %s", ip, ipNet, networkName)
+		}
+		if owner, ok := record.Allocations[ip.String()]; ok && owner != containerID {
+			return "", fmt.Errorf("IP %s is already in use by container %.12s", ip, owner)
+		}
+	} else {
+		for offset := uint64(2); offset < size-1; offset++ {
+			candidate := addToIP(ipNet.IP, uint32(offset))
+			if owner, ok := record.Allocations[candidate.String()]; !ok || owner == containerID {
+				ip = candidate
+				break
+			}
+		}
+		if ip == nil {
+			return "", fmt.Errorf("no available IP addresses in network %s: all %d addresses of %s are allocated", networkName, size-3, ipNet)
+		}
+	}
+
+	record.Allocations[ip.String()] = containerID
+	record.Allocated[ip.String()] = time.Now()
+	if err := saveIPAM(networkName, record); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+// ReleaseIP frees the addresses a container holds on a network
+func ReleaseIP(networkName, containerID string) error {
+	lock, err := store.Acquire("ipam-" + networkName)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	record, err := loadIPAM(networkName, nil)
+	if err != nil {
+		return err
+	}
+
+	released := false
+	for ip, owner := range record.Allocations {
+		if owner == containerID {
+			delete(record.Allocations, ip)
+			delete(record.Allocated, ip)
+			released = true
+		}
+	}
+	if !released {
+		return nil
+	}
+	return saveIPAM(networkName, record)
+}
+
+// Allocations returns the addresses held on a network, by IP
+func Allocations(networkName string) (map[string]Allocation, error) {
+	record, err := loadIPAM(networkName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := make(map[string]Allocation, len(record.Allocations))
+	for ip, id := range record.Allocations {
+		allocations[ip] = Allocation{ContainerID: id, Allocated: record.Allocated[ip]}
+	}
+	return allocations, nil
+}
+
+// AllocatedNetworks returns the networks that have allocation records
+func AllocatedNetworks() ([]string, error) {
+	entries, err := os.ReadDir(store.Path("ipam"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			names = append(names, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadIPAM reads a network's allocations. When the subnet changed since they
+// were made, those outside the new subnet are dropped.
+func loadIPAM(networkName string, ipNet *net.IPNet) (*ipamRecord, error) {
+	record := &ipamRecord{}
+	err := store.ReadJSON(ipamPath(networkName), record, ipamSchema)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if record.Allocations == nil {
+		record.Allocations = make(map[string]string)
+	}
+	if record.Allocated == nil {
+		record.Allocated = make(map[string]time.Time)
+	}
+
+	if ipNet != nil && record.Subnet != ipNet.String() {
+		for ip := range record.Allocations {
+			if !ipNet.Contains(net.ParseIP(ip)) {
+				delete(record.Allocations, ip)
+				delete(record.Allocated, ip)
+			}
+		}
+		record.Subnet = ipNet.String()
+	}
+	return record, nil
+}
+
+func saveIPAM(networkName string, record *ipamRecord) error {
+	record.SchemaVersion = ipamSchema.Version()
+	return store.WriteJSON(ipamPath(networkName), record)
+}
+
+// subnetSize returns the number of addresses in a subnet. Subnets smaller
+// than a /30 are rejected, as the network address, the gateway and the
+// broadcast address leave no room for containers.
+func subnetSize(ipNet *net.IPNet) (uint64, error) {
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return 0, fmt.Errorf("subnet %s is too small, it must be a /30 or larger", ipNet)
+	}
+	return uint64(1) << uint(bits-ones), nil
+}
+
+// ipOffset returns how far ip is from base
+func ipOffset(base, ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(base.To4())
+}
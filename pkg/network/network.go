@@ -2,43 +2,75 @@ package network
 
 import (
     crand "crypto/rand"
+    "encoding/binary"
     "encoding/hex"
     "fmt"
-    mrand "math/rand"
     "net"
     "os"
     "os/exec"
     "regexp"
     "strings"
-    "time"
 )
 
-const (
-    BridgeName = "minidocker0"
+const BridgeName = "minidocker0"
+
+// The default bridge's subnet and address, changed with SetSubnet
+var (
     SubnetCIDR = "172.18.0.0/24"
     BridgeIP   = "172.18.0.1/24"
 )
 
-// SetupBridge creates the minidocker bridge if it doesn't exist
-func SetupBridge() error {
+// SetSubnet sets the IPv4 subnet of the default bridge. The bridge takes
+// the first address, containers the others.
+func SetSubnet(cidr string) error {
+    _, ipNet, err := net.ParseCIDR(cidr)
+    if err != nil || ipNet.IP.To4() == nil {
+        return fmt.Errorf("invalid bridge subnet %q: must be an IPv4 CIDR (e.g. 172.18.0.0/24)", cidr)
+    }
+    ones, _ := ipNet.Mask.Size()
+    if _, err := subnetSize(ipNet); err != nil {
+        return fmt.Errorf("invalid bridge subnet: %v", err)
+    }
+
+    gateway := addToIP(ipNet.IP, 1)
+    SubnetCIDR = ipNet.String()
+    BridgeIP = fmt.Sprintf("%s/%d", gateway, ones)
+    return nil
+}
+
+// gatewayIP returns the bridge's address, without the prefix length
+func gatewayIP() string {
+    return strings.Split(BridgeIP, "/")[0]
+}
+
+// addToIP returns the IPv4 address n after ip
+func addToIP(ip net.IP, n uint32) net.IP {
+    v := binary.BigEndian.Uint32(ip.To4()) + n
+    next := make(net.IP, 4)
+    binary.BigEndian.PutUint32(next, v)
+    return next
+}
+
+// SetupBridge creates the network's bridge if it doesn't exist
+func (n *Network) SetupBridge() error {
     // Check if bridge exists
-    cmd := exec.Command("ip", "link", "show", BridgeName)
+    cmd := exec.Command("ip", "link", "show", n.Bridge)
     bridgeExists := cmd.Run() == nil
 
     if !bridgeExists {
         // Create bridge
-        if err := exec.Command("ip", "link", "add", BridgeName, "type", "bridge").Run(); err != nil {
+        if err := exec.Command("ip", "link", "add", n.Bridge, "type", "bridge").Run(); err != nil {
             return fmt.Errorf("failed to create bridge: %v", err)
         }
 
         // Set bridge IP
-        if err := exec.Command("ip", "addr", "add", BridgeIP, "dev", BridgeName).Run(); err != nil {
+        if err := exec.Command("ip", "addr", "add", n.gatewayCIDR(), "dev", n.Bridge).Run(); err != nil {
             return fmt.Errorf("failed to set bridge IP: %v", err)
         }
     }
 
     // Always ensure bridge is up
-    if err := exec.Command("ip", "link", "set", BridgeName, "up").Run(); err != nil {
+    if err := exec.Command("ip", "link", "set", n.Bridge, "up").Run(); err != nil {
         return fmt.Errorf("failed to bring bridge up: %v", err)
     }
 
@@ -53,13 +85,19 @@ func SetupBridge() error {
     }
 
     // Setup NAT (check if rule already exists)
-    if err := setupNAT(); err != nil {
+    if err := setupNAT(n.Subnet); err != nil {
         // Ignore if rule already exists
         fmt.Printf("NAT setup note: %v\n", err)
     }
 
-    exec.Command("iptables", "-A", "FORWARD", "-i", BridgeName, "-j", "ACCEPT").Run()
-    exec.Command("iptables", "-A", "FORWARD", "-o", BridgeName, "-j", "ACCEPT").Run()
+    // Keep other networks out before accepting the bridge's traffic
+    if err := isolate(n.Bridge); err != nil {
+        fmt.Fprintf(os.Stderr, "Warning: failed to isolate network %s: %v\n", n.Name, err)
+    }
+
+    // Added once, however many containers are started on the network
+    ensureRule("FORWARD", false, "-i", n.Bridge, "-j", "ACCEPT")
+    ensureRule("FORWARD", false, "-o", n.Bridge, "-j", "ACCEPT")
 
     return nil
 }
@@ -74,24 +112,26 @@ func detectExternalInterface() (string, error) {
 }
 
 // setupNAT configures iptables for container internet access
-func setupNAT() error {
+func setupNAT(subnet string) error {
     extIf, err := detectExternalInterface()
     if err != nil {
         return fmt.Errorf("cannot detect external interface: %v", err)
     }
 
     cmd := exec.Command("iptables", "-t", "nat", "-C", "POSTROUTING",
-        "-s", SubnetCIDR, "-o", extIf, "-j", "MASQUERADE")
+        "-s", subnet, "-o", extIf, "-j", "MASQUERADE")
     if cmd.Run() == nil {
         return nil
     }
 
     return exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING",
-        "-s", SubnetCIDR, "-o", extIf, "-j", "MASQUERADE").Run()
+        "-s", subnet, "-o", extIf, "-j", "MASQUERADE").Run()
 }
 
-// SetupContainerNetwork creates veth pair and connects to bridge
-func SetupContainerNetwork(containerID string, pid int) (string, error) {
+// SetupContainerNetwork creates veth pair and connects it to the network's
+// bridge, giving the container the IP allocated to it as interface ifName.
+// It returns the name of the host end of the pair.
+func SetupContainerNetwork(n *Network, pid int, containerIP, ifName string) (string, error) {
     // Generate interface names
     randomBytes := make([]byte, 4)
     if _, err := crand.Read(randomBytes); err != nil {
@@ -108,48 +148,40 @@ func SetupContainerNetwork(containerID string, pid int) (string, error) {
         return "", fmt.Errorf("failed to create veth pair: %v", err)
     }
 
+    if err := connectVeth(n, pid, vethHost, vethContainer, containerIP, ifName); err != nil {
+        // Deleting one end deletes the pair
+        exec.Command("ip", "link", "delete", vethHost).Run()
+        return "", err
+    }
+
+    return vethHost, nil
+}
+
+// connectVeth attaches a new veth pair to the bridge and the container
+func connectVeth(n *Network, pid int, vethHost, vethContainer, containerIP, ifName string) error {
     // Attach host end to bridge
-    if err := exec.Command("ip", "link", "set", vethHost, "master", BridgeName).Run(); err != nil {
-        return "", fmt.Errorf("failed to attach veth to bridge: %v", err)
+    if err := exec.Command("ip", "link", "set", vethHost, "master", n.Bridge).Run(); err != nil {
+        return fmt.Errorf("failed to attach veth to bridge: %v", err)
     }
 
     // Bring up host veth
     if err := exec.Command("ip", "link", "set", vethHost, "up").Run(); err != nil {
-        return "", fmt.Errorf("failed to bring up host veth: %v", err)
+        return fmt.Errorf("failed to bring up host veth: %v", err)
     }
 
     // Move container end into container's network namespace
     nsPath := fmt.Sprintf("/proc/%d/ns/net", pid)
     if err := exec.Command("ip", "link", "set", vethContainer, "netns", nsPath).Run(); err != nil {
-        return "", fmt.Errorf("failed to move veth to container: %v", err)
-    }
-
-    // Allocate IP for container
-    containerIP, err := allocateIP(containerID)
-    if err != nil {
-        return "", err
+        return fmt.Errorf("failed to move veth to container: %v", err)
     }
 
     // Configure container network from inside namespace
-    if err := configureContainerNetNS(pid, vethContainer, containerIP); err != nil {
-        return "", err
-    }
-
-    return containerIP, nil
+    return configureContainerNetNS(pid, vethContainer, containerIP, ifName, n.Gateway)
 }
 
-// allocateIP assigns an IP address to the container
-func allocateIP(containerID string) (string, error) {
-    // Seed math/rand for pseudo-random IP allocation
-    mrand.Seed(time.Now().UnixNano())
-
-    // Use safe ranges: 1..254 for both octets, avoid .1 (bridge) and .0/.255
-    hostPart := mrand.Intn(253) + 2
-    return fmt.Sprintf("172.18.0.%d/24", hostPart), nil
-}
-
-// configureContainerNetNS sets up networking inside container namespace
-func configureContainerNetNS(pid int, vethName, ipAddr string) error {
+// configureContainerNetNS sets up networking inside container namespace. Only
+// the first interface, eth0, gets the default route.
+func configureContainerNetNS(pid int, vethName, ipAddr, ifName, gateway string) error {
     netnsName := fmt.Sprintf("minidocker-%d", pid)
     netnsPath := fmt.Sprintf("/proc/%d/ns/net", pid)
 
@@ -171,19 +203,19 @@ func configureContainerNetNS(pid int, vethName, ipAddr string) error {
         return nil
     }
 
-    // Rename veth to eth0 inside container
-    if err := nsenterCmd("ip", "link", "set", vethName, "name", "eth0"); err != nil {
+    // Rename veth inside container
+    if err := nsenterCmd("ip", "link", "set", vethName, "name", ifName); err != nil {
         return fmt.Errorf("failed to rename veth: %v", err)
     }
 
     // Set IP address
-    if err := nsenterCmd("ip", "addr", "add", ipAddr, "dev", "eth0"); err != nil {
+    if err := nsenterCmd("ip", "addr", "add", ipAddr, "dev", ifName); err != nil {
         return fmt.Errorf("failed to set IP: %v", err)
     }
 
-    // Bring up eth0
-    if err := nsenterCmd("ip", "link", "set", "eth0", "up"); err != nil {
-        return fmt.Errorf("failed to bring up eth0: %v", err)
+    // Bring up the interface
+    if err := nsenterCmd("ip", "link", "set", ifName, "up"); err != nil {
+        return fmt.Errorf("failed to bring up %s: %v", ifName, err)
     }
 
     // Bring up loopback
@@ -192,9 +224,11 @@ func configureContainerNetNS(pid int, vethName, ipAddr string) error {
     }
 
     // Set default route via bridge
-    err := nsenterCmd("ip", "route", "add", "default", "via", "172.18.0.1", "dev", "eth0")
-    if err != nil && !strings.Contains(err.Error(), "File exists") {
-        return fmt.Errorf("failed to set default route: %v", err)
+    if ifName == "eth0" {
+        err := nsenterCmd("ip", "route", "add", "default", "via", gateway, "dev", ifName)
+        if err != nil && !strings.Contains(err.Error(), "File exists") {
+            return fmt.Errorf("failed to set default route: %v", err)
+        }
     }
 
     // --- validation: ensure ipAddr is CIDR and gateway is inside same subnet ---
@@ -203,7 +237,7 @@ func configureContainerNetNS(pid int, vethName, ipAddr string) error {
 	    return fmt.Errorf("invalid ipAddr %q: must be CIDR (e.g. 172.18.0.10/24)", ipAddr)
     }
 
-    gw := net.ParseIP("172.18.0.1")
+    gw := net.ParseIP(gateway)
     if gw == nil {
 	    return fmt.Errorf("invalid gateway IP")
     }
@@ -232,16 +266,48 @@ func configureContainerNetNS(pid int, vethName, ipAddr string) error {
     return nil
 }
 
-// CleanupContainerNetwork removes veth interfaces
-func CleanupContainerNetwork(containerID string) error {
-    vethHost := fmt.Sprintf("veth%s", containerID[:8])
+// CleanupContainerNetwork removes the veth pair of a container, given its host end
+func CleanupContainerNetwork(vethHost string) error {
+    if vethHost == "" {
+        return nil
+    }
 
-    exec.Command("ip", "link", "delete", vethHost).Run()
-    exec.Command("ip", "link", "delete", fmt.Sprintf("veth%s", containerID[:8])).Run()
+    if output, err := exec.Command("ip", "link", "delete", vethHost).CombinedOutput(); err != nil {
+        // The pair is gone already when the container's namespace was destroyed
+        if strings.Contains(string(output), "Cannot find device") {
+            return nil
+        }
+        return fmt.Errorf("failed to delete %s: %v, output: %s", vethHost, err, strings.TrimSpace(string(output)))
+    }
 
     return nil
 }
 
+// DanglingVeths lists the host veths whose container end is still in the
+// host namespace, i.e. whose setup never finished
+func DanglingVeths() ([]string, error) {
+    output, err := exec.Command("ip", "-o", "link", "show", "type", "veth").Output()
+    if err != nil {
+        return nil, err
+    }
+
+    var veths []string
+    for _, line := range strings.Split(string(output), "\n") {
+        // "12: vetha1b2c3@vethca1b2c3: <...>", where the peer reads "if11"
+        // once it is in another namespace
+        fields := strings.Fields(line)
+        if len(fields) < 2 {
+            continue
+        }
+        name, peer, _ := strings.Cut(strings.TrimSuffix(fields[1], ":"), "@")
+        if strings.HasPrefix(name, "veth") && peer == "vethc"+strings.TrimPrefix(name, "veth") {
+            veths = append(veths, name)
+        }
+    }
+
+    return veths, nil
+}
+
 // GetContainerIP returns the IP address of a container
 func GetContainerIP(containerID string, pid int) (string, error) {
     cmd := exec.Command("nsenter", "-t", fmt.Sprintf("%d", pid), "-n",
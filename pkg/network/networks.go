@@ -0,0 +1,372 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// NoNetwork runs a container without a network namespace of its own
+const NoNetwork = "none"
+
+// bridgePrefix starts the bridge names of user-defined networks
+const bridgePrefix = "md-"
+
+// isolationChain holds the rules keeping networks apart
+const isolationChain = "MINIDOCKER-ISOLATION"
+
+// networkSchema versions network records
+var networkSchema = &store.Schema{Kind: "network"}
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Network is a bridge that containers get an interface on
+type Network struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Driver        string    `json:"driver"`
+	Subnet        string    `json:"subnet"`
+	Gateway       string    `json:"gateway"`
+	Bridge        string    `json:"bridge"`
+	Created       time.Time `json:"created"`
+	SchemaVersion int       `json:"schema_version"`
+}
+
+// Endpoint is a container's interface on a network
+type Endpoint struct {
+	NetworkID string `json:"network_id"`
+	Interface string `json:"interface"`  // eth0, eth1...
+	IPAddress string `json:"ip_address"` // With prefix length
+	Gateway   string `json:"gateway"`
+	VethHost  string `json:"veth_host,omitempty"`
+}
+
+// defaultNetwork describes the minidocker0 bridge, which has no record
+func defaultNetwork() *Network {
+	sum := sha256.Sum256([]byte(BridgeName))
+	return &Network{
+		ID:      hex.EncodeToString(sum[:]),
+		Name:    DefaultNetwork,
+		Driver:  "bridge",
+		Subnet:  SubnetCIDR,
+		Gateway: gatewayIP(),
+		Bridge:  BridgeName,
+	}
+}
+
+func networkPath(id string) string {
+	return store.Path("networks", id+".json")
+}
+
+// gatewayCIDR returns the bridge's address with the subnet's prefix length
+func (n *Network) gatewayCIDR() string {
+	_, ipNet, _ := net.ParseCIDR(n.Subnet)
+	ones, _ := ipNet.Mask.Size()
+	return fmt.Sprintf("%s/%d", n.Gateway, ones)
+}
+
+// IsDefault reports whether this is the predefined bridge network
+func (n *Network) IsDefault() bool {
+	return n.Name == DefaultNetwork
+}
+
+// CreateNetwork creates a network with its own bridge. Without a subnet, the
+// first free /24 of 172.19.0.0/16 is used.
+func CreateNetwork(name, subnet string) (*Network, error) {
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	if name == DefaultNetwork || name == NoNetwork || name == "host" {
+		return nil, fmt.Errorf("network name %s is reserved", name)
+	}
+
+	lock, err := store.Acquire("networks")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		if n.Name == name {
+			return nil, fmt.Errorf("network with name %s already exists", name)
+		}
+	}
+
+	var ipNet *net.IPNet
+	if subnet == "" {
+		if ipNet, err = freeSubnet(networks); err != nil {
+			return nil, err
+		}
+	} else {
+		_, ipNet, err = net.ParseCIDR(subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %q: must be an IPv4 CIDR (e.g. 172.19.0.0/24)", subnet)
+		}
+		if _, err := subnetSize(ipNet); err != nil {
+			return nil, err
+		}
+		for _, n := range networks {
+			if overlaps(ipNet, n.Subnet) {
+				return nil, fmt.Errorf("subnet %s overlaps with network %s (%s)", ipNet, n.Name, n.Subnet)
+			}
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate network ID: %v", err)
+	}
+	id := hex.EncodeToString(b)
+
+	n := &Network{
+		ID:      id,
+		Name:    name,
+		Driver:  "bridge",
+		Subnet:  ipNet.String(),
+		Gateway: addToIP(ipNet.IP, 1).String(),
+		Bridge:  bridgePrefix + id[:12],
+		Created: time.Now(),
+	}
+	if err := n.SetupBridge(); err != nil {
+		exec.Command("ip", "link", "delete", n.Bridge).Run()
+		return nil, err
+	}
+
+	n.SchemaVersion = networkSchema.Version()
+	if err := store.WriteJSON(networkPath(n.ID), n); err != nil {
+		n.teardown()
+		return nil, err
+	}
+	return n, nil
+}
+
+// GetNetwork finds a network by name, full ID or unique ID prefix
+func GetNetwork(nameOrID string) (*Network, error) {
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range networks {
+		if n.Name == nameOrID || n.ID == nameOrID {
+			return n, nil
+		}
+	}
+
+	var matches []*Network
+	for _, n := range networks {
+		if strings.HasPrefix(n.ID, nameOrID) {
+			matches = append(matches, n)
+		}
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("multiple networks found with ID prefix: %s", nameOrID)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("network %s not found", nameOrID)
+	}
+	return matches[0], nil
+}
+
+// networkExists reports whether a network of exactly this name exists
+func networkExists(name string) (bool, error) {
+	networks, err := ListNetworks()
+	if err != nil {
+		return false, err
+	}
+	for _, n := range networks {
+		if n.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListNetworks returns the default network followed by the user-defined ones by name
+func ListNetworks() ([]*Network, error) {
+	networks := []*Network{defaultNetwork()}
+
+	entries, err := os.ReadDir(store.Path("networks"))
+	if os.IsNotExist(err) {
+		return networks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var defined []*Network
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		var n Network
+		if err := store.ReadJSON(store.Path("networks", entry.Name()), &n, networkSchema); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Warning: skipping network %s: %v\n", strings.TrimSuffix(entry.Name(), ".json"), err)
+			}
+			continue
+		}
+		defined = append(defined, &n)
+	}
+	sort.Slice(defined, func(i, j int) bool {
+		return defined[i].Name < defined[j].Name
+	})
+
+	return append(networks, defined...), nil
+}
+
+// RemoveNetwork deletes a user-defined network that no container is connected to
+func RemoveNetwork(nameOrID string) (*Network, error) {
+	lock, err := store.Acquire("networks")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	n, err := GetNetwork(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDefault() {
+		return nil, fmt.Errorf("%s is a pre-defined network and cannot be removed", n.Name)
+	}
+
+	// Connects allocate under the IPAM lock only, so hold it until the
+	// bridge is gone to keep them off a network being removed
+	ipamLock, err := store.Acquire("ipam-" + n.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer ipamLock.Release()
+
+	allocations, err := Allocations(n.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(allocations) > 0 {
+		var ids []string
+		for _, a := range allocations {
+			ids = append(ids, fmt.Sprintf("%.12s", a.ContainerID))
+		}
+		sort.Strings(ids)
+		return nil, fmt.Errorf("network %s has active endpoints (containers %s)", n.Name, strings.Join(ids, ", "))
+	}
+
+	if err := n.teardown(); err != nil {
+		return nil, err
+	}
+	os.Remove(ipamPath(n.Name))
+	if err := os.Remove(networkPath(n.ID)); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// teardown deletes the network's bridge and firewall rules
+func (n *Network) teardown() error {
+	removeIsolation(n.Bridge)
+	// Older versions added these rules once per container, so every copy goes
+	for _, dir := range []string{"-i", "-o"} {
+		for exec.Command("iptables", "-D", "FORWARD", dir, n.Bridge, "-j", "ACCEPT").Run() == nil {
+		}
+	}
+	if extIf, err := detectExternalInterface(); err == nil {
+		exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING",
+			"-s", n.Subnet, "-o", extIf, "-j", "MASQUERADE").Run()
+	}
+
+	if output, err := exec.Command("ip", "link", "delete", n.Bridge).CombinedOutput(); err != nil {
+		if !strings.Contains(string(output), "Cannot find device") {
+			return fmt.Errorf("failed to delete bridge %s: %v, output: %s", n.Bridge, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// freeSubnet returns the first /24 of 172.19.0.0/16 no network overlaps
+func freeSubnet(networks []*Network) (*net.IPNet, error) {
+	for i := 0; i < 256; i++ {
+		_, candidate, _ := net.ParseCIDR(fmt.Sprintf("172.19.%d.0/24", i))
+		free := true
+		for _, n := range networks {
+			if overlaps(candidate, n.Subnet) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in 172.19.0.0/16, give one with --subnet")
+}
+
+// overlaps reports whether two subnets share addresses
+func overlaps(ipNet *net.IPNet, subnet string) bool {
+	_, other, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	return ipNet.Contains(other.IP) || other.Contains(ipNet.IP)
+}
+
+// isolate keeps traffic from a bridge from being forwarded to any other
+// minidocker bridge. The rules live in their own chain, jumped to first
+// from FORWARD.
+func isolate(bridge string) error {
+	// Creating the chain fails once it exists
+	exec.Command("iptables", "-N", isolationChain).Run()
+	if err := ensureRule("FORWARD", true, "-j", isolationChain); err != nil {
+		return err
+	}
+
+	// Traffic staying on the bridge is returned before the drops below
+	if err := ensureRule(isolationChain, true, "-i", bridge, "-o", bridge, "-j", "RETURN"); err != nil {
+		return err
+	}
+	for _, other := range []string{BridgeName, bridgePrefix + "+"} {
+		if err := ensureRule(isolationChain, false, "-i", bridge, "-o", other, "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIsolation deletes the rules isolate added for a bridge
+func removeIsolation(bridge string) {
+	exec.Command("iptables", "-D", isolationChain, "-i", bridge, "-o", bridge, "-j", "RETURN").Run()
+	for _, other := range []string{BridgeName, bridgePrefix + "+"} {
+		exec.Command("iptables", "-D", isolationChain, "-i", bridge, "-o", other, "-j", "DROP").Run()
+	}
+}
+
+// ensureRule adds an iptables rule unless it exists, first in the chain or last
+func ensureRule(chain string, first bool, rule ...string) error {
+	if exec.Command("iptables", append([]string{"-C", chain}, rule...)...).Run() == nil {
+		return nil
+	}
+
+	args := append([]string{"-A", chain}, rule...)
+	if first {
+		args = append([]string{"-I", chain, "1"}, rule...)
+	}
+	if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+)
+
+// ChangeKind is how a path differs from the image
+type ChangeKind string
+
+const (
+	ChangeAdd    ChangeKind = "A"
+	ChangeModify ChangeKind = "C"
+	ChangeDelete ChangeKind = "D"
+)
+
+// Change is one path a container added, changed or deleted
+type Change struct {
+	Kind ChangeKind
+	Path string // Absolute path inside the container
+}
+
+// Changes compares an upper directory with the lower layers it sits on,
+// bottom layer first. Deletions come from whiteouts, and from opaque
+// directories hiding entries of the lower layers.
+func Changes(upperDir string, lowerDirs []string) ([]Change, error) {
+	var changes []Change
+
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		containerPath := "/" + filepath.ToSlash(rel)
+
+		if layer.IsWhiteout(info) {
+			changes = append(changes, Change{Kind: ChangeDelete, Path: containerPath})
+			return nil
+		}
+
+		kind := ChangeAdd
+		if existsInLower(lowerDirs, rel) {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Kind: kind, Path: containerPath})
+
+		// An opaque directory hides everything the lower layers had in it
+		if info.IsDir() && kind == ChangeModify && layer.IsOpaque(path) {
+			for _, name := range lowerEntries(lowerDirs, rel) {
+				if _, err := os.Lstat(filepath.Join(path, name)); os.IsNotExist(err) {
+					changes = append(changes, Change{Kind: ChangeDelete, Path: containerPath + "/" + name})
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// RootfsChanges compares a flattened root filesystem, as the native and
+// btrfs snapshotters create, with the layers it was created from. Without
+// an upper directory, changed files are found by their attributes.
+func RootfsChanges(rootfs string, lowerDirs []string) ([]Change, error) {
+	var changes []Change
+
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		containerPath := strings.TrimSuffix("/"+filepath.ToSlash(rel), "/.")
+
+		lower := lowerInfo(lowerDirs, rel)
+		switch {
+		case rel == ".":
+			// The root itself only matters for what was deleted from it
+			lower = info
+		case lower == nil:
+			changes = append(changes, Change{Kind: ChangeAdd, Path: containerPath})
+		case !sameFile(path, info, lowerPath(lowerDirs, rel), lower):
+			changes = append(changes, Change{Kind: ChangeModify, Path: containerPath})
+		}
+
+		// Entries the lower layers had in this directory are gone
+		if info.IsDir() && lower != nil && lower.IsDir() {
+			for _, name := range lowerEntries(lowerDirs, rel) {
+				if _, err := os.Lstat(filepath.Join(path, name)); os.IsNotExist(err) {
+					changes = append(changes, Change{Kind: ChangeDelete, Path: containerPath + "/" + name})
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// sameFile reports whether a file is unchanged from its lower version.
+// Mtimes are compared to the second, the precision layer tarballs keep.
+func sameFile(path string, info os.FileInfo, lowerPath string, lower os.FileInfo) bool {
+	if info.Mode() != lower.Mode() {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	lowerStat, lowerOk := lower.Sys().(*syscall.Stat_t)
+	if !ok || !lowerOk || stat.Uid != lowerStat.Uid || stat.Gid != lowerStat.Gid || stat.Rdev != lowerStat.Rdev {
+		return false
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		lowerTarget, lowerErr := os.Readlink(lowerPath)
+		return err == nil && lowerErr == nil && target == lowerTarget
+	}
+
+	if !info.IsDir() && info.Size() != lower.Size() {
+		return false
+	}
+	return info.ModTime().Unix() == lower.ModTime().Unix()
+}
+
+// existsInLower reports whether a path is visible in the merged lower layers
+func existsInLower(lowerDirs []string, rel string) bool {
+	return lowerInfo(lowerDirs, rel) != nil
+}
+
+// lowerInfo returns the file a path refers to in the merged lower layers,
+// or nil if it is not visible there
+func lowerInfo(lowerDirs []string, rel string) os.FileInfo {
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		if info, err := os.Lstat(filepath.Join(lowerDirs[i], rel)); err == nil {
+			if layer.IsWhiteout(info) {
+				return nil
+			}
+			return info
+		}
+		if hidesBelow(lowerDirs[i], rel) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// lowerPath returns where the visible lower version of a path is stored
+func lowerPath(lowerDirs []string, rel string) string {
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		path := filepath.Join(lowerDirs[i], rel)
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// lowerEntries lists the names visible in a directory of the merged lower layers
+func lowerEntries(lowerDirs []string, rel string) []string {
+	seen := make(map[string]bool)
+	var names []string
+
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		dir := filepath.Join(lowerDirs[i], rel)
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if seen[entry.Name()] {
+				continue
+			}
+			seen[entry.Name()] = true
+			if info, err := entry.Info(); err == nil && !layer.IsWhiteout(info) {
+				names = append(names, entry.Name())
+			}
+		}
+		if layer.IsOpaque(dir) || hidesBelow(lowerDirs[i], rel) {
+			break
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// hidesBelow reports whether a layer has an opaque directory, a whiteout
+// or a file above rel, so that layers further down cannot contribute it
+func hidesBelow(layerDir, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		path := filepath.Join(layerDir, dir)
+		if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+			return true
+		}
+		if layer.IsOpaque(path) {
+			return true
+		}
+	}
+	return false
+}
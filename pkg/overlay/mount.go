@@ -0,0 +1,326 @@
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The new mount API (Linux 5.2). Its syscalls have the same numbers on
+// every architecture.
+const (
+	sysMoveMount = 429
+	sysFsopen    = 430
+	sysFsconfig  = 431
+	sysFsmount   = 432
+
+	fsopenCloexec       = 0x1
+	fsconfigSetString   = 1
+	fsconfigCmdCreate   = 6
+	fsmountCloexec      = 0x1
+	moveMountFEmptyPath = 0x4
+	atFdcwd             = -100
+)
+
+// linkDir holds short symlinks to lower directories, so that mount(2)
+// options for many layers fit in a page
+const linkDir = "l"
+
+// errMountAPI means the kernel can't mount overlays with fsopen and
+// lowerdir+ (added in Linux 6.8)
+var errMountAPI = errors.New("new mount API not supported")
+
+// mountOverlay mounts an overlay at target. lowerDirs are listed top first.
+func mountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	err := fsmountOverlay(lowerDirs, upperDir, workDir, target)
+	if errors.Is(err, errMountAPI) {
+		err = legacyMountOverlay(lowerDirs, upperDir, workDir, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ok, err := isMounted(target); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("overlay mount at %s is missing from the mount table", target)
+	}
+	return nil
+}
+
+// fsmountOverlay passes every lower directory as its own lowerdir+
+// parameter, which has no limit on the number of layers
+func fsmountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	fsname, _ := syscall.BytePtrFromString("overlay")
+	fd, _, errno := syscall.Syscall(sysFsopen, uintptr(unsafe.Pointer(fsname)), fsopenCloexec, 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS || errno == syscall.EPERM {
+			return errMountAPI
+		}
+		return fmt.Errorf("fsopen overlay failed: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	params := [][2]string{{"source", "overlay"}}
+	for _, dir := range lowerDirs {
+		params = append(params, [2]string{"lowerdir+", dir})
+	}
+	params = append(params, [2]string{"upperdir", upperDir}, [2]string{"workdir", workDir})
+
+	for _, param := range params {
+		if err := fsconfig(int(fd), fsconfigSetString, param[0], param[1]); err != nil {
+			if param[0] == "lowerdir+" && err == syscall.EINVAL {
+				return errMountAPI
+			}
+			return fmt.Errorf("overlay %s=%s: %v%s", param[0], param[1], err, fsLog(int(fd)))
+		}
+	}
+	if err := fsconfig(int(fd), fsconfigCmdCreate, "", ""); err != nil {
+		return fmt.Errorf("overlay mount failed: %v%s", err, fsLog(int(fd)))
+	}
+
+	mfd, _, errno := syscall.Syscall(sysFsmount, fd, fsmountCloexec, 0)
+	if errno != 0 {
+		return fmt.Errorf("fsmount overlay failed: %v", errno)
+	}
+	defer syscall.Close(int(mfd))
+
+	empty, _ := syscall.BytePtrFromString("")
+	path, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFdcwd
+	_, _, errno = syscall.Syscall6(sysMoveMount, mfd, uintptr(unsafe.Pointer(empty)), uintptr(fdcwd), uintptr(unsafe.Pointer(path)), moveMountFEmptyPath, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to attach overlay at %s: %v", target, errno)
+	}
+	return nil
+}
+
+func fsconfig(fd, cmd int, key, value string) error {
+	var k, v *byte
+	var err error
+	if key != "" {
+		if k, err = syscall.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+	if value != "" {
+		if v, err = syscall.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+
+	_, _, errno := syscall.Syscall6(sysFsconfig, uintptr(fd), uintptr(cmd), uintptr(unsafe.Pointer(k)), uintptr(unsafe.Pointer(v)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fsLog returns the messages the kernel left on a filesystem context
+func fsLog(fd int) string {
+	var messages []string
+	buf := make([]byte, 1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil || n <= 0 {
+			break
+		}
+		messages = append(messages, strings.TrimSpace(string(buf[:n])))
+	}
+	if len(messages) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(messages, "; ") + ")"
+}
+
+// legacyMountOverlay mounts with mount(2). Lower directories are given as
+// short symlinks relative to the overlay directory, which the mount runs in.
+func legacyMountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	links := make([]string, len(lowerDirs))
+	for i, dir := range lowerDirs {
+		link, err := shortLink(dir)
+		if err != nil {
+			return err
+		}
+		links[i] = link
+	}
+
+	upper, err := filepath.Rel(overlayBasePath(), upperDir)
+	if err != nil {
+		return err
+	}
+	work, err := filepath.Rel(overlayBasePath(), workDir)
+	if err != nil {
+		return err
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(links, ":"), upper, work)
+	if len(options) >= os.Getpagesize() {
+		return fmt.Errorf("overlay mount failed: too many layers (%d) for mount options", len(lowerDirs))
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(overlayBasePath()); err != nil {
+		return err
+	}
+	defer os.Chdir(cwd)
+
+	if err := syscall.Mount("overlay", target, "overlay", 0, options); err != nil {
+		return fmt.Errorf("overlay mount failed: %v", err)
+	}
+	return nil
+}
+
+// shortLink returns l/<name>, a symlink to dir under the overlay directory
+func shortLink(dir string) (string, error) {
+	sum := sha256.Sum256([]byte(dir))
+	name := filepath.Join(linkDir, base32.StdEncoding.EncodeToString(sum[:])[:12])
+	path := filepath.Join(overlayBasePath(), name)
+
+	if target, err := os.Readlink(path); err == nil && target == dir {
+		return name, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(overlayBasePath(), linkDir), 0755); err != nil {
+		return "", err
+	}
+	os.Remove(path)
+	if err := os.Symlink(dir, path); err != nil {
+		return "", fmt.Errorf("failed to link %s: %v", dir, err)
+	}
+	return name, nil
+}
+
+// Unmount detaches everything mounted at target, lazily if it is busy, and
+// confirms with the mount table that nothing is left
+func Unmount(target string) error {
+	for i := 0; i < 16; i++ {
+		ok, err := isMounted(target)
+		if err != nil || !ok {
+			return err
+		}
+
+		err = syscall.Unmount(target, 0)
+		if err == syscall.EBUSY {
+			err = syscall.Unmount(target, syscall.MNT_DETACH)
+		}
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to unmount %s: %v", target, err)
+		}
+	}
+	return fmt.Errorf("failed to unmount %s: still mounted", target)
+}
+
+// BindMount mounts source at target, read-only if asked. MS_RDONLY is
+// ignored when a bind mount is created, so that takes a remount.
+func BindMount(source, target string, readOnly bool) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s at %s: %v", source, target, err)
+	}
+	if !readOnly {
+		return nil
+	}
+	if err := RemountReadOnly(target, true); err != nil {
+		Unmount(target)
+		return err
+	}
+	return nil
+}
+
+// RemountReadOnly makes the mount at target read-only. bind must be set
+// for a bind mount, which only changes that mount and not the filesystem.
+func RemountReadOnly(target string, bind bool) error {
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	if bind {
+		flags |= syscall.MS_BIND
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s read-only: %v", target, err)
+	}
+	return nil
+}
+
+// MountPointsUnder returns what is mounted at or below dir, deepest first
+func MountPointsUnder(dir string) ([]string, error) {
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var under []string
+	for _, mountPoint := range mountPoints {
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+"/") {
+			under = append(under, mountPoint)
+		}
+	}
+	sort.Slice(under, func(i, j int) bool {
+		return len(under[i]) > len(under[j])
+	})
+	return under, nil
+}
+
+// isMounted reports whether something is mounted at path
+func isMounted(path string) (bool, error) {
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		return false, err
+	}
+
+	for _, mountPoint := range mountPoints {
+		if mountPoint == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readMountPoints returns the mount points of the mount table
+func readMountPoints() ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var mountPoints []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 {
+			mountPoints = append(mountPoints, unescapeMountPath(fields[4]))
+		}
+	}
+	return mountPoints, nil
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space) of mountinfo paths
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -3,12 +3,14 @@ package overlay
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
-const overlayBasePath = "/var/lib/minidocker/overlay"
+
+func overlayBasePath() string { return store.Path("overlay") }
 
 type OverlayMount struct {
 	ContainerID string
@@ -18,14 +20,41 @@ type OverlayMount struct {
 	MergedDir string // Final merged view
 }
 
-// CreateOverlay sets up an overlay filesystem for a container
-func CreateOverlay(containerID string, layerPaths []string) (*OverlayMount, error) {
+// CreateOverlay sets up an overlay filesystem for a container on top of
+// the given layers, bottom first. Compressed layers are extracted first.
+func CreateOverlay(containerID string, layerIDs []string) (*OverlayMount, error) {
+	layerPaths, err := layer.Acquire(containerID, layerIDs)
+	if err != nil {
+		layer.Release(containerID)
+		return nil, err
+	}
+
+	overlay, err := CreateOverlayFromDirs(containerID, layerPaths)
+	if err != nil {
+		layer.Release(containerID)
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// CreateOverlayFromDirs sets up an overlay filesystem for a container on
+// top of the given read-only directories, bottom first
+func CreateOverlayFromDirs(containerID string, layerPaths []string) (*OverlayMount, error) {
+	// Overlay needs at least one lower directory, even for FROM scratch
+	if len(layerPaths) == 0 {
+		emptyDir := filepath.Join(overlayBasePath(), containerID, "empty")
+		if err := os.MkdirAll(emptyDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create a directory %s: %v", emptyDir, err)
+		}
+		layerPaths = []string{emptyDir}
+	}
+
 	overlay := &OverlayMount{
 		ContainerID: containerID,
 		LowerDirs: layerPaths,
-		UpperDir: filepath.Join(overlayBasePath, containerID, "diff"),
-		WorkDir: filepath.Join(overlayBasePath, containerID, "work"),
-		MergedDir: filepath.Join(overlayBasePath, containerID, "merged"),
+		UpperDir: filepath.Join(overlayBasePath(), containerID, "diff"),
+		WorkDir: filepath.Join(overlayBasePath(), containerID, "work"),
+		MergedDir: filepath.Join(overlayBasePath(), containerID, "merged"),
 	}
 
 	// Create directories
@@ -45,56 +74,44 @@ func CreateOverlay(containerID string, layerPaths []string) (*OverlayMount, erro
 
 // Mount performs the overlay mount
 func (o *OverlayMount) Mount() error {
-	// Build lowerdir string (reverse order: top layer first)
-	// OverlayFS reads from left to right, so we reverse our layer order
+	// OverlayFS stacks lower directories top first, so reverse our layer order
 	reversedLayers := make([]string, len(o.LowerDirs))
 	for i, layer := range o.LowerDirs {
 		reversedLayers[len(o.LowerDirs)-1-i] = layer
 	}
-	lowerdir := strings.Join(reversedLayers, ":")
-
-	// Build mount options
-	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, o.UpperDir, o.WorkDir)
-
-	// Execute mount command
-	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, o.MergedDir)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("overlay mount failed: %v, output: %s", err, string(output))
-	}
 
-	return nil
+	return mountOverlay(reversedLayers, o.UpperDir, o.WorkDir, o.MergedDir)
 }
 
 // Unmount unmounts the overlay filesystem
 func (o *OverlayMount) Unmount() error {
-	cmd := exec.Command("unmount", o.MergedDir)
-	if err := cmd.Run(); err != nil {
-		cmd = exec.Command("unmount", "-l", o.MergedDir)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to unmount overlay: %v", err)
-		}
+	if err := Unmount(o.MergedDir); err != nil {
+		return fmt.Errorf("failed to unmount overlay: %v", err)
 	}
-
 	return nil
 }
 
-// Cleanup removes overlay directories
+// Cleanup removes overlay directories and releases the container's layers.
+// Nothing is removed while the overlay is still mounted.
 func (o *OverlayMount) Cleanup() error {
-	o.Unmount()
+	if err := o.Unmount(); err != nil {
+		return err
+	}
 
-	overlayDir := filepath.Join(overlayBasePath, o.ContainerID)
-	return os.RemoveAll(overlayDir)
+	overlayDir := filepath.Join(overlayBasePath(), o.ContainerID)
+	if err := os.RemoveAll(overlayDir); err != nil {
+		return err
+	}
+	return layer.Release(o.ContainerID)
 }
 
 // GetOverlay retreives overlay configurations for a container
 func GetOverlay(containerID string) *OverlayMount {
 	return &OverlayMount{
 		ContainerID: containerID,
-		UpperDir: filepath.Join(overlayBasePath, containerID, "diff"),
-		WorkDir: filepath.Join(overlayBasePath, containerID, "work"),
-		MergedDir: filepath.Join(overlayBasePath, containerID, "merged"),
+		UpperDir: filepath.Join(overlayBasePath(), containerID, "diff"),
+		WorkDir: filepath.Join(overlayBasePath(), containerID, "work"),
+		MergedDir: filepath.Join(overlayBasePath(), containerID, "merged"),
 	}
 }
 
@@ -103,3 +120,22 @@ func CleanupOverlay(containerID string) error {
 	overlay := GetOverlay(containerID)
 	return overlay.Cleanup()
 }
+
+// ListOverlays returns the IDs of the containers that have an overlay
+func ListOverlays() ([]string, error) {
+	entries, err := os.ReadDir(overlayBasePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != linkDir {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
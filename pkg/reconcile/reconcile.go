@@ -0,0 +1,312 @@
+package reconcile
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/cgroup"
+	"github.com/jagjeet-singh-23/minidocker/pkg/container"
+	"github.com/jagjeet-singh-23/minidocker/pkg/network"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/snapshot"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+const (
+	// startupGrace covers a container another invocation is still starting
+	startupGrace = time.Minute
+
+	// staleSnapshotAge is how old a root filesystem without a container must
+	// be before it is removed; builds keep theirs for as long as a step runs
+	staleSnapshotAge = time.Hour
+
+	// lostExitCode is recorded for containers whose exit status was lost
+	lostExitCode = 255
+
+	// clockTicks is USER_HZ, the unit of process start times in /proc
+	clockTicks = 100
+)
+
+// Run brings the recorded state in line with the host after a crash or a
+// reboot: containers whose process is gone are marked exited and torn
+// down, and root filesystems, veths and cgroups nobody owns are removed.
+// Each repair is logged to stderr.
+func Run() error {
+	// Another invocation is already at it
+	lock, err := store.TryAcquire("reconcile")
+	if lock == nil {
+		return err
+	}
+	defer lock.Release()
+
+	containers, err := container.ListContainers()
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]*container.Container)
+	for _, c := range containers {
+		byID[c.ID] = c
+		if isDead(c) {
+			teardown(c)
+		}
+	}
+
+	removeSnapshots(byID)
+	removeVeths(containers)
+	removeCgroups(byID)
+	releaseIPs(byID)
+	return nil
+}
+
+// isDead reports whether a container recorded as running or stopping has
+// no process anymore
+func isDead(c *container.Container) bool {
+	if c.State != container.StateRunning && c.State != container.StateStopped {
+		return false
+	}
+	if c.PID == 0 {
+		// Running without a PID only while run is starting it
+		return c.State == container.StateRunning && time.Since(c.Started) > startupGrace
+	}
+
+	// The PID may have been reused since, by a process started much later
+	started, err := processStartTime(c.PID)
+	if err != nil {
+		return true
+	}
+	return started.Before(c.Started.Add(-2*time.Second)) || started.After(c.Started.Add(startupGrace))
+}
+
+// teardown releases what a dead container held and records that it exited
+func teardown(c *container.Container) {
+	ip := strings.Split(c.IPAddress, "/")[0]
+	if ip != "" {
+		for _, port := range c.Ports {
+			network.RemovePortForwarding(port.HostPort, port.ContainerPort, ip, port.Protocol)
+		}
+	}
+	if err := network.CleanupContainerNetwork(c.VethHost); err != nil {
+		warnf("container %s: %v", container.ShortID(c.ID), err)
+	}
+	if c.NetworkMode != "" && c.NetworkMode != network.NoNetwork {
+		network.ReleaseIP(c.NetworkMode, c.ID)
+	}
+	for name, endpoint := range c.Networks {
+		if err := network.CleanupContainerNetwork(endpoint.VethHost); err != nil {
+			warnf("container %s: %v", container.ShortID(c.ID), err)
+		}
+		network.ReleaseIP(name, c.ID)
+	}
+
+	// Volumes are mounted below the root filesystem, which stays for commit
+	if c.Rootfs != "" {
+		mountPoints, _ := overlay.MountPointsUnder(c.Rootfs)
+		for _, mountPoint := range mountPoints {
+			if mountPoint != c.Rootfs {
+				overlay.Unmount(mountPoint)
+			}
+		}
+	}
+	cgroup.RemoveCgroup(c.ID)
+
+	id, pid := c.ID, c.PID
+	c, err := container.UpdateContainer(id, func(c *container.Container) error {
+		if c.State == container.StateRunning {
+			c.State = container.StateExited
+			c.ExitCode = lostExitCode
+		}
+		c.Finished = time.Now()
+		c.PID = 0
+		c.IPAddress = ""
+		c.VethHost = ""
+		c.Networks = nil
+		return nil
+	})
+	if err != nil {
+		warnf("container %s: %v", container.ShortID(id), err)
+		return
+	}
+
+	if pid > 0 {
+		logf("container %s: process %d is no longer running, marked %s", container.ShortID(c.ID), pid, c.State)
+	} else {
+		logf("container %s: never started, marked %s", container.ShortID(c.ID), c.State)
+	}
+}
+
+// removeSnapshots removes old root filesystems of containers that no longer exist
+func removeSnapshots(byID map[string]*container.Container) {
+	for _, driver := range snapshot.Drivers {
+		snapshotter, err := snapshot.Get(driver)
+		if err != nil {
+			continue
+		}
+		keys, err := snapshotter.List()
+		if err != nil {
+			continue
+		}
+
+		for key, created := range keys {
+			if byID[key] != nil || time.Since(created) < staleSnapshotAge {
+				continue
+			}
+			if err := snapshotter.Remove(key); err != nil {
+				warnf("leftover %s root filesystem %s: %v", driver, key, err)
+				continue
+			}
+			logf("removed leftover %s root filesystem %s", driver, key)
+		}
+	}
+}
+
+// removeVeths deletes veths whose setup was interrupted
+func removeVeths(containers []*container.Container) {
+	veths, err := network.DanglingVeths()
+	if err != nil {
+		return
+	}
+
+	for _, veth := range veths {
+		owned := false
+		for _, c := range containers {
+			if c.VethHost == veth {
+				owned = true
+			}
+			for _, endpoint := range c.Networks {
+				if endpoint.VethHost == veth {
+					owned = true
+				}
+			}
+		}
+		if owned {
+			continue
+		}
+
+		if err := network.CleanupContainerNetwork(veth); err != nil {
+			warnf("leftover veth %s: %v", veth, err)
+			continue
+		}
+		logf("removed leftover veth %s", veth)
+	}
+}
+
+// removeCgroups removes the cgroups of containers that are not running
+func removeCgroups(byID map[string]*container.Container) {
+	ids, err := cgroup.ListCgroups()
+	if err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		if c := byID[id]; c != nil {
+			if c.State == container.StateRunning {
+				continue
+			}
+			// run creates the cgroup before starting the container
+			if c.State == container.StateCreated && time.Since(c.Created) < startupGrace {
+				continue
+			}
+		}
+
+		// A cgroup with processes left can't be removed, and is not ours to kill
+		if err := cgroup.RemoveCgroup(id); err != nil {
+			continue
+		}
+		logf("removed leftover cgroup minidocker-%s", id)
+	}
+}
+
+// releaseIPs frees addresses held by containers that are not running
+func releaseIPs(byID map[string]*container.Container) {
+	networks, err := network.AllocatedNetworks()
+	if err != nil {
+		return
+	}
+
+	for _, name := range networks {
+		allocations, err := network.Allocations(name)
+		if err != nil {
+			warnf("network %s: %v", name, err)
+			continue
+		}
+
+		for ip, a := range allocations {
+			// run allocates the address shortly before writing the container record
+			if time.Since(a.Allocated) < startupGrace {
+				continue
+			}
+
+			id := a.ContainerID
+			if c := byID[id]; c != nil {
+				if c.State == container.StateRunning || c.State == container.StateStopped {
+					continue
+				}
+				// run allocates the address before starting the container
+				if c.State == container.StateCreated && time.Since(c.Created) < startupGrace {
+					continue
+				}
+			}
+
+			if err := network.ReleaseIP(name, id); err != nil {
+				warnf("network %s: %v", name, err)
+				continue
+			}
+			logf("released IP %s of container %.12s on network %s", ip, id, name)
+		}
+	}
+}
+
+// processStartTime returns when a process started
+func processStartTime(pid int) (time.Time, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The command name may contain spaces; starttime is the 20th field after it
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// bootTime returns when the host booted
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Repaired: "+format+"\n", args...)
+}
+
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", args...)
+}
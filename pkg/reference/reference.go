@@ -0,0 +1,152 @@
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultDomain = "docker.io"
+	DefaultTag    = "latest"
+
+	legacyDefaultDomain = "index.docker.io"
+	officialRepoPrefix  = "library/"
+)
+
+var (
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference is a parsed image reference: [domain/]path[:tag][@digest]
+type Reference struct {
+	Domain string // Registry host, e.g. docker.io or localhost:5000
+	Path   string // Repository path, e.g. library/ubuntu
+	Tag    string
+	Digest string // sha256:<hex>
+}
+
+// Parse parses an image reference, normalizing it the way Docker does.
+// A reference without tag or digest gets the "latest" tag.
+func Parse(s string) (*Reference, error) {
+	if s == "" {
+		return nil, fmt.Errorf("invalid reference: empty string")
+	}
+
+	remainder := s
+	ref := &Reference{}
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return nil, fmt.Errorf("invalid reference %q: bad digest %q", s, ref.Digest)
+		}
+	}
+
+	// A colon after the last slash separates the tag (a colon before it is a port)
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid reference %q: bad tag %q", s, ref.Tag)
+		}
+	}
+
+	ref.Domain, ref.Path = splitDomain(remainder)
+
+	for _, component := range strings.Split(ref.Path, "/") {
+		if !componentRegexp.MatchString(component) {
+			return nil, fmt.Errorf("invalid reference %q: repository name must be lowercase alphanumeric", s)
+		}
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+
+	return ref, nil
+}
+
+// ValidateDigest checks that a digest is a well-formed sha256 digest. Digests
+// from a registry end up in file names, so they are checked before any use.
+func ValidateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+// splitDomain separates the registry host from the repository path
+func splitDomain(name string) (string, string) {
+	domain, path := DefaultDomain, name
+
+	i := strings.Index(name, "/")
+	if i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			domain, path = first, name[i+1:]
+		}
+	}
+
+	if domain == legacyDefaultDomain {
+		domain = DefaultDomain
+	}
+	if domain == DefaultDomain && !strings.Contains(path, "/") {
+		path = officialRepoPrefix + path
+	}
+
+	return domain, path
+}
+
+// Name returns the fully qualified repository name (domain/path)
+func (r *Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// FamiliarName returns the short repository name, e.g. "ubuntu" for docker.io/library/ubuntu
+func (r *Reference) FamiliarName() string {
+	if r.Domain != DefaultDomain {
+		return r.Name()
+	}
+	return strings.TrimPrefix(r.Path, officialRepoPrefix)
+}
+
+// String returns the fully qualified reference
+func (r *Reference) String() string {
+	return r.Name() + r.suffix()
+}
+
+// FamiliarString returns the short form of the reference, as shown to users
+func (r *Reference) FamiliarString() string {
+	return r.FamiliarName() + r.suffix()
+}
+
+func (r *Reference) suffix() string {
+	s := ""
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// RegistryHost returns the host to contact for the reference's domain
+func (r *Reference) RegistryHost() string {
+	if r.Domain == DefaultDomain {
+		return "registry-1.docker.io"
+	}
+	return r.Domain
+}
+
+// ManifestReference returns the digest if present, otherwise the tag
+func (r *Reference) ManifestReference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
@@ -0,0 +1,210 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+const downloadRetries = 3
+
+// downloadBasePath holds blobs while they are downloaded
+func downloadBasePath() string { return store.Path("downloads") }
+
+// GetManifest fetches a manifest by tag or digest and returns it with its digest
+func (c *Client) GetManifest(repository, ref string) (*Manifest, string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(fmt.Sprintf("/v2/%s/manifests/%s", repository, ref)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+
+	resp, err := c.do(req, repositoryScope(repository, "pull"))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, "", fmt.Errorf("failed to fetch manifest %s:%s: %v", repository, ref, err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest := digestBytes(data)
+	if strings.HasPrefix(ref, "sha256:") && digest != ref {
+		return nil, "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", ref, digest)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	}
+	if manifest.SchemaVersion != 2 {
+		return nil, "", fmt.Errorf("unsupported manifest schema version %d", manifest.SchemaVersion)
+	}
+
+	return &manifest, digest, nil
+}
+
+// GetBlob fetches a small blob (such as an image config) into memory and verifies it
+func (c *Client) GetBlob(repository, digest string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(fmt.Sprintf("/v2/%s/blobs/%s", repository, digest)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req, repositoryScope(repository, "pull"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, fmt.Errorf("failed to fetch blob %s: %v", digest, err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if got := digestBytes(data); got != digest {
+		return nil, fmt.Errorf("blob digest mismatch: expected %s, got %s", digest, got)
+	}
+
+	return data, nil
+}
+
+// DownloadBlob downloads a blob to the download cache and returns the
+// path of the verified file. Interrupted downloads resume with a Range request.
+func (c *Client) DownloadBlob(repository string, desc Descriptor) (string, error) {
+	if err := reference.ValidateDigest(desc.Digest); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(downloadBasePath(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %v", err)
+	}
+
+	hexDigest := strings.TrimPrefix(desc.Digest, "sha256:")
+	partialPath := filepath.Join(downloadBasePath(), hexDigest+".partial")
+	completePath := filepath.Join(downloadBasePath(), hexDigest)
+
+	if _, err := os.Stat(completePath); err == nil {
+		if verifyFile(completePath, desc.Digest) == nil {
+			return completePath, nil
+		}
+		os.Remove(completePath)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= downloadRetries; attempt++ {
+		if err := c.fetchRange(repository, desc, partialPath); err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := verifyFile(partialPath, desc.Digest); err != nil {
+			// Corrupt data can't be resumed, start over
+			os.Remove(partialPath)
+			lastErr = err
+			continue
+		}
+
+		if err := os.Rename(partialPath, completePath); err != nil {
+			return "", err
+		}
+		return completePath, nil
+	}
+
+	return "", fmt.Errorf("failed to download %s after %d attempts: %v", desc.Digest, downloadRetries, lastErr)
+}
+
+// fetchRange appends the missing part of a blob to the partial file
+func (c *Client) fetchRange(repository string, desc Descriptor, partialPath string) error {
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.url(fmt.Sprintf("/v2/%s/blobs/%s", repository, desc.Digest)), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.do(req, repositoryScope(repository, "pull"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Server ignored the range, start from scratch
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partialPath)
+		return fmt.Errorf("registry rejected resume range for %s", desc.Digest)
+	default:
+		return checkResponse(resp, http.StatusOK, http.StatusPartialContent)
+	}
+
+	file, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return fmt.Errorf("download of %s interrupted: %v", desc.Digest, err)
+	}
+
+	return nil
+}
+
+// verifyFile checks the sha256 digest of a file
+func verifyFile(path, digest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, got)
+	}
+	return nil
+}
+
+func digestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,297 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to a single Docker Registry HTTP API v2 endpoint
+type Client struct {
+	Host       string // Registry host[:port]
+	Scheme     string // https, or http for insecure registries
+	HTTPClient *http.Client
+	Auth       *AuthConfig // Optional credentials for token and basic auth
+
+	mu     sync.Mutex
+	tokens map[string]string // Bearer tokens keyed by scope
+	basic  bool              // Registry asked for basic auth instead of tokens
+}
+
+// NewClient creates a registry client. Plain HTTP is used for insecure
+// registries and for registries on the loopback interface.
+func NewClient(host string, insecure bool) *Client {
+	scheme := "https"
+	if insecure || isLoopback(host) {
+		scheme = "http"
+	}
+
+	return &Client{
+		Host:       host,
+		Scheme:     scheme,
+		HTTPClient: &http.Client{Timeout: 30 * time.Minute},
+		tokens:     make(map[string]string),
+	}
+}
+
+func isLoopback(host string) bool {
+	hostname := host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:i]
+	}
+	hostname = strings.Trim(hostname, "[]")
+	return hostname == "localhost" || hostname == "::1" || strings.HasPrefix(hostname, "127.")
+}
+
+// url builds an absolute URL for an API path such as /v2/<name>/manifests/<ref>
+func (c *Client) url(path string) string {
+	return fmt.Sprintf("%s://%s%s", c.Scheme, c.Host, path)
+}
+
+// resolveLocation turns an upload Location header into an absolute URL
+func (c *Client) resolveLocation(location string) (string, error) {
+	base, err := url.Parse(c.url("/"))
+	if err != nil {
+		return "", err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid location %q: %v", location, err)
+	}
+	return base.ResolveReference(loc).String(), nil
+}
+
+// do sends a request, answering a bearer token challenge once if the registry asks for one
+func (c *Client) do(req *http.Request, scope string) (*http.Response, error) {
+	c.authorize(req, scope)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err := c.handleChallenge(challenge, scope); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("registry requested authentication for a non-replayable request")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	c.authorize(retry, scope)
+
+	return c.HTTPClient.Do(retry)
+}
+
+// authorize attaches a cached token for the scope, or basic credentials, if there are any
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	token, ok := c.tokens[scope]
+	basic := c.basic
+	c.mu.Unlock()
+
+	if ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basic && c.Auth != nil {
+		req.SetBasicAuth(c.Auth.Username, c.Auth.Password)
+	}
+}
+
+// handleChallenge fetches a bearer token as described by a WWW-Authenticate header
+func (c *Client) handleChallenge(header, scope string) error {
+	scheme, params := parseChallenge(header)
+	if strings.EqualFold(scheme, "basic") {
+		if c.Auth == nil {
+			return fmt.Errorf("unauthorized: registry requires credentials, run 'minidocker login %s'", c.Host)
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	}
+	if !strings.EqualFold(scheme, "bearer") {
+		return fmt.Errorf("unauthorized: unsupported authentication scheme %q", scheme)
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("unauthorized: bearer challenge without realm")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	// Ask for the scope the registry named plus ours (e.g. pull on a mount source)
+	seen := make(map[string]bool)
+	for _, s := range strings.Fields(params["scope"] + " " + scope) {
+		if !seen[s] {
+			seen[s] = true
+			query.Add("scope", s)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Auth != nil {
+		req.SetBasicAuth(c.Auth.Username, c.Auth.Password)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		if c.Auth == nil {
+			return fmt.Errorf("unauthorized: authentication required, run 'minidocker login %s'", c.Host)
+		}
+		return fmt.Errorf("unauthorized: incorrect username or password")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("invalid token response: %v", err)
+	}
+
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("token response did not contain a token")
+	}
+
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Ping checks that the endpoint speaks the v2 API and that the client's credentials are accepted
+func (c *Client) Ping() error {
+	req, err := http.NewRequest(http.MethodGet, c.url("/v2/"), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("unauthorized: incorrect username or password")
+	}
+	return checkResponse(resp, http.StatusOK)
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and parameters
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+
+	header = strings.TrimSpace(header)
+	i := strings.Index(header, " ")
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted values may contain commas, e.g. scope="repository:a:pull,push"
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(rest[1:min(end, len(rest))], `\"`, `"`)
+			rest = rest[min(end+1, len(rest)):]
+		} else {
+			comma := strings.Index(rest, ",")
+			if comma < 0 {
+				comma = len(rest)
+			}
+			value = strings.TrimSpace(rest[:comma])
+			rest = rest[comma:]
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+// repositoryScope returns the token scope for an action on a repository
+func repositoryScope(repository string, actions ...string) string {
+	return fmt.Sprintf("repository:%s:%s", repository, strings.Join(actions, ","))
+}
+
+// checkResponse turns an unexpected status into an error carrying the registry's message
+func checkResponse(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var regErr struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &regErr) == nil && len(regErr.Errors) > 0 {
+		return fmt.Errorf("%s: %s (%s)", resp.Status, regErr.Errors[0].Message, regErr.Errors[0].Code)
+	}
+
+	return fmt.Errorf("unexpected response from %s: %s", resp.Request.URL.Path, resp.Status)
+}
@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+const (
+	configDirName  = ".minidocker"
+	configFileName = "config.json"
+
+	// Docker Hub credentials are stored under its legacy index address
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+)
+
+// AuthConfig holds the credentials for one registry
+type AuthConfig struct {
+	Username string
+	Password string
+}
+
+// authEntry is the Docker-compatible per-registry entry in config.json
+type authEntry struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"` // Older Docker clients store these instead of auth
+	Password string `json:"password,omitempty"`
+}
+
+// credentialFile mirrors the parts of Docker's config.json we use.
+// Unknown top-level keys, and the entries of registries we don't log in
+// to, such as ones holding an identitytoken, are written back unchanged.
+type credentialFile struct {
+	Auths       map[string]json.RawMessage `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+
+	raw map[string]json.RawMessage
+}
+
+// ConfigPath returns the location of the client credential file
+func ConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine home directory: %v", err)
+	}
+	return filepath.Join(home, configDirName, configFileName), nil
+}
+
+// authKey returns the config.json key for a registry domain
+func authKey(domain string) string {
+	if domain == reference.DefaultDomain {
+		return dockerHubAuthKey
+	}
+	return domain
+}
+
+func loadCredentialFile() (*credentialFile, error) {
+	cf := &credentialFile{
+		Auths:       make(map[string]json.RawMessage),
+		CredHelpers: make(map[string]string),
+		raw:         make(map[string]json.RawMessage),
+	}
+
+	path, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cf.raw); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, cf); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if cf.Auths == nil {
+		cf.Auths = make(map[string]json.RawMessage)
+	}
+
+	return cf, nil
+}
+
+func (cf *credentialFile) save() error {
+	path, err := ConfigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	auths, _ := json.Marshal(cf.Auths)
+	cf.raw["auths"] = auths
+	if cf.CredsStore != "" {
+		credsStore, _ := json.Marshal(cf.CredsStore)
+		cf.raw["credsStore"] = credsStore
+	}
+
+	data, err := json.MarshalIndent(cf.raw, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// The file is replaced atomically, so a file readable by others before
+	// ends up 0600 as well
+	return store.WriteFile(path, data, 0600)
+}
+
+// auth returns the entry stored for a registry
+func (cf *credentialFile) auth(key string) (authEntry, error) {
+	var entry authEntry
+	if data, ok := cf.Auths[key]; ok {
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return entry, fmt.Errorf("invalid stored credentials for %s: %v", key, err)
+		}
+	}
+	return entry, nil
+}
+
+// setAuth replaces the entry for one registry
+func (cf *credentialFile) setAuth(key string, entry authEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	cf.Auths[key] = data
+	return nil
+}
+
+// helperFor returns the credential helper configured for a registry, if any
+func (cf *credentialFile) helperFor(key string) string {
+	if helper, ok := cf.CredHelpers[key]; ok {
+		return helper
+	}
+	return cf.CredsStore
+}
+
+// LoadCredentials returns the stored credentials for a registry domain, or nil if there are none
+func LoadCredentials(domain string) (*AuthConfig, error) {
+	cf, err := loadCredentialFile()
+	if err != nil {
+		return nil, err
+	}
+
+	key := authKey(domain)
+	if helper := cf.helperFor(key); helper != "" {
+		return helperGet(helper, key)
+	}
+
+	entry, err := cf.auth(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Auth == "" {
+		if entry.Username == "" {
+			return nil, nil
+		}
+		return &AuthConfig{Username: entry.Username, Password: entry.Password}, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stored credentials for %s: %v", domain, err)
+	}
+
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid stored credentials for %s", domain)
+	}
+
+	return &AuthConfig{Username: user, Password: pass}, nil
+}
+
+// SaveCredentials stores credentials for a registry domain, using a credential helper when one is configured
+func SaveCredentials(domain string, auth *AuthConfig) error {
+	cf, err := loadCredentialFile()
+	if err != nil {
+		return err
+	}
+
+	key := authKey(domain)
+	if helper := cf.helperFor(key); helper != "" {
+		if err := helperStore(helper, key, auth); err != nil {
+			return err
+		}
+		// Keep an empty entry so the registry shows up as logged in, like Docker does
+		if err := cf.setAuth(key, authEntry{}); err != nil {
+			return err
+		}
+		return cf.save()
+	}
+
+	err = cf.setAuth(key, authEntry{
+		Auth: base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password)),
+	})
+	if err != nil {
+		return err
+	}
+	return cf.save()
+}
+
+// Login verifies credentials against a registry and stores them on success
+func Login(domain string, auth *AuthConfig, insecure bool) error {
+	ref := reference.Reference{Domain: domain}
+
+	client := NewClient(ref.RegistryHost(), insecure)
+	client.Auth = auth
+	if err := client.Ping(); err != nil {
+		return err
+	}
+
+	return SaveCredentials(domain, auth)
+}
+
+// helperCredentials is the JSON exchanged with docker-credential-* helpers
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func runHelper(helper, action string, input []byte) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(string(output) + stderr.String())
+		return nil, fmt.Errorf("credential helper %s %s failed: %v: %s", helper, action, err, msg)
+	}
+	return output, nil
+}
+
+func helperGet(helper, serverURL string) (*AuthConfig, error) {
+	output, err := runHelper(helper, "get", []byte(serverURL))
+	if err != nil {
+		// Helpers report unknown servers as an error; treat that as no credentials
+		if strings.Contains(err.Error(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return nil, fmt.Errorf("invalid output from credential helper %s: %v", helper, err)
+	}
+
+	return &AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+func helperStore(helper, serverURL string, auth *AuthConfig) error {
+	input, err := json.Marshal(helperCredentials{
+		ServerURL: serverURL,
+		Username:  auth.Username,
+		Secret:    auth.Password,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = runHelper(helper, "store", input)
+	return err
+}
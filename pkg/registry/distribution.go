@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// distributionBasePath records where blobs came from, by layer ID
+func distributionBasePath() string { return store.Path("distribution") }
+
+// BlobSource records a registry repository known to hold a blob
+type BlobSource struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+}
+
+// blobInfo maps a compressed registry blob to the local layer it produced
+type blobInfo struct {
+	Digest    string       `json:"digest"`
+	DiffID    string       `json:"diff_id"`              // Digest of the uncompressed tar
+	MediaType string       `json:"media_type,omitempty"` // Layer media type, which names the compression
+	Size      int64        `json:"size"`
+	LayerID   string       `json:"layer_id"`
+	Sources   []BlobSource `json:"sources"`
+}
+
+func blobInfoPath(digest string) string {
+	return filepath.Join(distributionBasePath(), strings.TrimPrefix(digest, "sha256:")+".json")
+}
+
+// lookupBlob returns the local layer for a registry blob, if it is still present
+func lookupBlob(digest string) (*blobInfo, bool) {
+	var info blobInfo
+	if err := store.ReadJSON(blobInfoPath(digest), &info, nil); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring blob record: %v\n", err)
+		}
+		return nil, false
+	}
+	if _, err := layer.GetLayer(info.LayerID); err != nil {
+		return nil, false
+	}
+
+	return &info, true
+}
+
+// blobsForLayer returns every known registry blob for a local layer
+func blobsForLayer(layerID string) []*blobInfo {
+	entries, err := os.ReadDir(distributionBasePath())
+	if err != nil {
+		return nil
+	}
+
+	var blobs []*blobInfo
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, ok := lookupBlob("sha256:" + strings.TrimSuffix(entry.Name(), ".json"))
+		if ok && info.LayerID == layerID {
+			blobs = append(blobs, info)
+		}
+	}
+
+	return blobs
+}
+
+// recordBlob remembers that a blob in a repository corresponds to a local layer
+func recordBlob(digest, layerID, diffID, mediaType string, size int64, source BlobSource) error {
+	info := &blobInfo{Digest: digest, DiffID: diffID, MediaType: mediaType, Size: size, LayerID: layerID}
+	changed := true
+	if existing, ok := lookupBlob(digest); ok && existing.LayerID == layerID {
+		info, changed = existing, false
+		if info.DiffID == "" && diffID != "" {
+			info.DiffID, changed = diffID, true
+		}
+		if info.MediaType == "" && mediaType != "" {
+			info.MediaType, changed = mediaType, true
+		}
+	}
+
+	known := false
+	for _, s := range info.Sources {
+		if s == source {
+			known = true
+			break
+		}
+	}
+	if known && !changed {
+		return nil
+	}
+	if !known {
+		info.Sources = append(info.Sources, source)
+	}
+
+	return store.WriteJSON(blobInfoPath(digest), info)
+}
@@ -0,0 +1,293 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/image"
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+)
+
+const defaultConcurrentDownloads = 3
+
+// PullOptions controls how an image is pulled
+type PullOptions struct {
+	Insecure               bool
+	MaxConcurrentDownloads int
+}
+
+// Pull downloads an image from a v2 registry and stores it as a layered image
+func Pull(refStr string, opts PullOptions) (*image.ImageManifest, error) {
+	ref, err := reference.Parse(refStr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(ref.RegistryHost(), opts.Insecure)
+	if client.Auth, err = LoadCredentials(ref.Domain); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Pulling %s from %s\n", ref.FamiliarString(), ref.Domain)
+
+	manifest, manifestDigest, err := client.GetManifest(ref.Path, ref.ManifestReference())
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.IsList() {
+		desc, err := selectPlatform(manifest.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Selected platform %s/%s\n", desc.Platform.OS, desc.Platform.Architecture)
+		if err := reference.ValidateDigest(desc.Digest); err != nil {
+			return nil, fmt.Errorf("manifest list entry: %v", err)
+		}
+
+		manifest, manifestDigest, err = client.GetManifest(ref.Path, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.IsList() {
+			return nil, fmt.Errorf("nested manifest lists are not supported")
+		}
+	}
+
+	if manifest.Config == nil {
+		return nil, fmt.Errorf("manifest %s has no config", manifestDigest)
+	}
+	if err := reference.ValidateDigest(manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("manifest config: %v", err)
+	}
+	for _, desc := range manifest.Layers {
+		if err := reference.ValidateDigest(desc.Digest); err != nil {
+			return nil, fmt.Errorf("manifest layer: %v", err)
+		}
+	}
+
+	configData, err := client.GetBlob(ref.Path, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ImageConfigBlob
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config lists %d layers, manifest has %d", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if err := reference.ValidateDigest(diffID); err != nil {
+			return nil, fmt.Errorf("image config diff ID: %v", err)
+		}
+	}
+
+	history := layerHistory(config.History, len(manifest.Layers))
+	source := BlobSource{Registry: ref.Domain, Repository: ref.Path}
+
+	layerIDs, err := pullLayers(client, ref.Path, manifest.Layers, config.RootFS.DiffIDs, history, source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := image.CreateImage(&image.ImageManifest{
+		Layers:  layerIDs,
+		Created: config.Created,
+		Author:  config.Author,
+		Config:  toImageConfig(config.Config),
+		History: toImageHistory(config.History),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Record both name:tag and name@digest so either form finds the image
+	if ref.Tag != "" {
+		tagRef := *ref
+		tagRef.Digest = ""
+		if err := image.SetReference(&tagRef, result.ID); err != nil {
+			return nil, err
+		}
+	}
+	digestRef := *ref
+	digestRef.Tag, digestRef.Digest = "", manifestDigest
+	if err := image.SetReference(&digestRef, result.ID); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Digest: %s\n", manifestDigest)
+	fmt.Printf("Status: Downloaded image for %s\n", ref.FamiliarString())
+
+	return result, nil
+}
+
+// pullLayers downloads and imports layers concurrently, returning layer IDs in manifest order
+func pullLayers(client *Client, repository string, descs []Descriptor, diffIDs []string, history []History, source BlobSource, opts PullOptions) ([]string, error) {
+	workers := opts.MaxConcurrentDownloads
+	if workers <= 0 {
+		workers = defaultConcurrentDownloads
+	}
+
+	// The same blob can appear several times in a manifest; fetch it once
+	first := make(map[string]int)
+	for i, desc := range descs {
+		if _, ok := first[desc.Digest]; !ok {
+			first[desc.Digest] = i
+		}
+	}
+
+	layerIDs := make([]string, len(descs))
+	errs := make([]error, len(descs))
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for _, i := range first {
+		wg.Add(1)
+		go func(i int, desc Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			layerIDs[i], errs[i] = pullLayer(client, repository, desc, diffIDs[i], history[i], source)
+		}(i, descs[i])
+	}
+	wg.Wait()
+
+	for i, desc := range descs {
+		j := first[desc.Digest]
+		if errs[j] != nil {
+			return nil, errs[j]
+		}
+		layerIDs[i] = layerIDs[j]
+	}
+
+	return layerIDs, nil
+}
+
+// pullLayer fetches a single layer blob and extracts it into layer storage
+func pullLayer(client *Client, repository string, desc Descriptor, diffID string, history History, source BlobSource) (string, error) {
+	short := shortDigest(desc.Digest)
+
+	// A layer whose diff ID was never verified is downloaded again
+	if info, ok := lookupBlob(desc.Digest); ok && info.DiffID != "" {
+		if info.DiffID != diffID {
+			return "", fmt.Errorf("layer %s: image config gives diff ID %s, the blob's is %s", short, diffID, info.DiffID)
+		}
+		fmt.Printf("%s: Already exists\n", short)
+		recordBlob(desc.Digest, info.LayerID, diffID, desc.MediaType, desc.Size, source)
+		return info.LayerID, nil
+	}
+
+	fmt.Printf("%s: Pulling fs layer\n", short)
+
+	blobPath, err := client.DownloadBlob(repository, desc)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("%s: Download complete\n", short)
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	createdBy := history.CreatedBy
+	if createdBy == "" {
+		createdBy = fmt.Sprintf("pull: %s@%s", source.Repository, desc.Digest)
+	}
+
+	l, err := layer.ImportLayer(file, diffID, createdBy, history.Comment)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract layer %s: %v", short, err)
+	}
+
+	if err := recordBlob(desc.Digest, l.ID, diffID, desc.MediaType, desc.Size, source); err != nil {
+		fmt.Printf("Warning: failed to record blob metadata for %s: %v\n", short, err)
+	}
+	os.Remove(blobPath)
+
+	fmt.Printf("%s: Pull complete\n", short)
+	return l.ID, nil
+}
+
+// selectPlatform picks the manifest for linux on the host architecture, falling back to linux/amd64
+func selectPlatform(manifests []Descriptor) (*Descriptor, error) {
+	for _, arch := range []string{runtime.GOARCH, "amd64"} {
+		for i := range manifests {
+			p := manifests[i].Platform
+			if p != nil && p.OS == "linux" && p.Architecture == arch {
+				return &manifests[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest found for linux/%s", runtime.GOARCH)
+}
+
+// layerHistory returns the history entries that correspond to actual layers
+func layerHistory(history []History, layerCount int) []History {
+	var result []History
+	for _, h := range history {
+		if !h.EmptyLayer {
+			result = append(result, h)
+		}
+	}
+
+	// Registries don't always carry history; pad so every layer has an entry
+	for len(result) < layerCount {
+		result = append(result, History{})
+	}
+
+	return result[:layerCount]
+}
+
+// toImageHistory converts registry history, including config-only entries
+func toImageHistory(history []History) []image.HistoryEntry {
+	var result []image.HistoryEntry
+	for _, h := range history {
+		result = append(result, image.HistoryEntry{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		})
+	}
+	return result
+}
+
+// toImageConfig converts a registry config to the local image configuration
+func toImageConfig(c ContainerConfig) image.ImageConfig {
+	var ports []string
+	for port := range c.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+
+	return image.ImageConfig{
+		Cmd:          c.Cmd,
+		Entrypoint:   c.Entrypoint,
+		Env:          c.Env,
+		WorkingDir:   c.WorkingDir,
+		User:         c.User,
+		ExposedPorts: ports,
+	}
+}
+
+func shortDigest(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
@@ -0,0 +1,371 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/image"
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+const (
+	testRepository = "test/app"
+	testToken      = "secret-token"
+)
+
+type manifestEntry struct {
+	mediaType string
+	data      []byte
+}
+
+// fakeRegistry is a registry:2-style stand-in that requires a bearer token
+// for everything under /v2/
+type fakeRegistry struct {
+	t         *testing.T
+	server    *httptest.Server
+	manifests map[string]manifestEntry // by tag and by digest
+	blobs     map[string][]byte        // content served for a digest
+
+	mu            sync.Mutex
+	truncate      map[string]bool // digests whose next download is cut short
+	ranges        []string        // Range headers seen on blob requests
+	tokenRequests int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:         t,
+		manifests: make(map[string]manifestEntry),
+		blobs:     make(map[string][]byte),
+		truncate:  make(map[string]bool),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// host returns the registry address as it appears in image references
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry",scope="repository:%s:pull"`, r.server.URL, testRepository))
+		http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + testRepository + "/"
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(req.URL.Path, prefix+"manifests/"):
+		entry, ok := r.manifests[strings.TrimPrefix(req.URL.Path, prefix+"manifests/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", entry.mediaType)
+		w.Write(entry.data)
+	case strings.HasPrefix(req.URL.Path, prefix+"blobs/"):
+		r.serveBlob(w, req, strings.TrimPrefix(req.URL.Path, prefix+"blobs/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("service") != "fake-registry" {
+		r.t.Errorf("token request for service %q", query.Get("service"))
+	}
+	if scope := fmt.Sprintf("repository:%s:pull", testRepository); !contains(query["scope"], scope) {
+		r.t.Errorf("token request scopes %v do not include %s", query["scope"], scope)
+	}
+
+	r.mu.Lock()
+	r.tokenRequests++
+	r.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	data, ok := r.blobs[digest]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	r.mu.Lock()
+	if rng := req.Header.Get("Range"); rng != "" {
+		r.ranges = append(r.ranges, rng)
+	}
+	truncate := r.truncate[digest]
+	delete(r.truncate, digest)
+	r.mu.Unlock()
+
+	if truncate {
+		// Promise the whole blob, send half of it and drop the connection
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// addImage publishes an image with one layer holding files. The config
+// lists diffID as the layer's diff ID, or the real one if diffID is empty.
+func (r *fakeRegistry) addImage(files map[string]string, diffID string) (manifestDigest, layerDigest string) {
+	layerTar := makeTar(r.t, files)
+	if diffID == "" {
+		diffID = digestBytes(layerTar)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(layerTar)
+	zw.Close()
+	layerBlob := gz.Bytes()
+	layerDigest = digestBytes(layerBlob)
+	r.blobs[layerDigest] = layerBlob
+
+	config, err := json.Marshal(ImageConfigBlob{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Created:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Config:       ContainerConfig{Cmd: []string{"/bin/app"}, WorkingDir: "/srv"},
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{diffID}},
+		History:      []History{{CreatedBy: "COPY app /bin/app"}},
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	configDigest := digestBytes(config)
+	r.blobs[configDigest] = config
+
+	return r.addManifest("", MediaTypeDockerManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeDockerManifest,
+		Config:        &Descriptor{MediaType: MediaTypeDockerConfig, Digest: configDigest, Size: int64(len(config))},
+		Layers:        []Descriptor{{MediaType: MediaTypeDockerLayer, Digest: layerDigest, Size: int64(len(layerBlob))}},
+	}), layerDigest
+}
+
+// addManifest stores a manifest under its digest and, if given, a tag
+func (r *fakeRegistry) addManifest(tag, mediaType string, manifest Manifest) string {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	digest := digestBytes(data)
+	r.manifests[digest] = manifestEntry{mediaType, data}
+	if tag != "" {
+		r.manifests[tag] = manifestEntry{mediaType, data}
+	}
+	return digest
+}
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// layerFiles returns the regular files stored in a layer
+func layerFiles(t *testing.T, layerID string) map[string]string {
+	var buf bytes.Buffer
+	if err := layer.ExportLayer(layerID, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, _ := io.ReadAll(tr)
+			files[strings.TrimPrefix(hdr.Name, "./")] = string(data)
+		}
+	}
+	return files
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// useTempRoot keeps all state, and the credential file, out of the real locations
+func useTempRoot(t *testing.T) {
+	root := store.Root
+	store.Root = t.TempDir()
+	t.Cleanup(func() { store.Root = root })
+	t.Setenv("HOME", t.TempDir())
+}
+
+func TestPullManifestListWithTokenAuth(t *testing.T) {
+	useTempRoot(t)
+	reg := newFakeRegistry(t)
+
+	imageDigest, layerDigest := reg.addImage(map[string]string{"bin/app": "hello"}, "")
+
+	// Only the linux entry for this architecture may be fetched
+	reg.addManifest("v1", MediaTypeDockerManifestList, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeDockerManifestList,
+		Manifests: []Descriptor{
+			{MediaType: MediaTypeDockerManifest, Digest: digestBytes([]byte("windows")), Platform: &Platform{OS: "windows", Architecture: runtime.GOARCH}},
+			{MediaType: MediaTypeDockerManifest, Digest: imageDigest, Platform: &Platform{OS: "linux", Architecture: runtime.GOARCH}},
+		},
+	})
+
+	ref := reg.host() + "/" + testRepository + ":v1"
+	manifest, err := Pull(ref, PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg.mu.Lock()
+	tokenRequests := reg.tokenRequests
+	reg.mu.Unlock()
+	if tokenRequests == 0 {
+		t.Error("pull did not answer the bearer token challenge")
+	}
+
+	for _, name := range []string{ref, reg.host() + "/" + testRepository + "@" + imageDigest} {
+		id, err := image.ResolveID(name)
+		if err != nil {
+			t.Errorf("resolving %s: %v", name, err)
+		} else if id != manifest.ID {
+			t.Errorf("%s resolves to %s, want %s", name, id, manifest.ID)
+		}
+	}
+
+	if len(manifest.Config.Cmd) != 1 || manifest.Config.Cmd[0] != "/bin/app" || manifest.Config.WorkingDir != "/srv" {
+		t.Errorf("image config = %+v", manifest.Config)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("image has %d layers, want 1", len(manifest.Layers))
+	}
+	if files := layerFiles(t, manifest.Layers[0]); files["bin/app"] != "hello" {
+		t.Errorf("layer files = %v", files)
+	}
+
+	// Push reuses the blob under the media type it was pulled with
+	if info, ok := lookupBlob(layerDigest); !ok || info.MediaType != MediaTypeDockerLayer || info.LayerID != manifest.Layers[0] {
+		t.Errorf("blob record = %+v, want layer %s with media type %s", info, manifest.Layers[0], MediaTypeDockerLayer)
+	}
+
+	// A second pull finds the verified layer locally
+	again, err := Pull(ref, PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != manifest.ID {
+		t.Errorf("second pull gave image %s, want %s", again.ID, manifest.ID)
+	}
+}
+
+func TestPullResumesInterruptedDownload(t *testing.T) {
+	useTempRoot(t)
+	reg := newFakeRegistry(t)
+
+	content := strings.Repeat("resumable layer content\n", 4096)
+	imageDigest, layerDigest := reg.addImage(map[string]string{"data.txt": content}, "")
+	reg.truncate[layerDigest] = true
+
+	manifest, err := Pull(reg.host()+"/"+testRepository+"@"+imageDigest, PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg.mu.Lock()
+	ranges := reg.ranges
+	reg.mu.Unlock()
+	want := fmt.Sprintf("bytes=%d-", len(reg.blobs[layerDigest])/2)
+	if len(ranges) != 1 || ranges[0] != want {
+		t.Errorf("range requests = %v, want [%s]", ranges, want)
+	}
+	if files := layerFiles(t, manifest.Layers[0]); files["data.txt"] != content {
+		t.Error("resumed layer content differs from the original")
+	}
+}
+
+func TestPullRejectsDigestMismatch(t *testing.T) {
+	useTempRoot(t)
+	reg := newFakeRegistry(t)
+
+	imageDigest, layerDigest := reg.addImage(map[string]string{"bin/app": "hello"}, "")
+	reg.blobs[layerDigest] = []byte("not the layer the manifest names")
+	reg.manifests["v1"] = reg.manifests[imageDigest]
+
+	ref := reg.host() + "/" + testRepository + ":v1"
+	_, err := Pull(ref, PullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("got error %v, want a digest mismatch", err)
+	}
+	if _, err := image.ResolveID(ref); err == nil {
+		t.Error("a corrupt pull was tagged")
+	}
+	if layers, _ := layer.ListLayers(); len(layers) != 0 {
+		t.Errorf("a corrupt pull left %d layers behind", len(layers))
+	}
+}
+
+func TestPullRejectsDiffIDMismatch(t *testing.T) {
+	useTempRoot(t)
+	reg := newFakeRegistry(t)
+
+	wrong := digestBytes([]byte("some other layer"))
+	imageDigest, _ := reg.addImage(map[string]string{"bin/app": "hello"}, wrong)
+
+	_, err := Pull(reg.host()+"/"+testRepository+"@"+imageDigest, PullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "diff ID mismatch") {
+		t.Fatalf("got error %v, want a diff ID mismatch", err)
+	}
+	if layers, _ := layer.ListLayers(); len(layers) != 0 {
+		t.Errorf("an unverified layer was stored: %d layers", len(layers))
+	}
+}
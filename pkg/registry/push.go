@@ -0,0 +1,555 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/image"
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/reference"
+)
+
+const defaultChunkSize = 8 * 1024 * 1024
+
+// PushOptions controls how an image is pushed
+type PushOptions struct {
+	Insecure  bool
+	ChunkSize int64 // Blobs larger than this are uploaded in chunks
+}
+
+// pushedLayer is a layer blob as it exists in the target repository
+type pushedLayer struct {
+	Digest    string
+	DiffID    string
+	MediaType string
+	Size      int64
+}
+
+// Push uploads a local image to a v2 registry and returns the manifest digest
+func Push(refStr string, opts PushOptions) (string, error) {
+	ref, err := reference.Parse(refStr)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", fmt.Errorf("cannot push by digest, use a tag")
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+
+	local, err := image.GetImageManifest(refStr)
+	if err != nil {
+		return "", fmt.Errorf("image %s is not a layered image: %v", ref.FamiliarString(), err)
+	}
+
+	client := NewClient(ref.RegistryHost(), opts.Insecure)
+	if client.Auth, err = LoadCredentials(ref.Domain); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("The push refers to repository [%s]\n", ref.Name())
+
+	var layers []pushedLayer
+	for _, layerID := range local.Layers {
+		pushed, err := pushLayer(client, ref, layerID, opts)
+		if err != nil {
+			return "", err
+		}
+		layers = append(layers, *pushed)
+	}
+
+	localHistory, err := image.GetHistory(local)
+	if err != nil {
+		return "", err
+	}
+	var history []History
+	for _, h := range localHistory {
+		history = append(history, History{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		})
+	}
+
+	configData, err := json.Marshal(buildConfigBlob(local, layers, history))
+	if err != nil {
+		return "", err
+	}
+	configDesc := Descriptor{
+		MediaType: MediaTypeDockerConfig,
+		Digest:    digestBytes(configData),
+		Size:      int64(len(configData)),
+	}
+
+	exists, err := client.BlobExists(ref.Path, configDesc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		location, err := client.startUpload(ref.Path)
+		if err != nil {
+			return "", err
+		}
+		if err := client.uploadMonolithic(ref.Path, location, configDesc.Digest, bytes.NewReader(configData), configDesc.Size); err != nil {
+			return "", err
+		}
+	}
+
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeDockerManifest,
+		Config:        &configDesc,
+	}
+	for _, l := range layers {
+		manifest.Layers = append(manifest.Layers, Descriptor{
+			MediaType: l.MediaType,
+			Digest:    l.Digest,
+			Size:      l.Size,
+		})
+	}
+	useOCITypes(&manifest)
+
+	digest, err := client.PutManifest(ref.Path, ref.Tag, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("%s: digest: %s\n", ref.Tag, digest)
+	return digest, nil
+}
+
+// pushLayer makes sure a layer exists in the target repository, uploading it only when needed
+func pushLayer(client *Client, ref *reference.Reference, layerID string, opts PushOptions) (*pushedLayer, error) {
+	short := layerID[:12]
+	target := BlobSource{Registry: ref.Domain, Repository: ref.Path}
+
+	// A failed mount opens a regular upload session. It is used for the
+	// upload, and cancelled if the blob turns out not to need one.
+	var location string
+	uploaded := false
+	defer func() {
+		if location != "" && !uploaded {
+			client.cancelUpload(ref.Path, location)
+		}
+	}()
+
+	// Blobs we have pulled or pushed before may already be in the registry
+	// Only blobs whose diff ID and media type are known can be reused
+	for _, info := range blobsForLayer(layerID) {
+		if info.DiffID == "" || info.MediaType == "" {
+			continue
+		}
+		known := &pushedLayer{Digest: info.Digest, DiffID: info.DiffID, MediaType: info.MediaType, Size: info.Size}
+
+		exists, err := client.BlobExists(ref.Path, info.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			fmt.Printf("%s: Layer already exists\n", short)
+			recordPushedBlob(known, layerID, target)
+			return known, nil
+		}
+		if location != "" {
+			continue
+		}
+
+		for _, source := range info.Sources {
+			if source.Registry != ref.Domain || source.Repository == ref.Path {
+				continue
+			}
+			mounted, sessionLocation, err := client.MountBlob(ref.Path, source.Repository, info.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if mounted {
+				fmt.Printf("%s: Mounted from %s\n", short, source.Repository)
+				recordPushedBlob(known, layerID, target)
+				return known, nil
+			}
+			location = sessionLocation
+			break
+		}
+	}
+
+	fmt.Printf("%s: Preparing\n", short)
+
+	blob, err := compressLayer(layerID)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(blob.path)
+	defer blob.file.Close()
+
+	pushed := &pushedLayer{Digest: blob.digest, DiffID: blob.diffID, MediaType: MediaTypeDockerLayer, Size: blob.size}
+
+	exists, err := client.BlobExists(ref.Path, blob.digest)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		fmt.Printf("%s: Layer already exists\n", short)
+		recordPushedBlob(pushed, layerID, target)
+		return pushed, nil
+	}
+
+	if location == "" {
+		if location, err = client.startUpload(ref.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf("%s: Pushing (%.2f MB)\n", short, float64(blob.size)/(1024*1024))
+
+	if blob.size > opts.ChunkSize {
+		err = client.uploadChunked(ref.Path, location, blob.digest, blob.file, blob.size, opts.ChunkSize)
+	} else {
+		err = client.uploadMonolithic(ref.Path, location, blob.digest, blob.file, blob.size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload layer %s: %v", short, err)
+	}
+	uploaded = true
+
+	recordPushedBlob(pushed, layerID, target)
+	fmt.Printf("%s: Pushed\n", short)
+
+	return pushed, nil
+}
+
+func recordPushedBlob(pushed *pushedLayer, layerID string, target BlobSource) {
+	if err := recordBlob(pushed.Digest, layerID, pushed.DiffID, pushed.MediaType, pushed.Size, target); err != nil {
+		fmt.Printf("Warning: failed to record blob metadata for %s: %v\n", layerID[:12], err)
+	}
+}
+
+// useOCITypes turns a manifest into an OCI manifest when a reused layer blob
+// has an OCI media type, such as zstd, that a Docker manifest can't name.
+// Docker gzip layers are the same bytes as OCI gzip layers.
+func useOCITypes(manifest *Manifest) {
+	oci := false
+	for _, l := range manifest.Layers {
+		if strings.HasPrefix(l.MediaType, "application/vnd.oci.") {
+			oci = true
+		}
+	}
+	if !oci {
+		return
+	}
+
+	manifest.MediaType = MediaTypeOCIManifest
+	manifest.Config.MediaType = MediaTypeOCIConfig
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == MediaTypeDockerLayer {
+			manifest.Layers[i].MediaType = MediaTypeOCILayer
+		}
+	}
+}
+
+// compressedBlob is a gzip-compressed layer tarball staged on disk
+type compressedBlob struct {
+	path   string
+	file   *os.File
+	digest string // sha256 of the compressed blob
+	diffID string // sha256 of the uncompressed tar
+	size   int64
+}
+
+// compressLayer tars and gzips a layer, computing both digests in a single pass
+func compressLayer(layerID string) (*compressedBlob, error) {
+	if err := os.MkdirAll(downloadBasePath(), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(downloadBasePath(), "push-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	compressedHash := sha256.New()
+	diffHash := sha256.New()
+
+	gz := gzip.NewWriter(io.MultiWriter(file, compressedHash))
+	if err := layer.ExportLayer(layerID, io.MultiWriter(gz, diffHash)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to export layer %s: %v", layerID[:12], err)
+	}
+	if err := gz.Close(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &compressedBlob{
+		path:   file.Name(),
+		file:   file,
+		digest: "sha256:" + hex.EncodeToString(compressedHash.Sum(nil)),
+		diffID: "sha256:" + hex.EncodeToString(diffHash.Sum(nil)),
+		size:   size,
+	}, nil
+}
+
+// buildConfigBlob produces the registry image configuration for a local image
+func buildConfigBlob(m *image.ImageManifest, layers []pushedLayer, history []History) *ImageConfigBlob {
+	ports := make(map[string]struct{})
+	for _, p := range m.Config.ExposedPorts {
+		ports[p] = struct{}{}
+	}
+
+	config := &ImageConfigBlob{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Created:      m.Created,
+		Author:       m.Author,
+		Config: ContainerConfig{
+			User:         m.Config.User,
+			ExposedPorts: ports,
+			Env:          m.Config.Env,
+			Entrypoint:   m.Config.Entrypoint,
+			Cmd:          m.Config.Cmd,
+			WorkingDir:   m.Config.WorkingDir,
+		},
+		RootFS:  RootFS{Type: "layers"},
+		History: history,
+	}
+	for _, l := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.DiffID)
+	}
+
+	return config
+}
+
+// BlobExists checks whether a blob is present in a repository
+func (c *Client) BlobExists(repository, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url(fmt.Sprintf("/v2/%s/blobs/%s", repository, digest)), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req, repositoryScope(repository, "pull", "push"))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check blob %s: %s", digest, resp.Status)
+	}
+}
+
+// MountBlob asks the registry to link a blob from another repository.
+// If the registry cannot mount it, the returned location is a fresh upload session.
+func (c *Client) MountBlob(repository, from, digest string) (bool, string, error) {
+	query := url.Values{"mount": {digest}, "from": {from}}
+	req, err := http.NewRequest(http.MethodPost, c.url(fmt.Sprintf("/v2/%s/blobs/uploads/?%s", repository, query.Encode())), nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	scope := repositoryScope(repository, "pull", "push") + " " + repositoryScope(from, "pull")
+	resp, err := c.do(req, scope)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusCreated, http.StatusAccepted); err != nil {
+		return false, "", err
+	}
+	if resp.StatusCode == http.StatusCreated {
+		return true, "", nil
+	}
+
+	location, err := c.resolveLocation(resp.Header.Get("Location"))
+	return false, location, err
+}
+
+// startUpload opens an upload session and returns its location
+func (c *Client) startUpload(repository string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url(fmt.Sprintf("/v2/%s/blobs/uploads/", repository)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(req, repositoryScope(repository, "pull", "push"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusAccepted); err != nil {
+		return "", fmt.Errorf("failed to start upload: %v", err)
+	}
+
+	return c.resolveLocation(resp.Header.Get("Location"))
+}
+
+// cancelUpload deletes an upload session. Failures are ignored, as the
+// registry expires abandoned sessions on its own.
+func (c *Client) cancelUpload(repository, location string) {
+	req, err := http.NewRequest(http.MethodDelete, location, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.do(req, repositoryScope(repository, "pull", "push"))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// uploadMonolithic sends a whole blob in a single PUT
+func (c *Client) uploadMonolithic(repository, location, digest string, r io.ReaderAt, size int64) error {
+	target, err := withDigest(location, digest)
+	if err != nil {
+		return err
+	}
+
+	req, err := newSectionRequest(http.MethodPut, target, r, 0, size)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, repositoryScope(repository, "pull", "push"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp, http.StatusCreated)
+}
+
+// uploadChunked sends a blob as a series of PATCH requests followed by a closing PUT
+func (c *Client) uploadChunked(repository, location, digest string, r io.ReaderAt, size, chunkSize int64) error {
+	scope := repositoryScope(repository, "pull", "push")
+
+	for offset := int64(0); offset < size; offset += chunkSize {
+		n := min(chunkSize, size-offset)
+
+		req, err := newSectionRequest(http.MethodPatch, location, r, offset, n)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+
+		resp, err := c.do(req, scope)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if err := checkResponse(resp, http.StatusAccepted); err != nil {
+			return fmt.Errorf("chunk upload at offset %d failed: %v", offset, err)
+		}
+		if location, err = c.resolveLocation(resp.Header.Get("Location")); err != nil {
+			return err
+		}
+	}
+
+	target, err := withDigest(location, digest)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, scope)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp, http.StatusCreated)
+}
+
+// PutManifest uploads a manifest under a tag and returns its digest
+func (c *Client) PutManifest(repository, tag string, manifest *Manifest) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.url(fmt.Sprintf("/v2/%s/manifests/%s", repository, tag)), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", manifest.MediaType)
+
+	resp, err := c.do(req, repositoryScope(repository, "pull", "push"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return "", fmt.Errorf("failed to push manifest: %v", err)
+	}
+
+	digest := digestBytes(data)
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != digest {
+		return "", fmt.Errorf("registry reported manifest digest %s, expected %s", header, digest)
+	}
+
+	return digest, nil
+}
+
+// newSectionRequest builds a request whose body is a replayable section of r
+func newSectionRequest(method, target string, r io.ReaderAt, offset, n int64) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, io.NewSectionReader(r, offset, n))
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = n
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(r, offset, n)), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+
+	return req, nil
+}
+
+// withDigest adds the digest query parameter that completes an upload
+func withDigest(location, digest string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
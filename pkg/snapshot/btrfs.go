@@ -0,0 +1,229 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// btrfsSuperMagic is the statfs type of btrfs filesystems
+const btrfsSuperMagic = 0x9123683e
+
+// btrfsBasePath must be on a btrfs filesystem
+func btrfsBasePath() string { return store.Path("btrfs") }
+
+// btrfsDriver keeps a read-only subvolume for every stack of layers, each
+// a snapshot of the one below with a layer applied, and gives snapshots a
+// writable btrfs snapshot of it. Snapshots share all unchanged extents.
+type btrfsDriver struct{}
+
+func (d btrfsDriver) Prepare(key string, layerIDs []string) (string, error) {
+	return d.snapshot(key, layerIDs, false)
+}
+
+func (d btrfsDriver) View(key string, layerIDs []string) (string, error) {
+	return d.snapshot(key, layerIDs, true)
+}
+
+// snapshot creates the subvolume of key from the subvolume of its layers
+func (btrfsDriver) snapshot(key string, layerIDs []string, readOnly bool) (string, error) {
+	if err := checkBtrfs(); err != nil {
+		return "", err
+	}
+
+	base, err := layerSubvolume(layerIDs)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(btrfsBasePath(), "snapshots", key)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create a directory %s: %v", dir, err)
+	}
+	if err := saveLayers(dir, layerIDs); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	args := []string{"subvolume", "create", rootfs}
+	if base != "" {
+		args = []string{"subvolume", "snapshot", base, rootfs}
+		if readOnly {
+			args = []string{"subvolume", "snapshot", "-r", base, rootfs}
+		}
+	}
+	if err := btrfs(args...); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return rootfs, nil
+}
+
+func (btrfsDriver) Changes(key string) ([]overlay.Change, error) {
+	rootfs, base, err := btrfsSnapshot(key)
+	if err != nil {
+		return nil, err
+	}
+	return rootfsChanges(rootfs, base)
+}
+
+func (btrfsDriver) Commit(key, createdBy, comment string) (*layer.Layer, error) {
+	rootfs, base, err := btrfsSnapshot(key)
+	if err != nil {
+		return nil, err
+	}
+	return commitRootfs(rootfs, base, createdBy, comment)
+}
+
+func (btrfsDriver) Remove(key string) error {
+	dir := filepath.Join(btrfsBasePath(), "snapshots", key)
+	if err := unmountUnder(dir); err != nil {
+		return err
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if _, err := os.Stat(rootfs); err == nil {
+		if err := btrfs("subvolume", "delete", rootfs); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// Usage adds up the files the snapshot added or changed; everything else
+// shares extents with the layers
+func (btrfsDriver) Usage(key string) (int64, error) {
+	rootfs, base, err := btrfsSnapshot(key)
+	if err != nil {
+		return 0, err
+	}
+	return changesSize(rootfs, base)
+}
+
+func (btrfsDriver) List() (map[string]time.Time, error) {
+	return listDirs(filepath.Join(btrfsBasePath(), "snapshots"))
+}
+
+// btrfsSnapshot returns the root filesystem of key and, as the only lower
+// directory, the subvolume of the layers it was created from
+func btrfsSnapshot(key string) (string, []string, error) {
+	dir := filepath.Join(btrfsBasePath(), "snapshots", key)
+	layerIDs, err := loadLayers(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	base, err := layerSubvolume(layerIDs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var lowerDirs []string
+	if base != "" {
+		lowerDirs = []string{base}
+	}
+	return filepath.Join(dir, "rootfs"), lowerDirs, nil
+}
+
+// layerSubvolume returns the read-only subvolume holding a stack of layers,
+// creating the subvolumes of the stack that do not exist yet. It returns
+// "" for no layers.
+func layerSubvolume(layerIDs []string) (string, error) {
+	layersPath := filepath.Join(btrfsBasePath(), "layers")
+	if err := os.MkdirAll(layersPath, 0755); err != nil {
+		return "", err
+	}
+
+	parent := ""
+	for i, layerID := range layerIDs {
+		chainID := layer.ChainID(layerIDs[:i+1])
+		path := filepath.Join(layersPath, chainID)
+
+		if _, err := os.Stat(path); err != nil {
+			if err := buildLayerSubvolume(layerID, chainID, parent, path); err != nil {
+				return "", err
+			}
+		}
+
+		parent = path
+	}
+
+	return parent, nil
+}
+
+// buildLayerSubvolume creates the subvolume of one layer on top of its
+// parent's. The lock keeps concurrent runs of the same chain from racing on
+// the shared temporary subvolume.
+func buildLayerSubvolume(layerID, chainID, parent, path string) error {
+	lock, err := store.Acquire("btrfs-" + chainID)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Another process may have built it while we waited
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	// Build under a temporary name so a failure leaves nothing behind
+	tmpPath := filepath.Join(filepath.Dir(path), ".tmp-"+chainID)
+	if _, err := os.Stat(tmpPath); err == nil {
+		btrfs("subvolume", "delete", tmpPath)
+	}
+
+	args := []string{"subvolume", "create", tmpPath}
+	if parent != "" {
+		args = []string{"subvolume", "snapshot", parent, tmpPath}
+	}
+	if err := btrfs(args...); err != nil {
+		return err
+	}
+
+	if err := layer.ApplyLayer(layerID, tmpPath); err != nil {
+		btrfs("subvolume", "delete", tmpPath)
+		return err
+	}
+	if err := btrfs("property", "set", "-ts", tmpPath, "ro", "true"); err != nil {
+		btrfs("subvolume", "delete", tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		btrfs("subvolume", "delete", tmpPath)
+		return err
+	}
+	return nil
+}
+
+// checkBtrfs makes sure the driver's directory is on a btrfs filesystem
+func checkBtrfs() error {
+	if err := os.MkdirAll(btrfsBasePath(), 0755); err != nil {
+		return err
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(btrfsBasePath(), &fs); err != nil {
+		return err
+	}
+	if fs.Type != btrfsSuperMagic {
+		return fmt.Errorf("the btrfs storage driver needs %s on a btrfs filesystem", btrfsBasePath())
+	}
+	return nil
+}
+
+func btrfs(args ...string) error {
+	output, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs %s failed: %v, output: %s", strings.Join(args[:2], " "), err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+func nativeBasePath() string { return store.Path("native") }
+
+// nativeDriver gives every snapshot a full private copy of its layers. It
+// works on any kernel and filesystem, at the cost of disk space and time.
+type nativeDriver struct{}
+
+func (nativeDriver) Prepare(key string, layerIDs []string) (string, error) {
+	dir := filepath.Join(nativeBasePath(), key)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return "", fmt.Errorf("failed to create a directory %s: %v", rootfs, err)
+	}
+
+	if err := saveLayers(dir, layerIDs); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	for _, layerID := range layerIDs {
+		if err := layer.ApplyLayer(layerID, rootfs); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return rootfs, nil
+}
+
+func (d nativeDriver) View(key string, layerIDs []string) (string, error) {
+	rootfs, err := d.Prepare(key, layerIDs)
+	if err != nil {
+		return "", err
+	}
+
+	// A read-only bind mount of the copy onto itself
+	if err := overlay.BindMount(rootfs, rootfs, true); err != nil {
+		d.Remove(key)
+		return "", err
+	}
+	return rootfs, nil
+}
+
+func (nativeDriver) Changes(key string) ([]overlay.Change, error) {
+	dir := filepath.Join(nativeBasePath(), key)
+	lowerDirs, err := lowerDirs(key, dir)
+	if err != nil {
+		return nil, err
+	}
+	return rootfsChanges(filepath.Join(dir, "rootfs"), lowerDirs)
+}
+
+func (nativeDriver) Commit(key, createdBy, comment string) (*layer.Layer, error) {
+	dir := filepath.Join(nativeBasePath(), key)
+	lowerDirs, err := lowerDirs(key, dir)
+	if err != nil {
+		return nil, err
+	}
+	return commitRootfs(filepath.Join(dir, "rootfs"), lowerDirs, createdBy, comment)
+}
+
+func (nativeDriver) Remove(key string) error {
+	dir := filepath.Join(nativeBasePath(), key)
+
+	// Views are bind mounted, and a leftover volume mount must not be
+	// deleted through
+	if err := unmountUnder(dir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return layer.Release(key)
+}
+
+// Usage adds up the files added or changed in the copy, not the copy itself
+func (nativeDriver) Usage(key string) (int64, error) {
+	dir := filepath.Join(nativeBasePath(), key)
+	lowerDirs, err := lowerDirs(key, dir)
+	if err != nil {
+		return 0, err
+	}
+	return changesSize(filepath.Join(dir, "rootfs"), lowerDirs)
+}
+
+func (nativeDriver) List() (map[string]time.Time, error) {
+	return listDirs(nativeBasePath())
+}
@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// overlayDriver stacks the layers with kernel overlayfs under a
+// per-snapshot upper directory
+type overlayDriver struct{}
+
+func (overlayDriver) Prepare(key string, layerIDs []string) (string, error) {
+	mount, err := overlay.CreateOverlay(key, layerIDs)
+	if err != nil {
+		overlay.CleanupOverlay(key)
+		return "", err
+	}
+
+	if err := saveLayers(filepath.Dir(mount.UpperDir), layerIDs); err != nil {
+		mount.Cleanup()
+		return "", err
+	}
+	return mount.MergedDir, nil
+}
+
+// PrepareRootfs creates a writable overlay snapshot for key on top of the
+// root filesystem of a monolithic image, which is used read-only
+func PrepareRootfs(key, imageRootfs string) (string, error) {
+	mount, err := overlay.CreateOverlayFromDirs(key, []string{imageRootfs})
+	if err != nil {
+		overlay.CleanupOverlay(key)
+		return "", err
+	}
+
+	if err := store.WriteFile(filepath.Join(filepath.Dir(mount.UpperDir), "lower"), []byte(imageRootfs), 0644); err != nil {
+		mount.Cleanup()
+		return "", err
+	}
+	return mount.MergedDir, nil
+}
+
+func (d overlayDriver) View(key string, layerIDs []string) (string, error) {
+	rootfs, err := d.Prepare(key, layerIDs)
+	if err != nil {
+		return "", err
+	}
+
+	if err := overlay.RemountReadOnly(rootfs, false); err != nil {
+		d.Remove(key)
+		return "", err
+	}
+	return rootfs, nil
+}
+
+func (overlayDriver) Changes(key string) ([]overlay.Change, error) {
+	upperDir := overlay.GetOverlay(key).UpperDir
+	lowerDirs, err := lowerDirs(key, filepath.Dir(upperDir))
+	if err != nil {
+		return nil, err
+	}
+	return overlay.Changes(upperDir, lowerDirs)
+}
+
+func (overlayDriver) Commit(key, createdBy, comment string) (*layer.Layer, error) {
+	upperDir := overlay.GetOverlay(key).UpperDir
+
+	// Containers of monolithic images created before those were mounted
+	// with overlay have no upper directory
+	entries, err := os.ReadDir(upperDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return layer.CreateLayer(upperDir, createdBy, comment)
+}
+
+func (overlayDriver) Remove(key string) error {
+	return overlay.CleanupOverlay(key)
+}
+
+func (overlayDriver) Usage(key string) (int64, error) {
+	return dirSize(overlay.GetOverlay(key).UpperDir)
+}
+
+func (overlayDriver) List() (map[string]time.Time, error) {
+	ids, err := overlay.ListOverlays()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]time.Time)
+	for _, id := range ids {
+		if info, err := os.Stat(filepath.Dir(overlay.GetOverlay(id).UpperDir)); err == nil {
+			keys[id] = info.ModTime()
+		}
+	}
+	return keys, nil
+}
+
+// lowerDirs returns the directories of the layers a snapshot was prepared
+// from. The snapshot already holds them, so nothing is extracted.
+func lowerDirs(key, dir string) ([]string, error) {
+	// Snapshots of monolithic images record the image's rootfs instead
+	if data, err := os.ReadFile(filepath.Join(dir, "lower")); err == nil {
+		return []string{string(data)}, nil
+	}
+
+	layerIDs, err := loadLayers(dir)
+	if err != nil {
+		return nil, err
+	}
+	return layer.Acquire(key, layerIDs)
+}
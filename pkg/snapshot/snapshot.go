@@ -0,0 +1,186 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/layer"
+	"github.com/jagjeet-singh-23/minidocker/pkg/overlay"
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
+)
+
+// DefaultDriver is the storage driver used when none is selected
+const DefaultDriver = "overlay"
+
+// Snapshotter prepares the root filesystems containers and build steps run
+// in from image layers. Each root filesystem is identified by a key, the
+// container or build step ID.
+type Snapshotter interface {
+	// Prepare creates a writable root filesystem for key on top of the
+	// given layers, bottom first, and returns its path
+	Prepare(key string, layerIDs []string) (string, error)
+
+	// View creates a read-only root filesystem for key and returns its path
+	View(key string, layerIDs []string) (string, error)
+
+	// Changes lists the paths added, changed and deleted under key
+	Changes(key string) ([]overlay.Change, error)
+
+	// Commit stores the changes made under key as a new layer. It returns
+	// nil if nothing changed.
+	Commit(key, createdBy, comment string) (*layer.Layer, error)
+
+	// Remove unmounts and deletes the root filesystem of key
+	Remove(key string) error
+
+	// Usage returns the bytes the root filesystem of key takes up on top
+	// of its layers
+	Usage(key string) (int64, error)
+
+	// List returns the keys of all root filesystems and when each was created
+	List() (map[string]time.Time, error)
+}
+
+// Drivers are the names of the storage drivers
+var Drivers = []string{"overlay", "native", "btrfs"}
+
+// Get returns the snapshotter of a storage driver. An empty name selects
+// the default driver.
+func Get(driver string) (Snapshotter, error) {
+	switch driver {
+	case "", "overlay", "overlay2":
+		return overlayDriver{}, nil
+	case "native", "vfs":
+		return nativeDriver{}, nil
+	case "btrfs":
+		return btrfsDriver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q (use overlay, native or btrfs)", driver)
+	}
+}
+
+// rootfsChanges lists the changes made to a flattened root filesystem
+func rootfsChanges(rootfs string, lowerDirs []string) ([]overlay.Change, error) {
+	changes, err := overlay.RootfsChanges(rootfs, lowerDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Layer directories keep their metadata.json at the root, and it is not
+	// part of the layer
+	filtered := changes[:0]
+	for _, change := range changes {
+		if change.Path != "/metadata.json" || change.Kind != overlay.ChangeDelete {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered, nil
+}
+
+// changesSize adds up the size of the files added or changed in a
+// flattened root filesystem
+func changesSize(rootfs string, lowerDirs []string) (int64, error) {
+	changes, err := rootfsChanges(rootfs, lowerDirs)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, change := range changes {
+		info, err := os.Lstat(filepath.Join(rootfs, change.Path))
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// commitRootfs creates a layer from the changes made to a flattened root filesystem
+func commitRootfs(rootfs string, lowerDirs []string, createdBy, comment string) (*layer.Layer, error) {
+	changes, err := rootfsChanges(rootfs, lowerDirs)
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+
+	var changed, deleted []string
+	for _, change := range changes {
+		rel := strings.TrimPrefix(change.Path, "/")
+		if change.Kind == overlay.ChangeDelete {
+			deleted = append(deleted, rel)
+		} else {
+			changed = append(changed, rel)
+		}
+	}
+
+	return layer.CreateLayerFromChanges(rootfs, changed, deleted, createdBy, comment)
+}
+
+// saveLayers records the layers a snapshot was prepared from
+func saveLayers(dir string, layerIDs []string) error {
+	return store.WriteJSON(filepath.Join(dir, "layers.json"), layerIDs)
+}
+
+// loadLayers returns the layers a snapshot was prepared from
+func loadLayers(dir string) ([]string, error) {
+	var layerIDs []string
+	err := store.ReadJSON(filepath.Join(dir, "layers.json"), &layerIDs, nil)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no snapshot at %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return layerIDs, nil
+}
+
+// unmountUnder unmounts everything mounted at or below dir, deepest first
+func unmountUnder(dir string) error {
+	mountPoints, err := overlay.MountPointsUnder(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, mountPoint := range mountPoints {
+		if err := overlay.Unmount(mountPoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSize adds up the sizes of the files under a directory
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// listDirs returns the subdirectories of dir and their modification times
+func listDirs(dir string) (map[string]time.Time, error) {
+	keys := make(map[string]time.Time)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && entry.IsDir() {
+			keys[entry.Name()] = info.ModTime()
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Root is the directory holding all of minidocker's state
+var Root = "/var/lib/minidocker"
+
+// Path returns the path of an entry in the store, e.g. Path("containers", id+".json")
+func Path(elem ...string) string {
+	return filepath.Join(append([]string{Root}, elem...)...)
+}
+
+// WriteFile replaces a file atomically: the data is written and synced to
+// a temporary file in the same directory, which is renamed over path.
+// Readers see either the old or the new content, never a torn write.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// WriteJSON atomically writes v as indented JSON
+func WriteJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, data, 0644)
+}
+
+// ReadJSON reads a JSON record into v, upgrading it first if it was written
+// with an older schema. The upgrade is kept in memory; it is stored the next
+// time the record is written. schema may be nil for unversioned files.
+func ReadJSON(path string, v interface{}, schema *Schema) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if schema != nil {
+		if data, err = schema.migrate(data); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s is corrupt: %v", path, err)
+	}
+	return nil
+}
+
+// Schema is the layout of one kind of record. Records carry the version
+// they were written with in "schema_version"; records from before versions
+// were introduced have none and count as version 0.
+type Schema struct {
+	Kind string
+
+	// Migrations[n] upgrades a record from version n to n+1. A nil entry is a
+	// version that only added fields.
+	Migrations []Migration
+}
+
+// Migration upgrades a record, given as a generic JSON object, by one version
+type Migration func(record map[string]interface{}) error
+
+// Version returns the current version of the schema
+func (s *Schema) Version() int {
+	return len(s.Migrations)
+}
+
+func (s *Schema) migrate(data []byte) ([]byte, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("corrupt %s record: %v", s.Kind, err)
+	}
+
+	version := 0
+	if v, ok := record["schema_version"].(float64); ok {
+		version = int(v)
+	}
+	if version == s.Version() {
+		return data, nil
+	}
+	if version > s.Version() {
+		return nil, fmt.Errorf("%s record has schema version %d, newer than this minidocker supports (%d)", s.Kind, version, s.Version())
+	}
+
+	for ; version < s.Version(); version++ {
+		if migration := s.Migrations[version]; migration != nil {
+			if err := migration(record); err != nil {
+				return nil, fmt.Errorf("failed to upgrade %s record from schema version %d: %v", s.Kind, version, err)
+			}
+		}
+	}
+	record["schema_version"] = version
+
+	return json.Marshal(record)
+}
+
+// Lock is an flock(2) lock on a file in the store's locks directory. It
+// is held until released or until the process exits.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the exclusive lock of a name, waiting while another
+// process holds it. Locks are not reentrant: a process must not acquire a
+// lock it already holds.
+func Acquire(name string) (*Lock, error) {
+	return acquire(name, syscall.LOCK_EX)
+}
+
+// TryAcquire takes the exclusive lock of a name if no other process holds
+// it. It returns nil if the lock is taken.
+func TryAcquire(name string) (*Lock, error) {
+	l, err := acquire(name, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil, nil
+	}
+	return l, err
+}
+
+func acquire(name string, how int) (*Lock, error) {
+	path := Path("locks", name+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock %s: %v", name, err)
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", name, err)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release gives up the lock
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
@@ -1,20 +1,28 @@
 package volume
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/jagjeet-singh-23/minidocker/pkg/store"
 )
 
-const volumeBasePath = "/var/lib/minidocker/volumes"
+func volumeBasePath() string { return store.Path("volumes") }
+
+// volumeSchema versions volume records
+var volumeSchema = &store.Schema{
+	Kind:       "volume",
+	Migrations: []store.Migration{nil}, // 1: schema_version added
+}
 
 type Volume struct {
 	Name string       `json:"name"`
 	Mountpoint string `json:"mountpoint"`
 	Created time.Time `json:"created"`
 	Driver string     `json:"driver"`
+	SchemaVersion int `json:"schema_version"`
 }
 
 // CreateVolume creates a new named volume
@@ -23,8 +31,18 @@ func CreateVolume(name string) (*Volume, error) {
 		return nil, fmt.Errorf("volume name cannot be empty")
 	}
 
+	// Two containers may create the same volume at once
+	lock, err := store.Acquire("volume-" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	if volume, err := GetVolume(name); err == nil {
+		return volume, nil
+	}
+
 	// Check if volume already exists
-	volumePath := filepath.Join(volumeBasePath, name, "_data_")
+	volumePath := filepath.Join(volumeBasePath(), name, "_data_")
 	if err := os.MkdirAll(volumePath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create volume directory: %v", err)
 	}
@@ -38,7 +56,7 @@ func CreateVolume(name string) (*Volume, error) {
 
 	// Save volume metadata
 	if err := saveVolume(volume); err != nil {
-		os.RemoveAll(filepath.Join(volumeBasePath, name))
+		os.RemoveAll(filepath.Join(volumeBasePath(), name))
 		return nil, err
 	}
 
@@ -47,22 +65,21 @@ func CreateVolume(name string) (*Volume, error) {
 
 // VolumeExists checks if a volume exists
 func VolumeExists(name string) bool {
-	metadataPath := filepath.Join(volumeBasePath, name, "metadata.json")
+	metadataPath := filepath.Join(volumeBasePath(), name, "metadata.json")
 	_, err := os.Stat(metadataPath)
 	return err == nil
 }
 
 // GetVolume retrieves volume information
 func GetVolume(name string) (*Volume, error) {
-	metadataPath := filepath.Join(volumeBasePath, name, "metadata.json")
-	
-	data, err := os.ReadFile(metadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("Volume %s not found", name)
-	}
+	metadataPath := filepath.Join(volumeBasePath(), name, "metadata.json")
 
 	var volume Volume
-	if err := json.Unmarshal(data, &volume); err != nil {
+	err := store.ReadJSON(metadataPath, &volume, volumeSchema)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Volume %s not found", name)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -71,12 +88,12 @@ func GetVolume(name string) (*Volume, error) {
 
 // ListVolumes returns all volumes
 func ListVolumes() ([]*Volume, error) {
-	if _, err := os.Stat(volumeBasePath); os.IsNotExist(err) {
+	if _, err := os.Stat(volumeBasePath()); os.IsNotExist(err) {
 		return []*Volume{}, nil
 	}
 
 	var volumes []*Volume
-	entries, err := os.ReadDir(volumeBasePath)
+	entries, err := os.ReadDir(volumeBasePath())
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +105,9 @@ func ListVolumes() ([]*Volume, error) {
 
 		volume, err := GetVolume(entry.Name())
 		if err != nil {
+			if VolumeExists(entry.Name()) {
+				fmt.Fprintf(os.Stderr, "Warning: skipping volume %s: %v\n", entry.Name(), err)
+			}
 			continue
 		}
 		volumes = append(volumes, volume)
@@ -102,20 +122,16 @@ func RemoveVolume(name string) error {
 		return fmt.Errorf("volume %s not found", name)
 	}
 
-	volumePath := filepath.Join(volumeBasePath, name)
+	volumePath := filepath.Join(volumeBasePath(), name)
 	return os.RemoveAll(volumePath)
 }
 
 // saveVolume persists volume metadata
 func saveVolume(volume *Volume) error {
-	metadataPath := filepath.Join(volumeBasePath, volume.Name, "metadata.json")
-
-	data, err := json.MarshalIndent(volume, "", "  ")
-	if err != nil {
-		return err
-	}
+	metadataPath := filepath.Join(volumeBasePath(), volume.Name, "metadata.json")
 
-	return os.WriteFile(metadataPath, data, 0644)
+	volume.SchemaVersion = volumeSchema.Version()
+	return store.WriteJSON(metadataPath, volume)
 }
 
 // Mount represents a volume or bind mount